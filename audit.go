@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/a-h/serve/config"
+	"github.com/a-h/serve/handlers"
+)
+
+// audit checks the hash chain of an audit log, e.g. serve audit verify audit.jsonl
+func audit(args []string) error {
+	fs := flag.NewFlagSet("serve audit verify", flag.ContinueOnError)
+	key := fs.String("key", os.Getenv("SERVE_AUDIT_KEY"), "Secret key, the same as the server's -audit-key. (Env: SERVE_AUDIT_KEY)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: serve audit verify [options] <file>")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "verify" {
+		fs.Usage()
+		return fmt.Errorf("expected verify and the path of an audit log")
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected the path of an audit log")
+	}
+	if len(*key) < config.MinAuditKeyLength {
+		return fmt.Errorf("-key must be at least %d characters", config.MinAuditKeyLength)
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	entries, head, err := handlers.VerifyAuditLog(f, []byte(*key))
+	if err != nil {
+		return fmt.Errorf("%s: verified %d entries before: %w", fs.Arg(0), entries, err)
+	}
+	// Entries removed from the end of the log can only be detected by comparing the head with
+	// a previous run.
+	fmt.Printf("%s: verified %d entries, head %s\n", fs.Arg(0), entries, head)
+	return nil
+}
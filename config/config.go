@@ -5,20 +5,39 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
 	"time"
 )
 
 func New() (c *Config, err error) {
 	conf := &Config{
-		Dir:           ".",
-		Addr:          ":8080",
-		Crt:           "",
-		Key:           "",
-		LogRemoteAddr: false,
-		ReadOnly:      true,
-		Auth:          "",
-		LogFormat:     "text",
-		Help:          false,
+		Dir:             ".",
+		Addr:            ":8080",
+		Crt:             "",
+		Key:             "",
+		LogRemoteAddr:   false,
+		ReadOnly:        true,
+		Auth:            "",
+		LogFormat:       "text",
+		WebDAV:          false,
+		Tus:             false,
+		S3:              false,
+		S3Region:        "us-east-1",
+		TusMaxSize:      0,
+		HideDotfiles:    false,
+		Symlinks:        "within-root",
+		ProxyHeaders:    "x-forwarded",
+		JWTUserClaim:    "sub",
+		JWTGroupsClaim:  "groups",
+		ArchiveMaxSize:  1 << 30,
+		ArchiveMaxFiles: 10000,
+		ExtractMaxSize:  1 << 30,
+		ExtractMaxFiles: 10000,
+		AuthMaxFailures: 10,
+		AuthLockout:     15 * time.Minute,
+		SessionIdle:     30 * time.Minute,
+		SessionMaxAge:   12 * time.Hour,
+		Help:            false,
 	}
 
 	conf.FlagSet = flag.NewFlagSet("serve", flag.ContinueOnError)
@@ -26,13 +45,55 @@ func New() (c *Config, err error) {
 	conf.FlagSet.StringVar(&conf.Addr, "addr", conf.Addr, "Address to serve on. (Env: SERVE_ADDR)")
 	conf.FlagSet.StringVar(&conf.Crt, "crt", conf.Crt, "Path to crt file for TLS. (Env: SERVE_CRT)")
 	conf.FlagSet.StringVar(&conf.Key, "key", conf.Key, "Path to key file for TLS. (Env: SERVE_KEY)")
+	conf.FlagSet.StringVar(&conf.ClientCA, "client-ca", conf.ClientCA, "Path to PEM encoded CA certificates that TLS client certificates are verified against. Certificates are required unless another auth method or -acl-file is used. (Env: SERVE_CLIENT_CA)")
 	conf.FlagSet.BoolVar(&conf.LogRemoteAddr, "log-remote-addr", conf.LogRemoteAddr, "Log remote address. (Env: SERVE_LOG_REMOTE_ADDR)")
-	conf.FlagSet.BoolVar(&conf.ReadOnly, "read-only", conf.ReadOnly, "Allow only GET and HEAD requests. (Env: SERVE_READ_ONLY)")
+	conf.FlagSet.StringVar(&conf.TrustedProxies, "trusted-proxies", conf.TrustedProxies, "Comma separated CIDR ranges or IP addresses of proxies that the client IP and protocol are taken from the -proxy-headers of. (Env: SERVE_TRUSTED_PROXIES)")
+	conf.FlagSet.StringVar(&conf.ProxyHeaders, "proxy-headers", conf.ProxyHeaders, "Headers that the -trusted-proxies set, x-forwarded for X-Forwarded-For and X-Forwarded-Proto, or forwarded for Forwarded. The other headers are ignored. (Env: SERVE_PROXY_HEADERS)")
+	conf.FlagSet.StringVar(&conf.AllowRead, "allow-read", conf.AllowRead, "Comma separated CIDR ranges or IP addresses allowed to read (GET, HEAD, OPTIONS and PROPFIND), all if not set. (Env: SERVE_ALLOW_READ)")
+	conf.FlagSet.StringVar(&conf.DenyRead, "deny-read", conf.DenyRead, "Comma separated CIDR ranges or IP addresses denied reads, taking precedence over -allow-read. (Env: SERVE_DENY_READ)")
+	conf.FlagSet.StringVar(&conf.AllowWrite, "allow-write", conf.AllowWrite, "Comma separated CIDR ranges or IP addresses allowed to use other methods, e.g. PUT and DELETE, all if not set. (Env: SERVE_ALLOW_WRITE)")
+	conf.FlagSet.StringVar(&conf.DenyWrite, "deny-write", conf.DenyWrite, "Comma separated CIDR ranges or IP addresses denied other methods, taking precedence over -allow-write. (Env: SERVE_DENY_WRITE)")
+	conf.FlagSet.BoolVar(&conf.ReadOnly, "read-only", conf.ReadOnly, "Allow only read requests (GET, HEAD and, with -webdav, PROPFIND). (Env: SERVE_READ_ONLY)")
 	conf.FlagSet.StringVar(&conf.Auth, "auth", conf.Auth, "Username:Password for basic auth, no auth if not set. (Env: SERVE_AUTH)")
+	conf.FlagSet.StringVar(&conf.AuthFile, "auth-file", conf.AuthFile, "Path to an htpasswd file of users for basic auth, with bcrypt, SHA-256/512 crypt or argon2id hashes. Reloaded when changed. (Env: SERVE_AUTH_FILE)")
+	conf.FlagSet.Int64Var(&conf.AuthMaxFailures, "auth-max-failures", conf.AuthMaxFailures, "Number of failed basic auth attempts from an IP address or for a username before it's locked out for -auth-lockout. Attempts are slowed down with exponential backoff after 3 failures. 0 disables throttling. (Env: SERVE_AUTH_MAX_FAILURES)")
+	conf.FlagSet.DurationVar(&conf.AuthLockout, "auth-lockout", conf.AuthLockout, "Duration of a lockout after -auth-max-failures, also the duration after which failures are forgotten. (Env: SERVE_AUTH_LOCKOUT)")
+	conf.FlagSet.BoolVar(&conf.Login, "login", conf.Login, "Serve a login form at /.login for browsers, which starts a session stored in a cookie, as an alternative to basic auth. Requires -auth or -auth-file. (Env: SERVE_LOGIN)")
+	conf.FlagSet.StringVar(&conf.SessionKey, "session-key", conf.SessionKey, "Secret key, at least 32 characters, used to sign session cookies. A random key is used if not set, so sessions end when the server restarts. (Env: SERVE_SESSION_KEY)")
+	conf.FlagSet.DurationVar(&conf.SessionIdle, "session-idle-timeout", conf.SessionIdle, "Duration without requests after which a session ends. (Env: SERVE_SESSION_IDLE_TIMEOUT)")
+	conf.FlagSet.DurationVar(&conf.SessionMaxAge, "session-max-age", conf.SessionMaxAge, "Duration after logging in that a session ends, even if it's in use. (Env: SERVE_SESSION_MAX_AGE)")
+	conf.FlagSet.StringVar(&conf.APIKeyFile, "api-key-file", conf.APIKeyFile, "Path to a file of SHA-256 hashed API keys, accepted as Authorization: Bearer tokens, each with scopes, path prefixes and expiry. Reloaded when changed. (Env: SERVE_API_KEY_FILE)")
+	conf.FlagSet.StringVar(&conf.JWKS, "jwks", conf.JWKS, "Path or https URL of a JWKS used to verify RS256, ES256 and EdDSA signed JWTs, accepted as Authorization: Bearer tokens. (Env: SERVE_JWKS)")
+	conf.FlagSet.StringVar(&conf.JWTIssuer, "jwt-issuer", conf.JWTIssuer, "Required iss claim of JWTs. (Env: SERVE_JWT_ISSUER)")
+	conf.FlagSet.StringVar(&conf.JWTAudience, "jwt-audience", conf.JWTAudience, "Required aud claim of JWTs. (Env: SERVE_JWT_AUDIENCE)")
+	conf.FlagSet.StringVar(&conf.JWTUserClaim, "jwt-user-claim", conf.JWTUserClaim, "JWT claim used as the username. (Env: SERVE_JWT_USER_CLAIM)")
+	conf.FlagSet.StringVar(&conf.JWTGroupsClaim, "jwt-groups-claim", conf.JWTGroupsClaim, "JWT claim containing the groups of the user, which can be used in ACL rules. (Env: SERVE_JWT_GROUPS_CLAIM)")
+	conf.FlagSet.StringVar(&conf.URLSigningKey, "url-signing-key", conf.URLSigningKey, "Secret key, at least 32 characters, used to verify pre-signed URLs created with serve sign, which don't need other credentials. (Env: SERVE_URL_SIGNING_KEY)")
+	conf.FlagSet.StringVar(&conf.ShareLinksFile, "share-links-file", conf.ShareLinksFile, "Path to a JSON file, outside the served directory, that stores download-limited share links created at /.shares/ by authenticated users. (Env: SERVE_SHARE_LINKS_FILE)")
+	conf.FlagSet.StringVar(&conf.AuditLog, "audit-log", conf.AuditLog, "Path to a file, outside the served directory, that uploads, deletes and other changes are appended to as hash-chained JSON lines, which can be checked with serve audit verify. Requires -audit-key. (Env: SERVE_AUDIT_LOG)")
+	conf.FlagSet.StringVar(&conf.AuditKey, "audit-key", conf.AuditKey, "Secret key, at least 32 characters, used to sign the entries of the audit log, so that they can't be rewritten without it. (Env: SERVE_AUDIT_KEY)")
+	conf.FlagSet.StringVar(&conf.ACLFile, "acl-file", conf.ACLFile, "Path to a file of access control rules granting users and groups read, write and delete permissions for path globs. With auth, requests without credentials are allowed as anonymous. (Env: SERVE_ACL_FILE)")
 	conf.FlagSet.DurationVar(&conf.ReadTimeout, "read-timeout", 24*time.Hour, "Maximum duration for reading the entire request, including the body. (Env: SERVE_READ_TIMEOUT)")
 	conf.FlagSet.DurationVar(&conf.ReadHeaderTimeout, "read-header-timeout", 5*time.Second, "Amount of time allowed to read request headers. (Env: SERVE_READ_HEADER_TIMEOUT)")
 	conf.FlagSet.DurationVar(&conf.WriteTimeout, "write-timeout", 12*time.Hour, "Maximum duration before timing out writes of the response. (Env: SERVE_WRITE_TIMEOUT)")
+	conf.FlagSet.BoolVar(&conf.WebDAV, "webdav", conf.WebDAV, "Enable WebDAV methods, so that the directory can be mounted as a network drive. (Env: SERVE_WEBDAV)")
+	conf.FlagSet.StringVar(&conf.IndexTemplate, "index-template", conf.IndexTemplate, "Path to a Go html/template used to render directory listings. (Env: SERVE_INDEX_TEMPLATE)")
+	conf.FlagSet.BoolVar(&conf.HideDotfiles, "hide-dotfiles", conf.HideDotfiles, "Hide files and directories whose names start with a dot. (Env: SERVE_HIDE_DOTFILES)")
+	conf.FlagSet.StringVar(&conf.Symlinks, "symlinks", conf.Symlinks, "Symlink policy: deny hides symlinks and rejects writes through them, within-root follows symlinks that stay within the directory, follow also follows symlinks outside the directory for reads. (Env: SERVE_SYMLINKS)")
+	conf.FlagSet.Int64Var(&conf.ArchiveMaxSize, "archive-max-size", conf.ArchiveMaxSize, "Maximum total size in bytes of the files in a directory archive (?archive=zip or tar.gz), 0 for no limit. (Env: SERVE_ARCHIVE_MAX_SIZE)")
+	conf.FlagSet.Int64Var(&conf.ArchiveMaxFiles, "archive-max-files", conf.ArchiveMaxFiles, "Maximum number of files in a directory archive, 0 for no limit. (Env: SERVE_ARCHIVE_MAX_FILES)")
+	conf.FlagSet.Int64Var(&conf.ExtractMaxSize, "extract-max-size", conf.ExtractMaxSize, "Maximum total size in bytes of the files extracted from an uploaded archive (?extract=true), 0 for no limit. (Env: SERVE_EXTRACT_MAX_SIZE)")
+	conf.FlagSet.Int64Var(&conf.ExtractMaxFiles, "extract-max-files", conf.ExtractMaxFiles, "Maximum number of files extracted from an uploaded archive, 0 for no limit. (Env: SERVE_EXTRACT_MAX_FILES)")
+	conf.FlagSet.BoolVar(&conf.Tus, "tus", conf.Tus, "Accept resumable uploads using the tus protocol at /.tus/. (Env: SERVE_TUS)")
+	conf.FlagSet.Int64Var(&conf.TusMaxSize, "tus-max-size", conf.TusMaxSize, "Maximum size of a tus upload in bytes, 0 for no limit. (Env: SERVE_TUS_MAX_SIZE)")
+	conf.FlagSet.DurationVar(&conf.TusExpiry, "tus-expiry", 24*time.Hour, "Duration an incomplete tus or S3 multipart upload is kept without receiving data, 0 to keep forever. (Env: SERVE_TUS_EXPIRY)")
+	conf.FlagSet.BoolVar(&conf.S3, "s3", conf.S3, "Serve the directory using the S3 API instead, with top level directories as buckets. Requires -s3-access-key unless -read-only is set. (Env: SERVE_S3)")
+	conf.FlagSet.StringVar(&conf.S3AccessKey, "s3-access-key", conf.S3AccessKey, "Access key ID that S3 requests must be signed with, no auth if not set, which requires -read-only. (Env: SERVE_S3_ACCESS_KEY)")
+	conf.FlagSet.StringVar(&conf.S3SecretKey, "s3-secret-key", conf.S3SecretKey, "Secret access key that S3 requests must be signed with. (Env: SERVE_S3_SECRET_KEY)")
+	conf.FlagSet.StringVar(&conf.S3Region, "s3-region", conf.S3Region, "Region reported to S3 clients. (Env: SERVE_S3_REGION)")
 	conf.FlagSet.StringVar(&conf.LogFormat, "log-format", conf.LogFormat, "Log format: text or json. (Env: SERVE_LOG_FORMAT)")
+	conf.FlagSet.StringVar(&conf.AccessLogFormat, "access-log-format", conf.AccessLogFormat, "Write requests to an access log instead of the log, in the format: clf (Common Log Format), combined (Combined Log Format), json, or a Go text/template executed with each request, e.g. '{{.Method}} {{.URL}} {{.Status}}'. (Env: SERVE_ACCESS_LOG_FORMAT)")
+	conf.FlagSet.StringVar(&conf.AccessLogFile, "access-log-file", conf.AccessLogFile, "Path to a file that the access log is appended to, stdout if not set. Defaults -access-log-format to combined. (Env: SERVE_ACCESS_LOG_FILE)")
 	conf.FlagSet.BoolVar(&conf.Help, "help", conf.Help, "Print help.")
 	if err = conf.FlagSet.Parse(os.Args[1:]); err != nil {
 		return nil, err
@@ -52,15 +113,94 @@ func New() (c *Config, err error) {
 	if keyEnv := os.Getenv("SERVE_KEY"); keyEnv != "" {
 		conf.Key = keyEnv
 	}
+	if clientCAEnv := os.Getenv("SERVE_CLIENT_CA"); clientCAEnv != "" {
+		conf.ClientCA = clientCAEnv
+	}
 	if remoteAddrEnv := os.Getenv("SERVE_LOG_REMOTE_ADDR"); remoteAddrEnv != "" {
 		conf.LogRemoteAddr = remoteAddrEnv == "true"
 	}
+	if trustedProxiesEnv := os.Getenv("SERVE_TRUSTED_PROXIES"); trustedProxiesEnv != "" {
+		conf.TrustedProxies = trustedProxiesEnv
+	}
+	if proxyHeadersEnv := os.Getenv("SERVE_PROXY_HEADERS"); proxyHeadersEnv != "" {
+		conf.ProxyHeaders = proxyHeadersEnv
+	}
+	if allowReadEnv := os.Getenv("SERVE_ALLOW_READ"); allowReadEnv != "" {
+		conf.AllowRead = allowReadEnv
+	}
+	if denyReadEnv := os.Getenv("SERVE_DENY_READ"); denyReadEnv != "" {
+		conf.DenyRead = denyReadEnv
+	}
+	if allowWriteEnv := os.Getenv("SERVE_ALLOW_WRITE"); allowWriteEnv != "" {
+		conf.AllowWrite = allowWriteEnv
+	}
+	if denyWriteEnv := os.Getenv("SERVE_DENY_WRITE"); denyWriteEnv != "" {
+		conf.DenyWrite = denyWriteEnv
+	}
 	if readOnlyEnv := os.Getenv("SERVE_READ_ONLY"); readOnlyEnv != "" {
 		conf.ReadOnly = readOnlyEnv == "true"
 	}
 	if authEnv := os.Getenv("SERVE_AUTH"); authEnv != "" {
 		conf.Auth = authEnv
 	}
+	if authFileEnv := os.Getenv("SERVE_AUTH_FILE"); authFileEnv != "" {
+		conf.AuthFile = authFileEnv
+	}
+	conf.AuthMaxFailures, err = parseInt64Env("SERVE_AUTH_MAX_FAILURES", conf.AuthMaxFailures)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid SERVE_AUTH_MAX_FAILURES: %w", err))
+	}
+	conf.AuthLockout, err = parseDurationEnv("SERVE_AUTH_LOCKOUT", conf.AuthLockout)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid SERVE_AUTH_LOCKOUT: %w", err))
+	}
+	if loginEnv := os.Getenv("SERVE_LOGIN"); loginEnv != "" {
+		conf.Login = loginEnv == "true"
+	}
+	if sessionKeyEnv := os.Getenv("SERVE_SESSION_KEY"); sessionKeyEnv != "" {
+		conf.SessionKey = sessionKeyEnv
+	}
+	conf.SessionIdle, err = parseDurationEnv("SERVE_SESSION_IDLE_TIMEOUT", conf.SessionIdle)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid SERVE_SESSION_IDLE_TIMEOUT: %w", err))
+	}
+	conf.SessionMaxAge, err = parseDurationEnv("SERVE_SESSION_MAX_AGE", conf.SessionMaxAge)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid SERVE_SESSION_MAX_AGE: %w", err))
+	}
+	if apiKeyFileEnv := os.Getenv("SERVE_API_KEY_FILE"); apiKeyFileEnv != "" {
+		conf.APIKeyFile = apiKeyFileEnv
+	}
+	if jwksEnv := os.Getenv("SERVE_JWKS"); jwksEnv != "" {
+		conf.JWKS = jwksEnv
+	}
+	if jwtIssuerEnv := os.Getenv("SERVE_JWT_ISSUER"); jwtIssuerEnv != "" {
+		conf.JWTIssuer = jwtIssuerEnv
+	}
+	if jwtAudienceEnv := os.Getenv("SERVE_JWT_AUDIENCE"); jwtAudienceEnv != "" {
+		conf.JWTAudience = jwtAudienceEnv
+	}
+	if jwtUserClaimEnv := os.Getenv("SERVE_JWT_USER_CLAIM"); jwtUserClaimEnv != "" {
+		conf.JWTUserClaim = jwtUserClaimEnv
+	}
+	if jwtGroupsClaimEnv := os.Getenv("SERVE_JWT_GROUPS_CLAIM"); jwtGroupsClaimEnv != "" {
+		conf.JWTGroupsClaim = jwtGroupsClaimEnv
+	}
+	if urlSigningKeyEnv := os.Getenv("SERVE_URL_SIGNING_KEY"); urlSigningKeyEnv != "" {
+		conf.URLSigningKey = urlSigningKeyEnv
+	}
+	if shareLinksFileEnv := os.Getenv("SERVE_SHARE_LINKS_FILE"); shareLinksFileEnv != "" {
+		conf.ShareLinksFile = shareLinksFileEnv
+	}
+	if auditLogEnv := os.Getenv("SERVE_AUDIT_LOG"); auditLogEnv != "" {
+		conf.AuditLog = auditLogEnv
+	}
+	if auditKeyEnv := os.Getenv("SERVE_AUDIT_KEY"); auditKeyEnv != "" {
+		conf.AuditKey = auditKeyEnv
+	}
+	if aclFileEnv := os.Getenv("SERVE_ACL_FILE"); aclFileEnv != "" {
+		conf.ACLFile = aclFileEnv
+	}
 	conf.ReadTimeout, err = parseDurationEnv("SERVE_READ_TIMEOUT", conf.ReadTimeout)
 	if err != nil {
 		errs = append(errs, fmt.Errorf("invalid SERVE_READ_TIMEOUT: %w", err))
@@ -73,14 +213,80 @@ func New() (c *Config, err error) {
 	if err != nil {
 		errs = append(errs, fmt.Errorf("invalid SERVE_WRITE_TIMEOUT: %w", err))
 	}
+	if webDAVEnv := os.Getenv("SERVE_WEBDAV"); webDAVEnv != "" {
+		conf.WebDAV = webDAVEnv == "true"
+	}
+	if indexTemplateEnv := os.Getenv("SERVE_INDEX_TEMPLATE"); indexTemplateEnv != "" {
+		conf.IndexTemplate = indexTemplateEnv
+	}
+	if hideDotfilesEnv := os.Getenv("SERVE_HIDE_DOTFILES"); hideDotfilesEnv != "" {
+		conf.HideDotfiles = hideDotfilesEnv == "true"
+	}
+	if symlinksEnv := os.Getenv("SERVE_SYMLINKS"); symlinksEnv != "" {
+		conf.Symlinks = symlinksEnv
+	}
+	conf.ArchiveMaxSize, err = parseInt64Env("SERVE_ARCHIVE_MAX_SIZE", conf.ArchiveMaxSize)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid SERVE_ARCHIVE_MAX_SIZE: %w", err))
+	}
+	conf.ArchiveMaxFiles, err = parseInt64Env("SERVE_ARCHIVE_MAX_FILES", conf.ArchiveMaxFiles)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid SERVE_ARCHIVE_MAX_FILES: %w", err))
+	}
+	conf.ExtractMaxSize, err = parseInt64Env("SERVE_EXTRACT_MAX_SIZE", conf.ExtractMaxSize)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid SERVE_EXTRACT_MAX_SIZE: %w", err))
+	}
+	conf.ExtractMaxFiles, err = parseInt64Env("SERVE_EXTRACT_MAX_FILES", conf.ExtractMaxFiles)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid SERVE_EXTRACT_MAX_FILES: %w", err))
+	}
+	if tusEnv := os.Getenv("SERVE_TUS"); tusEnv != "" {
+		conf.Tus = tusEnv == "true"
+	}
+	conf.TusMaxSize, err = parseInt64Env("SERVE_TUS_MAX_SIZE", conf.TusMaxSize)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid SERVE_TUS_MAX_SIZE: %w", err))
+	}
+	conf.TusExpiry, err = parseDurationEnv("SERVE_TUS_EXPIRY", conf.TusExpiry)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid SERVE_TUS_EXPIRY: %w", err))
+	}
+	if s3Env := os.Getenv("SERVE_S3"); s3Env != "" {
+		conf.S3 = s3Env == "true"
+	}
+	if s3AccessKeyEnv := os.Getenv("SERVE_S3_ACCESS_KEY"); s3AccessKeyEnv != "" {
+		conf.S3AccessKey = s3AccessKeyEnv
+	}
+	if s3SecretKeyEnv := os.Getenv("SERVE_S3_SECRET_KEY"); s3SecretKeyEnv != "" {
+		conf.S3SecretKey = s3SecretKeyEnv
+	}
+	if s3RegionEnv := os.Getenv("SERVE_S3_REGION"); s3RegionEnv != "" {
+		conf.S3Region = s3RegionEnv
+	}
 	conf.LogFormat, err = parseLogFormat("SERVE_LOG_FORMAT", conf.LogFormat)
 	if err != nil {
 		errs = append(errs, fmt.Errorf("invalid SERVE_LOG_FORMAT: %w", err))
 	}
+	if accessLogFormatEnv := os.Getenv("SERVE_ACCESS_LOG_FORMAT"); accessLogFormatEnv != "" {
+		conf.AccessLogFormat = accessLogFormatEnv
+	}
+	if accessLogFileEnv := os.Getenv("SERVE_ACCESS_LOG_FILE"); accessLogFileEnv != "" {
+		conf.AccessLogFile = accessLogFileEnv
+	}
 
 	return conf, errors.Join(errs...)
 }
 
+// MinURLSigningKeyLength is the minimum length of the key used to sign URLs.
+const MinURLSigningKeyLength = 32
+
+// MinAuditKeyLength is the minimum length of the key used to sign audit log entries.
+const MinAuditKeyLength = 32
+
+// MinSessionKeyLength is the minimum length of the key used to sign session cookies.
+const MinSessionKeyLength = 32
+
 func parseLogFormat(envVar string, defaultVal string) (string, error) {
 	val := os.Getenv(envVar)
 	if val == "" {
@@ -100,19 +306,69 @@ func parseDurationEnv(envVar string, defaultVal time.Duration) (d time.Duration,
 	return time.ParseDuration(val)
 }
 
+func parseInt64Env(envVar string, defaultVal int64) (int64, error) {
+	val := os.Getenv(envVar)
+	if val == "" {
+		return defaultVal, nil
+	}
+	return strconv.ParseInt(val, 10, 64)
+}
+
 type Config struct {
 	FlagSet           *flag.FlagSet
 	Dir               string
 	Addr              string
 	Crt               string
 	Key               string
+	ClientCA          string
 	LogRemoteAddr     bool
+	TrustedProxies    string
+	ProxyHeaders      string
+	AllowRead         string
+	DenyRead          string
+	AllowWrite        string
+	DenyWrite         string
 	ReadOnly          bool
 	Auth              string
+	AuthFile          string
+	AuthMaxFailures   int64
+	AuthLockout       time.Duration
+	Login             bool
+	SessionKey        string
+	SessionIdle       time.Duration
+	SessionMaxAge     time.Duration
+	APIKeyFile        string
+	JWKS              string
+	JWTIssuer         string
+	JWTAudience       string
+	JWTUserClaim      string
+	JWTGroupsClaim    string
+	URLSigningKey     string
+	ShareLinksFile    string
+	AuditLog          string
+	AuditKey          string
+	ACLFile           string
 	ReadTimeout       time.Duration
 	ReadHeaderTimeout time.Duration
 	WriteTimeout      time.Duration
+	WebDAV            bool
+	IndexTemplate     string
+	HideDotfiles      bool
+	Symlinks          string
+	ArchiveMaxSize    int64
+	ArchiveMaxFiles   int64
+	ExtractMaxSize    int64
+	ExtractMaxFiles   int64
+	Tus               bool
+	TusMaxSize        int64
+	TusExpiry         time.Duration
+	S3                bool
+	S3AccessKey       string
+	S3SecretKey       string
+	S3Region          string
 	LogFormat         string
+	AccessLogFormat   string
+	AccessLogFile     string
 	Help              bool
 }
 
@@ -120,7 +376,67 @@ func (c *Config) Validate() error {
 	if (c.Crt != "" && c.Key == "") || (c.Crt == "" && c.Key != "") {
 		return ErrCrtKeyMismatch
 	}
+	if c.ClientCA != "" && c.Crt == "" {
+		return ErrClientCA
+	}
+	if (c.S3AccessKey != "" && c.S3SecretKey == "") || (c.S3AccessKey == "" && c.S3SecretKey != "") {
+		return ErrS3KeyMismatch
+	}
+	if c.Auth != "" && c.AuthFile != "" {
+		return ErrAuthFile
+	}
+	if c.AuthMaxFailures < 0 || (c.AuthMaxFailures > 0 && c.AuthLockout <= 0) {
+		return ErrAuthLockout
+	}
+	if c.Login && c.Auth == "" && c.AuthFile == "" {
+		return ErrLogin
+	}
+	if c.SessionKey != "" && len(c.SessionKey) < MinSessionKeyLength {
+		return ErrSessionKey
+	}
+	if c.Login && (c.SessionIdle <= 0 || c.SessionMaxAge <= 0) {
+		return ErrSessionTimeout
+	}
+	if c.JWKS != "" && (c.JWTIssuer == "" || c.JWTAudience == "") {
+		return ErrJWT
+	}
+	if c.URLSigningKey != "" && len(c.URLSigningKey) < MinURLSigningKeyLength {
+		return ErrURLSigningKey
+	}
+	if (c.AuditLog != "" || c.AuditKey != "") && (c.AuditLog == "" || len(c.AuditKey) < MinAuditKeyLength) {
+		return ErrAuditKey
+	}
+	if c.S3 && (c.Auth != "" || c.AuthFile != "" || c.APIKeyFile != "" || c.JWKS != "" || c.URLSigningKey != "") {
+		return ErrS3Auth
+	}
+	if c.S3 && (c.ClientCA != "" || c.Login || c.ShareLinksFile != "" || c.Tus || c.WebDAV || c.IndexTemplate != "") {
+		return ErrS3Unsupported
+	}
+	if c.S3 && c.S3AccessKey == "" && !c.ReadOnly {
+		return ErrS3ReadOnly
+	}
+	if c.Symlinks != "deny" && c.Symlinks != "within-root" && c.Symlinks != "follow" {
+		return ErrSymlinks
+	}
+	if c.ProxyHeaders != "x-forwarded" && c.ProxyHeaders != "forwarded" {
+		return ErrProxyHeaders
+	}
 	return nil
 }
 
 var ErrCrtKeyMismatch = fmt.Errorf("-crt and -key must be used together.")
+var ErrClientCA = fmt.Errorf("-client-ca requires -crt and -key.")
+var ErrS3KeyMismatch = fmt.Errorf("-s3-access-key and -s3-secret-key must be used together.")
+var ErrAuthFile = fmt.Errorf("-auth and -auth-file can't be used together.")
+var ErrAuthLockout = fmt.Errorf("-auth-max-failures must not be negative, and -auth-lockout must be positive.")
+var ErrLogin = fmt.Errorf("-login requires -auth or -auth-file.")
+var ErrSessionKey = fmt.Errorf("-session-key must be at least %d characters.", MinSessionKeyLength)
+var ErrSessionTimeout = fmt.Errorf("-session-idle-timeout and -session-max-age must be positive.")
+var ErrJWT = fmt.Errorf("-jwks requires -jwt-issuer and -jwt-audience.")
+var ErrURLSigningKey = fmt.Errorf("-url-signing-key must be at least %d characters.", MinURLSigningKeyLength)
+var ErrAuditKey = fmt.Errorf("-audit-log and -audit-key must be used together, and -audit-key must be at least %d characters.", MinAuditKeyLength)
+var ErrS3Unsupported = fmt.Errorf("-client-ca, -login, -share-links-file, -tus, -webdav and -index-template can't be used with -s3.")
+var ErrS3ReadOnly = fmt.Errorf("-s3 requires -s3-access-key and -s3-secret-key unless -read-only is set.")
+var ErrS3Auth = fmt.Errorf("-auth, -auth-file, -api-key-file, -jwks and -url-signing-key can't be used with -s3, use -s3-access-key and -s3-secret-key instead.")
+var ErrSymlinks = fmt.Errorf("-symlinks must be deny, within-root or follow.")
+var ErrProxyHeaders = fmt.Errorf("-proxy-headers must be x-forwarded or forwarded.")
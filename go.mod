@@ -1,3 +1,10 @@
 module github.com/a-h/serve
 
 go 1.25.4
+
+require (
+	golang.org/x/crypto v0.55.0
+	golang.org/x/net v0.58.0
+)
+
+require golang.org/x/sys v0.47.0 // indirect
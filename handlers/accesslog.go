@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Access log formats.
+const (
+	// AccessLogCLF is the NCSA Common Log Format.
+	AccessLogCLF = "clf"
+	// AccessLogCombined is the NCSA Combined Log Format, which adds the referer and user agent.
+	AccessLogCombined = "combined"
+	// AccessLogJSON writes a JSON object per request.
+	AccessLogJSON = "json"
+)
+
+// clfTimeFormat is the format of timestamps in the Common Log Format.
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLogEntry is a request written to the access log. Custom templates are executed with it.
+type AccessLogEntry struct {
+	Time time.Time
+	// RemoteAddr is the client IP address, or empty if it's not logged.
+	RemoteAddr string
+	// User is the authenticated user, or empty if anonymous.
+	User   string
+	Method string
+	// URL is the request URI, with URL signatures redacted.
+	URL    string
+	Proto  string
+	Status int
+	// Bytes is the number of bytes of the response body that were sent.
+	Bytes int64
+	// RequestBytes is the number of bytes of the request body that were read, e.g. of an upload.
+	RequestBytes int64
+	Referer      string
+	UserAgent    string
+	Duration     time.Duration
+	// TTFB is the time to first byte, from the start of the request until the response started
+	// to be written.
+	TTFB time.Duration
+	// Aborted is true if the client disconnected before the response was sent, or before the
+	// request body was received.
+	Aborted bool
+	// RequestID is the ID returned to the client in the X-Request-ID header.
+	RequestID string
+}
+
+// NewAccessLog writes requests to w in the format, which is clf, combined, json, or a Go
+// text/template executed with an AccessLogEntry, e.g. `{{.Method}} {{.URL}} {{.Status}}`.
+func NewAccessLog(w io.Writer, format string) (*AccessLog, error) {
+	l := &AccessLog{w: w}
+	switch format {
+	case AccessLogCLF:
+		l.format = formatCLF
+	case AccessLogCombined:
+		l.format = formatCombined
+	case AccessLogJSON:
+		l.format = formatAccessLogJSON
+	default:
+		tmpl, err := template.New("access-log").Parse(format)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access log template: %w", err)
+		}
+		l.format = func(buf *bytes.Buffer, e *AccessLogEntry) error {
+			return tmpl.Execute(buf, e)
+		}
+	}
+	return l, nil
+}
+
+type AccessLog struct {
+	format func(buf *bytes.Buffer, e *AccessLogEntry) error
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Log writes the entry as a single line.
+func (l *AccessLog) Log(e *AccessLogEntry) error {
+	var buf bytes.Buffer
+	if err := l.format(&buf, e); err != nil {
+		return err
+	}
+	if buf.Len() == 0 || buf.Bytes()[buf.Len()-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.w.Write(buf.Bytes())
+	return err
+}
+
+// formatCLF writes host ident user [time] "request" status bytes.
+func formatCLF(buf *bytes.Buffer, e *AccessLogEntry) error {
+	buf.WriteString(clfField(e.RemoteAddr))
+	buf.WriteString(" - ")
+	buf.WriteString(clfField(e.User))
+	buf.WriteString(" [")
+	buf.WriteString(e.Time.Format(clfTimeFormat))
+	buf.WriteString(`] "`)
+	buf.WriteString(clfEscape(e.Method + " " + e.URL + " " + e.Proto))
+	buf.WriteString(`" `)
+	buf.WriteString(strconv.Itoa(e.Status))
+	buf.WriteByte(' ')
+	if e.Bytes == 0 {
+		buf.WriteByte('-')
+	} else {
+		buf.WriteString(strconv.FormatInt(e.Bytes, 10))
+	}
+	return nil
+}
+
+// formatCombined writes the Common Log Format followed by "referer" "user agent".
+func formatCombined(buf *bytes.Buffer, e *AccessLogEntry) error {
+	formatCLF(buf, e)
+	buf.WriteString(` "`)
+	buf.WriteString(clfEscape(orDash(e.Referer)))
+	buf.WriteString(`" "`)
+	buf.WriteString(clfEscape(orDash(e.UserAgent)))
+	buf.WriteByte('"')
+	return nil
+}
+
+func formatAccessLogJSON(buf *bytes.Buffer, e *AccessLogEntry) error {
+	return json.NewEncoder(buf).Encode(struct {
+		Time         time.Time `json:"time"`
+		RemoteAddr   string    `json:"remote_addr,omitempty"`
+		User         string    `json:"user,omitempty"`
+		Method       string    `json:"method"`
+		URL          string    `json:"url"`
+		Proto        string    `json:"proto"`
+		Status       int       `json:"status"`
+		Bytes        int64     `json:"bytes"`
+		RequestBytes int64     `json:"request_bytes"`
+		Referer      string    `json:"referer,omitempty"`
+		UserAgent    string    `json:"user_agent,omitempty"`
+		DurationMS   float64   `json:"duration_ms"`
+		TTFBMS       float64   `json:"ttfb_ms"`
+		Aborted      bool      `json:"aborted"`
+		RequestID    string    `json:"request_id,omitempty"`
+	}{
+		Time:         e.Time,
+		RemoteAddr:   e.RemoteAddr,
+		User:         e.User,
+		Method:       e.Method,
+		URL:          e.URL,
+		Proto:        e.Proto,
+		Status:       e.Status,
+		Bytes:        e.Bytes,
+		RequestBytes: e.RequestBytes,
+		Referer:      e.Referer,
+		UserAgent:    e.UserAgent,
+		DurationMS:   float64(e.Duration) / float64(time.Millisecond),
+		TTFBMS:       float64(e.TTFB) / float64(time.Millisecond),
+		Aborted:      e.Aborted,
+		RequestID:    e.RequestID,
+	})
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// clfField returns a field that isn't quoted, so spaces are escaped to keep the fields apart.
+func clfField(s string) string {
+	return strings.ReplaceAll(clfEscape(orDash(s)), " ", `\x20`)
+}
+
+// clfEscape escapes quotes, backslashes and control characters like Apache does, so that
+// clients can't forge log lines.
+func clfEscape(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&sb, `\x%02x`, c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
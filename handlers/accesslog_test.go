@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	entry := &AccessLogEntry{
+		Time:       time.Date(2025, 3, 4, 5, 6, 7, 0, time.FixedZone("", -7*60*60)),
+		RemoteAddr: "192.0.2.1",
+		User:       "alice",
+		Method:     http.MethodGet,
+		URL:        "/docs/report.pdf?download=true",
+		Proto:      "HTTP/1.1",
+		Status:     http.StatusOK,
+		Bytes:      2326,
+		Referer:    "https://example.com/",
+		UserAgent:  `curl/8.0 "quoted"`,
+		Duration:   1500 * time.Microsecond,
+	}
+	tests := []struct {
+		format   string
+		entry    *AccessLogEntry
+		expected string
+	}{
+		{
+			format:   AccessLogCLF,
+			entry:    entry,
+			expected: `192.0.2.1 - alice [04/Mar/2025:05:06:07 -0700] "GET /docs/report.pdf?download=true HTTP/1.1" 200 2326` + "\n",
+		},
+		{
+			format:   AccessLogCombined,
+			entry:    entry,
+			expected: `192.0.2.1 - alice [04/Mar/2025:05:06:07 -0700] "GET /docs/report.pdf?download=true HTTP/1.1" 200 2326 "https://example.com/" "curl/8.0 \"quoted\""` + "\n",
+		},
+		{
+			format:   AccessLogCombined,
+			entry:    &AccessLogEntry{Time: entry.Time, Method: http.MethodHead, URL: "/", Proto: "HTTP/2.0", Status: http.StatusNotModified},
+			expected: `- - - [04/Mar/2025:05:06:07 -0700] "HEAD / HTTP/2.0" 304 - "-" "-"` + "\n",
+		},
+		{
+			format:   AccessLogCLF,
+			entry:    &AccessLogEntry{Time: entry.Time, User: "bob smith\n", Method: http.MethodGet, URL: "/a\"b", Proto: "HTTP/1.1", Status: http.StatusOK},
+			expected: `- - bob\x20smith\x0a [04/Mar/2025:05:06:07 -0700] "GET /a\"b HTTP/1.1" 200 -` + "\n",
+		},
+		{
+			format:   "{{.Method}} {{.URL}} {{.Status}} {{.Duration}}",
+			entry:    entry,
+			expected: "GET /docs/report.pdf?download=true 200 1.5ms\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			l, err := NewAccessLog(&buf, tt.format)
+			if err != nil {
+				t.Fatalf("Failed to create access log: %v", err)
+			}
+			if err = l.Log(tt.entry); err != nil {
+				t.Fatalf("Failed to log: %v", err)
+			}
+			if buf.String() != tt.expected {
+				t.Errorf("Expected:\n%s\nGot:\n%s", tt.expected, buf.String())
+			}
+		})
+	}
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		l, _ := NewAccessLog(&buf, AccessLogJSON)
+		if err := l.Log(entry); err != nil {
+			t.Fatalf("Failed to log: %v", err)
+		}
+		var actual map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &actual); err != nil {
+			t.Fatalf("Failed to decode %q: %v", buf.String(), err)
+		}
+		if actual["user"] != "alice" || actual["bytes"] != 2326.0 || actual["user_agent"] != entry.UserAgent || actual["duration_ms"] != 1.5 {
+			t.Errorf("Unexpected entry %v", actual)
+		}
+	})
+	t.Run("invalid templates are rejected", func(t *testing.T) {
+		if _, err := NewAccessLog(&bytes.Buffer{}, "{{.Method"); err == nil {
+			t.Error("Expected an error")
+		}
+	})
+	t.Run("the logging middleware writes requests to the access log", func(t *testing.T) {
+		var buf bytes.Buffer
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello"))
+		})
+		m := NewLoggingMiddleware(slog.New(slog.DiscardHandler), true, next)
+		m.AccessLog, _ = NewAccessLog(&buf, AccessLogCombined)
+		req := httptest.NewRequest(http.MethodGet, "/file.txt?serve-signature=secret", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("User-Agent", "test")
+		m.ServeHTTP(httptest.NewRecorder(), req.WithContext(WithIdentity(req.Context(), &Identity{Name: "alice"})))
+		expected := `192.0.2.1 - alice [`
+		if !strings.HasPrefix(buf.String(), expected) || !strings.HasSuffix(buf.String(), `] "GET /file.txt?serve-signature=REDACTED HTTP/1.1" 200 5 "-" "test"`+"\n") {
+			t.Errorf("Unexpected access log %q", buf.String())
+		}
+	})
+	t.Run("the logging middleware records request bytes, time to first byte and aborts", func(t *testing.T) {
+		var buf bytes.Buffer
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := io.Copy(io.Discard, r.Body); err != nil {
+				http.Error(w, "failed to read body", http.StatusBadRequest)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+			w.Write([]byte("saved"))
+		})
+		m := NewLoggingMiddleware(slog.New(slog.DiscardHandler), false, next)
+		m.AccessLog, _ = NewAccessLog(&buf, "{{.Status}} {{.Bytes}} {{.RequestBytes}} {{.Aborted}} {{.TTFB.Milliseconds}}")
+		serve := func(w http.ResponseWriter, body io.Reader) (status, n, requestBytes int64, aborted bool, ttfb int64) {
+			buf.Reset()
+			m.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/upload.bin", body))
+			fmt.Sscan(buf.String(), &status, &n, &requestBytes, &aborted, &ttfb)
+			return
+		}
+
+		status, n, requestBytes, aborted, ttfb := serve(httptest.NewRecorder(), strings.NewReader("0123456789"))
+		if status != 200 || n != 5 || requestBytes != 10 || aborted || ttfb < 10 {
+			t.Errorf("Unexpected upload entry %q", buf.String())
+		}
+		_, _, requestBytes, aborted, _ = serve(httptest.NewRecorder(), io.MultiReader(strings.NewReader("01234"), iotest.ErrReader(io.ErrUnexpectedEOF)))
+		if requestBytes != 5 || !aborted {
+			t.Errorf("Expected an aborted upload, got %q", buf.String())
+		}
+		_, n, _, aborted, _ = serve(failingWriter{httptest.NewRecorder()}, http.NoBody)
+		if n != 0 || !aborted {
+			t.Errorf("Expected an aborted download, got %q", buf.String())
+		}
+	})
+}
+
+// failingWriter fails writes, as if the client disconnected.
+type failingWriter struct {
+	http.ResponseWriter
+}
+
+func (failingWriter) Write(b []byte) (int, error) {
+	return 0, syscall.EPIPE
+}
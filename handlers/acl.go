@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Permission is a set of operations that can be performed on a path.
+type Permission uint8
+
+const (
+	PermissionRead Permission = 1 << iota
+	PermissionWrite
+	PermissionDelete
+	PermissionAll = PermissionRead | PermissionWrite | PermissionDelete
+)
+
+func (p Permission) String() string {
+	var names []string
+	for _, perm := range []struct {
+		p    Permission
+		name string
+	}{{PermissionRead, "read"}, {PermissionWrite, "write"}, {PermissionDelete, "delete"}} {
+		if p&perm.p != 0 {
+			names = append(names, perm.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// ParsePermission parses a comma separated list of permissions: read, write, delete or all.
+func ParsePermission(s string) (p Permission, err error) {
+	for name := range strings.SplitSeq(s, ",") {
+		switch strings.TrimSpace(name) {
+		case "read":
+			p |= PermissionRead
+		case "write":
+			p |= PermissionWrite
+		case "delete":
+			p |= PermissionDelete
+		case "all":
+			p |= PermissionAll
+		default:
+			return 0, fmt.Errorf("invalid permission %q, must be read, write, delete or all", name)
+		}
+	}
+	return p, nil
+}
+
+// Authorizer decides which operations each user can perform.
+type Authorizer interface {
+	// Authorize returns true if the identity, which is nil for anonymous requests, has the
+	// permission for the URL path, e.g. /docs/readme.md.
+	Authorize(id *Identity, urlPath string, perm Permission) bool
+}
+
+type staticAuthorizer Permission
+
+func (a staticAuthorizer) Authorize(id *Identity, urlPath string, perm Permission) bool {
+	return Permission(a)&perm == perm
+}
+
+// AllowAll grants every permission to everyone.
+var AllowAll Authorizer = staticAuthorizer(PermissionAll)
+
+// authorize returns true if the request has the permission for the path within the root,
+// otherwise it writes a 401 or 403 response, or a 405 response for writes to a read-only server.
+func (h *FileHandler) authorize(w http.ResponseWriter, r *http.Request, cleaned string, perm Permission) bool {
+	if h.isAuthorized(r, cleaned, perm) {
+		return true
+	}
+	if h.IsReadOnly && perm&^PermissionRead != 0 {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	deny(w, r)
+	return false
+}
+
+func (h *FileHandler) isAuthorized(r *http.Request, cleaned string, perm Permission) bool {
+	return h.isAuthorizedContext(r.Context(), cleaned, perm)
+}
+
+// isAuthorizedContext is isAuthorized for the identity of the context, for the WebDAV file
+// system, which only has the context of the request.
+func (h *FileHandler) isAuthorizedContext(ctx context.Context, cleaned string, perm Permission) bool {
+	if h.IsReadOnly && perm&^PermissionRead != 0 {
+		return false
+	}
+	if cleaned == "." {
+		cleaned = ""
+	}
+	id := IdentityFromContext(ctx)
+	if id != nil && id.Scope != nil && !id.Scope.Allows("/"+cleaned, perm) {
+		return false
+	}
+	return h.Authorizer.Authorize(id, "/"+cleaned, perm)
+}
+
+// authorizeTree is authorize for the path and everything within it, for operations such as
+// recursive deletes that affect the whole tree.
+func (h *FileHandler) authorizeTree(w http.ResponseWriter, r *http.Request, cleaned string, perm Permission) bool {
+	if !h.authorize(w, r, cleaned, perm) {
+		return false
+	}
+	if !h.isAuthorizedTree(r, cleaned, cleaned, perm) {
+		deny(w, r)
+		return false
+	}
+	return true
+}
+
+var errTreeUnauthorized = errors.New("unauthorized")
+
+// isAuthorizedTree returns true if the request has the permission for every file and directory
+// within src, with their paths moved from src to dst, so that copies and extracted archives are
+// authorized for the paths they will have. Symlinks aren't followed, and if src doesn't exist,
+// there's nothing to authorize.
+func (h *FileHandler) isAuthorizedTree(r *http.Request, src, dst string, perm Permission) bool {
+	if src == "" {
+		src = "."
+	}
+	err := fs.WalkDir(h.rootedFileSystem.FS(), src, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name == src && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		rel := name
+		if src != "." {
+			rel = strings.TrimPrefix(strings.TrimPrefix(name, src), "/")
+		}
+		if !h.isAuthorized(r, path.Join(dst, rel), perm) {
+			return errTreeUnauthorized
+		}
+		return nil
+	})
+	return err == nil
+}
+
+// ACL is an Authorizer that grants permissions to users and groups for paths matching globs.
+// Permissions are only ever granted, so the permissions of a user for a path are those of every
+// rule that matches.
+type ACL struct {
+	rules []aclRule
+	// groups maps usernames to the groups they are a member of.
+	groups map[string][]string
+}
+
+type aclRule struct {
+	// principal is a username, a @group, @authenticated for any authenticated user, or * for
+	// anyone, including anonymous users.
+	principal string
+	// pattern is the path glob, split into segments.
+	pattern []string
+	perm    Permission
+}
+
+// LoadACL reads an ACL file, see ParseACL.
+func LoadACL(name string) (*ACL, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	acl, err := ParseACL(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return acl, nil
+}
+
+// ParseACL parses ACL rules, one per line, in the format:
+//
+//	# Comment.
+//	group <group> <username>...
+//	<principal> <glob> <permissions>
+//
+// The principal is a username, a @group, @authenticated or *. Globs match URL paths, where *
+// matches within a path segment and ** matches any number of segments, e.g. /releases/**.
+// Permissions are a comma separated list of read, write and delete, or all.
+func ParseACL(r io.Reader) (*ACL, error) {
+	acl := &ACL{groups: make(map[string][]string)}
+	scanner := bufio.NewScanner(r)
+	var lineNumber int
+	for scanner.Scan() {
+		lineNumber++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] == "group" {
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("line %d: expected group <group> <username>...", lineNumber)
+			}
+			for _, member := range fields[2:] {
+				acl.groups[member] = append(acl.groups[member], fields[1])
+			}
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected <principal> <glob> <permissions>", lineNumber)
+		}
+		if !strings.HasPrefix(fields[1], "/") {
+			return nil, fmt.Errorf("line %d: glob %q must start with /", lineNumber, fields[1])
+		}
+		pattern := pathSegments(fields[1])
+		for _, segment := range pattern {
+			if _, err := path.Match(segment, ""); err != nil {
+				return nil, fmt.Errorf("line %d: invalid glob %q: %w", lineNumber, fields[1], err)
+			}
+		}
+		perm, err := ParsePermission(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		acl.rules = append(acl.rules, aclRule{principal: fields[0], pattern: pattern, perm: perm})
+	}
+	return acl, scanner.Err()
+}
+
+func (a *ACL) Authorize(id *Identity, urlPath string, perm Permission) bool {
+	segments := pathSegments(urlPath)
+	var granted Permission
+	for _, rule := range a.rules {
+		if !a.matchesPrincipal(rule.principal, id) || !matchGlob(rule.pattern, segments) {
+			continue
+		}
+		granted |= rule.perm
+		if granted&perm == perm {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *ACL) matchesPrincipal(principal string, id *Identity) bool {
+	if principal == "*" {
+		return true
+	}
+	if id == nil {
+		return false
+	}
+	group, isGroup := strings.CutPrefix(principal, "@")
+	if !isGroup {
+		return principal == id.Name
+	}
+	return group == "authenticated" || slices.Contains(id.Groups, group) || slices.Contains(a.groups[id.Name], group)
+}
+
+func pathSegments(urlPath string) []string {
+	urlPath = strings.Trim(path.Clean("/"+urlPath), "/")
+	if urlPath == "" {
+		return nil
+	}
+	return strings.Split(urlPath, "/")
+}
+
+// matchGlob matches the path segments against the glob segments, where ** matches any number of
+// segments, including none, so that /docs/** matches /docs itself.
+func matchGlob(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := range len(segments) + 1 {
+			if matchGlob(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], segments[0])
+	return ok && matchGlob(pattern[1:], segments[1:])
+}
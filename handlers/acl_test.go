@@ -0,0 +1,342 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testACL = `# Teams.
+group devs alice carol
+
+* /public/** read
+@authenticated /docs/** read
+bob /docs/** write
+@devs /releases/** read,write
+alice /releases/** delete
+alice /docs/*.md all
+`
+
+func TestParseACL(t *testing.T) {
+	for _, input := range []string{
+		"alice /docs",
+		"alice docs/** read",
+		"alice /docs/** execute",
+		"alice /docs/[ read",
+		"group",
+	} {
+		t.Run(input, func(t *testing.T) {
+			if _, err := ParseACL(strings.NewReader(input)); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestACLAuthorize(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader(testACL))
+	if err != nil {
+		t.Fatalf("Failed to parse ACL: %v", err)
+	}
+	alice := &Identity{Name: "alice"}
+	bob := &Identity{Name: "bob"}
+	dave := &Identity{Name: "dave", Groups: []string{"devs"}}
+	tests := []struct {
+		name     string
+		id       *Identity
+		urlPath  string
+		perm     Permission
+		expected bool
+	}{
+		{name: "anonymous can read public", id: nil, urlPath: "/public/a.txt", perm: PermissionRead, expected: true},
+		{name: "** matches the directory itself", id: nil, urlPath: "/public", perm: PermissionRead, expected: true},
+		{name: "anonymous can't write public", id: nil, urlPath: "/public/a.txt", perm: PermissionWrite, expected: false},
+		{name: "anonymous can't read docs", id: nil, urlPath: "/docs/a.txt", perm: PermissionRead, expected: false},
+		{name: "anonymous can't read the root", id: nil, urlPath: "/", perm: PermissionRead, expected: false},
+		{name: "authenticated users can read docs", id: alice, urlPath: "/docs/a/b.txt", perm: PermissionRead, expected: true},
+		{name: "permissions of rules are combined", id: bob, urlPath: "/docs/a.txt", perm: PermissionRead | PermissionWrite, expected: true},
+		{name: "bob can't delete docs", id: bob, urlPath: "/docs/a.txt", perm: PermissionDelete, expected: false},
+		{name: "* doesn't match across segments", id: alice, urlPath: "/docs/a/b.md", perm: PermissionDelete, expected: false},
+		{name: "* matches within a segment", id: alice, urlPath: "/docs/b.md", perm: PermissionDelete, expected: true},
+		{name: "groups from the ACL", id: alice, urlPath: "/releases/v1.zip", perm: PermissionAll, expected: true},
+		{name: "groups from the identity", id: dave, urlPath: "/releases/v1.zip", perm: PermissionWrite, expected: true},
+		{name: "group members only get the group's permissions", id: dave, urlPath: "/releases/v1.zip", perm: PermissionDelete, expected: false},
+		{name: "non-members get nothing", id: bob, urlPath: "/releases/v1.zip", perm: PermissionRead, expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if actual := acl.Authorize(tt.id, tt.urlPath, tt.perm); actual != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, actual)
+			}
+		})
+	}
+	t.Run("read-only limits the ACL to read", func(t *testing.T) {
+		fh := &FileHandler{Authorizer: acl, IsReadOnly: true}
+		ctx := WithIdentity(context.Background(), alice)
+		if !fh.isAuthorizedContext(ctx, "releases/v1.zip", PermissionRead) {
+			t.Error("Expected read to be allowed")
+		}
+		if fh.isAuthorizedContext(ctx, "releases/v1.zip", PermissionWrite) {
+			t.Error("Expected write to be denied")
+		}
+	})
+}
+
+func TestFileHandlerACL(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"public/a.txt", "docs/b.txt", "releases/c.txt"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+	acl, err := ParseACL(strings.NewReader(testACL + "* / read\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse ACL: %v", err)
+	}
+	fh, closer, err := NewFileHandler(slog.New(slog.DiscardHandler), dir, false)
+	if err != nil {
+		t.Fatalf("Failed to create FileHandler: %v", err)
+	}
+	defer closer()
+	fh.Authorizer = acl
+	handler := NewBasicAuthMiddlewareWithVerifier(fh, passwords{"alice": "a", "bob": "b"})
+	handler.AllowAnonymous = true
+
+	serve := func(method, target, user, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if user != "" {
+			req.SetBasicAuth(user, user[:1])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Anonymous users can read public files", func(t *testing.T) {
+		if w := serve(http.MethodGet, "/public/a.txt", "", ""); w.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", w.Code)
+		}
+	})
+	t.Run("Anonymous users are asked to authenticate", func(t *testing.T) {
+		w := serve(http.MethodGet, "/docs/b.txt", "", "")
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d", w.Code)
+		}
+		if w.Header().Get("WWW-Authenticate") == "" {
+			t.Error("Expected a WWW-Authenticate header")
+		}
+	})
+	t.Run("Authenticated users without permission are forbidden", func(t *testing.T) {
+		if w := serve(http.MethodPut, "/releases/d.txt", "bob", "d"); w.Code != http.StatusForbidden {
+			t.Errorf("Expected status 403, got %d", w.Code)
+		}
+		if w := serve(http.MethodDelete, "/docs/b.txt", "bob", ""); w.Code != http.StatusForbidden {
+			t.Errorf("Expected status 403, got %d", w.Code)
+		}
+	})
+	t.Run("Users with permission can write", func(t *testing.T) {
+		if w := serve(http.MethodPut, "/releases/d.txt", "alice", "d"); w.Code != http.StatusCreated {
+			t.Errorf("Expected status 201, got %d", w.Code)
+		}
+		if w := serve(http.MethodDelete, "/releases/d.txt", "alice", ""); w.Code != http.StatusNoContent {
+			t.Errorf("Expected status 204, got %d", w.Code)
+		}
+	})
+	t.Run("Listings only include readable entries", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+		var listing struct {
+			Entries []struct {
+				Name string `json:"name"`
+			} `json:"entries"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &listing); err != nil {
+			t.Fatalf("Failed to decode listing: %v", err)
+		}
+		var names []string
+		for _, e := range listing.Entries {
+			names = append(names, e.Name)
+		}
+		if !slices.Equal(names, []string{"public"}) {
+			t.Errorf("Expected only public, got %v", names)
+		}
+	})
+	t.Run("PROPFIND only lists readable entries", func(t *testing.T) {
+		fh.WebDAV = true
+		defer func() { fh.WebDAV = false }()
+		w := serve("PROPFIND", "/", "", "")
+		if w.Code != http.StatusMultiStatus {
+			t.Fatalf("Expected status 207, got %d", w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "/public/a.txt") {
+			t.Errorf("Expected the listing to include public/a.txt, got %s", w.Body.String())
+		}
+		for _, name := range []string{"/docs", "/releases"} {
+			if strings.Contains(w.Body.String(), name) {
+				t.Errorf("Expected the listing not to include %s, got %s", name, w.Body.String())
+			}
+		}
+	})
+}
+
+func TestFileHandlerACLDotDotNames(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"index.html", "private/ok.txt", "private/a..b.txt"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+	acl, err := ParseACL(strings.NewReader("* / read\n* /index.html read\nalice /private/** read\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse ACL: %v", err)
+	}
+	fh, closer, err := NewFileHandler(slog.New(slog.DiscardHandler), dir, false)
+	if err != nil {
+		t.Fatalf("Failed to create FileHandler: %v", err)
+	}
+	defer closer()
+	fh.Authorizer = acl
+
+	serve := func(target string, id *Identity) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if id != nil {
+			req = req.WithContext(WithIdentity(req.Context(), id))
+		}
+		w := httptest.NewRecorder()
+		fh.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, target := range []string{"/private/ok.txt", "/private/a..b.txt", "/private/..b.txt", "/private/a.."} {
+		t.Run(target+" is authorized as itself", func(t *testing.T) {
+			if w := serve(target, nil); w.Code != http.StatusForbidden {
+				t.Errorf("Expected status 403, got %d: %q", w.Code, w.Body.String())
+			}
+		})
+	}
+	t.Run("files with .. in their name can be read with permission", func(t *testing.T) {
+		w := serve("/private/a..b.txt", &Identity{Name: "alice"})
+		if w.Code != http.StatusOK || w.Body.String() != "private/a..b.txt" {
+			t.Errorf("Expected the file, got %d: %q", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestFileHandlerACLRecursive(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"dir/own.txt", "dir/other.txt", "site/old.txt"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+	acl, err := ParseACL(strings.NewReader(`alice /** read
+alice /dir delete
+alice /dir/own.txt delete
+alice /dst write
+alice /site write,delete
+alice /site/** write
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse ACL: %v", err)
+	}
+	fh, closer, err := NewFileHandler(slog.New(slog.DiscardHandler), dir, false)
+	if err != nil {
+		t.Fatalf("Failed to create FileHandler: %v", err)
+	}
+	defer closer()
+	fh.Authorizer = acl
+	fh.WebDAV = true
+
+	serve := func(method, target string, headers map[string]string, body []byte) int {
+		req := httptest.NewRequest(method, target, bytes.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		req = req.WithContext(WithIdentity(req.Context(), &Identity{Name: "alice"}))
+		w := httptest.NewRecorder()
+		fh.ServeHTTP(w, req)
+		return w.Code
+	}
+	expectFiles := func(t *testing.T, names ...string) {
+		t.Helper()
+		for _, name := range names {
+			if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+				t.Errorf("Expected %s to exist: %v", name, err)
+			}
+		}
+	}
+
+	t.Run("Directories can't be deleted without permission for their contents", func(t *testing.T) {
+		if code := serve(http.MethodDelete, "/dir", nil, nil); code != http.StatusForbidden {
+			t.Errorf("Expected status 403, got %d", code)
+		}
+		expectFiles(t, "dir/own.txt", "dir/other.txt")
+	})
+	t.Run("Directories can't be moved without permission for their contents", func(t *testing.T) {
+		if code := serve("MOVE", "/dir", map[string]string{"Destination": "/dst"}, nil); code != http.StatusForbidden {
+			t.Errorf("Expected status 403, got %d", code)
+		}
+		expectFiles(t, "dir/own.txt", "dir/other.txt")
+	})
+	t.Run("Directories can't be copied to paths that can't be written", func(t *testing.T) {
+		if code := serve("COPY", "/dir", map[string]string{"Destination": "/dst"}, nil); code != http.StatusForbidden {
+			t.Errorf("Expected status 403, got %d", code)
+		}
+		if code := serve("COPY", "/dir", map[string]string{"Destination": "/dst", "Depth": "0"}, nil); code != http.StatusCreated {
+			t.Errorf("Expected status 201, got %d", code)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "dst", "own.txt")); !os.IsNotExist(err) {
+			t.Errorf("Expected the contents not to be copied, got %v", err)
+		}
+	})
+	t.Run("Archives can't be extracted to paths that can't be written", func(t *testing.T) {
+		body := testTarGz(t, []testArchiveEntry{{name: "a.txt", content: "a"}})
+		if code := serve(http.MethodPut, "/dst?extract=true", nil, body); code != http.StatusForbidden {
+			t.Errorf("Expected status 403, got %d", code)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "dst", "a.txt")); !os.IsNotExist(err) {
+			t.Errorf("Expected nothing to be extracted, got %v", err)
+		}
+	})
+	t.Run("Directories can't be replaced without permission to delete their contents", func(t *testing.T) {
+		body := testTarGz(t, []testArchiveEntry{{name: "a.txt", content: "a"}})
+		if code := serve(http.MethodPut, "/site?extract=true&replace=true", nil, body); code != http.StatusForbidden {
+			t.Errorf("Expected status 403, got %d", code)
+		}
+		expectFiles(t, "site/old.txt")
+		if code := serve(http.MethodPut, "/site?extract=true", nil, body); code != http.StatusCreated {
+			t.Errorf("Expected status 201, got %d", code)
+		}
+		expectFiles(t, "site/old.txt", "site/a.txt")
+	})
+}
+
+// passwords is a PasswordVerifier for a map of usernames to passwords.
+type passwords map[string]string
+
+func (p passwords) Verify(username, password string) bool {
+	expected, ok := p[username]
+	return ok && expected == password
+}
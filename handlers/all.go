@@ -1,27 +1,254 @@
 package handlers
 
 import (
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/a-h/serve/config"
 )
 
 func Create(log *slog.Logger, conf *config.Config) (h http.Handler, closer func() error, err error) {
+	trustedProxies, err := ParsePrefixes(conf.TrustedProxies)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid -trusted-proxies: %w", err)
+	}
+	var read, write IPFilter
+	if read.Allow, err = ParsePrefixes(conf.AllowRead); err != nil {
+		return nil, nil, fmt.Errorf("invalid -allow-read: %w", err)
+	}
+	if read.Deny, err = ParsePrefixes(conf.DenyRead); err != nil {
+		return nil, nil, fmt.Errorf("invalid -deny-read: %w", err)
+	}
+	if write.Allow, err = ParsePrefixes(conf.AllowWrite); err != nil {
+		return nil, nil, fmt.Errorf("invalid -allow-write: %w", err)
+	}
+	if write.Deny, err = ParsePrefixes(conf.DenyWrite); err != nil {
+		return nil, nil, fmt.Errorf("invalid -deny-write: %w", err)
+	}
+	h, closer, err = create(log, conf)
+	if err != nil {
+		return nil, closer, err
+	}
+	// Requests are filtered by IP address before they're authenticated.
+	if len(read.Allow) > 0 || len(read.Deny) > 0 || len(write.Allow) > 0 || len(write.Deny) > 0 {
+		h = NewIPFilterMiddleware(log, h, read, write)
+	}
+	var accessLog *AccessLog
+	if conf.AccessLogFormat != "" || conf.AccessLogFile != "" {
+		format := conf.AccessLogFormat
+		if format == "" {
+			format = AccessLogCombined
+		}
+		var w io.Writer = os.Stdout
+		if conf.AccessLogFile != "" {
+			inside, err := isInDir(conf.Dir, conf.AccessLogFile)
+			if err != nil {
+				return nil, closer, err
+			}
+			if inside {
+				return nil, closer, fmt.Errorf("access log file must not be in the directory being served")
+			}
+			f, err := os.OpenFile(conf.AccessLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				return nil, closer, fmt.Errorf("failed to open access log file: %w", err)
+			}
+			closeHandler := closer
+			closer = func() error {
+				return errors.Join(closeHandler(), f.Close())
+			}
+			w = f
+		}
+		if accessLog, err = NewAccessLog(w, format); err != nil {
+			return nil, closer, err
+		}
+	}
+	// Requests are logged before they're filtered and authenticated, so that denied requests are
+	// logged too.
+	withLogging := NewLoggingMiddleware(log, conf.LogRemoteAddr, h)
+	withLogging.AccessLog = accessLog
+	h = withLogging
+	// Request IDs are added first, so that all logs of the request include them.
+	h = NewRequestIDMiddleware(log, h, trustedProxies)
+	withClientIP := NewClientIPMiddleware(h, trustedProxies)
+	withClientIP.ProxyHeaders = conf.ProxyHeaders
+	return withClientIP, closer, nil
+}
+
+func create(log *slog.Logger, conf *config.Config) (h http.Handler, closer func() error, err error) {
 	handler, closer, err := NewFileHandler(log, conf.Dir, conf.ReadOnly)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create file handler: %w", err)
 	}
-	withLogging := NewLoggingMiddleware(log, conf.LogRemoteAddr, handler)
+	if conf.ACLFile != "" {
+		acl, err := LoadACL(conf.ACLFile)
+		if err != nil {
+			return nil, closer, fmt.Errorf("failed to load ACL file: %w", err)
+		}
+		handler.Authorizer = acl
+	}
+	handler.WebDAV = conf.WebDAV
+	if conf.IndexTemplate != "" {
+		if handler.IndexTemplate, err = ParseIndexTemplate(conf.IndexTemplate); err != nil {
+			return nil, closer, fmt.Errorf("failed to parse index template: %w", err)
+		}
+	}
+	handler.HideDotfiles = conf.HideDotfiles
+	handler.Symlinks = SymlinkPolicy(conf.Symlinks)
+	handler.ArchiveMaxSize = conf.ArchiveMaxSize
+	handler.ArchiveMaxFiles = conf.ArchiveMaxFiles
+	handler.ExtractMaxSize = conf.ExtractMaxSize
+	handler.ExtractMaxFiles = conf.ExtractMaxFiles
+	if conf.ShareLinksFile != "" {
+		inside, err := isInDir(conf.Dir, conf.ShareLinksFile)
+		if err != nil {
+			return nil, closer, err
+		}
+		if inside {
+			return nil, closer, fmt.Errorf("share links file must not be in the directory being served")
+		}
+		if handler.ShareLinks, err = NewShareLinks(log, conf.ShareLinksFile); err != nil {
+			return nil, closer, fmt.Errorf("failed to load share links file: %w", err)
+		}
+	}
+	if conf.AuditLog != "" {
+		inside, err := isInDir(conf.Dir, conf.AuditLog)
+		if err != nil {
+			return nil, closer, err
+		}
+		if inside {
+			return nil, closer, fmt.Errorf("audit log must not be in the directory being served")
+		}
+		if handler.AuditLog, err = NewAuditLog(conf.AuditLog, []byte(conf.AuditKey)); err != nil {
+			return nil, closer, fmt.Errorf("failed to open audit log: %w", err)
+		}
+		closeHandler := closer
+		closer = func() error {
+			return errors.Join(closeHandler(), handler.AuditLog.Close())
+		}
+	}
+	handler.TusEnabled = conf.Tus
+	handler.TusMaxSize = conf.TusMaxSize
+	handler.TusExpiry = conf.TusExpiry
+	if conf.S3 {
+		credentials := make(map[string]string)
+		if conf.S3AccessKey != "" {
+			credentials[conf.S3AccessKey] = conf.S3SecretKey
+		}
+		return NewS3Handler(log, handler, credentials, conf.S3Region), closer, nil
+	}
+	var passwords PasswordVerifier
 	if conf.Auth != "" {
 		parts := strings.SplitN(conf.Auth, ":", 2)
 		if len(parts) != 2 {
 			return nil, closer, fmt.Errorf("-auth must be in the format username:password")
 		}
-		withAuth := NewBasicAuthMiddleware(withLogging, parts[0], parts[1])
-		return withAuth, closer, nil
+		passwords = staticPassword{username: parts[0], password: parts[1]}
+	}
+	if conf.AuthFile != "" {
+		htpasswd, err := NewHtpasswd(log, conf.AuthFile)
+		if err != nil {
+			return nil, closer, fmt.Errorf("failed to load auth file: %w", err)
+		}
+		passwords = htpasswd
+	}
+	// authenticate is the outermost authentication middleware, each of which falls back to the
+	// next for requests without its kind of credentials.
+	var authenticate http.Handler
+	if passwords != nil {
+		basicAuth := NewBasicAuthMiddlewareWithVerifier(handler, passwords)
+		basicAuth.AllowAnonymous = conf.ACLFile != ""
+		if conf.AuthMaxFailures > 0 {
+			basicAuth.Throttle = NewThrottle(log, int(conf.AuthMaxFailures), conf.AuthLockout)
+		}
+		authenticate = basicAuth
+		if conf.Login {
+			key := []byte(conf.SessionKey)
+			if len(key) == 0 {
+				log.Info("No -session-key set, sessions will end when the server restarts")
+				key = make([]byte, 32)
+				rand.Read(key)
+			}
+			sessions := NewSessionMiddleware(log, handler, passwords, NewSessions(key, conf.SessionIdle, conf.SessionMaxAge))
+			sessions.Fallback = basicAuth
+			sessions.AllowAnonymous = conf.ACLFile != ""
+			sessions.Throttle = basicAuth.Throttle
+			authenticate = sessions
+		}
+	}
+	var tokenVerifiers TokenVerifiers
+	if conf.APIKeyFile != "" {
+		keys, err := NewAPIKeys(log, conf.APIKeyFile)
+		if err != nil {
+			return nil, closer, fmt.Errorf("failed to load API key file: %w", err)
+		}
+		tokenVerifiers = append(tokenVerifiers, keys)
+	}
+	if conf.JWKS != "" {
+		jwks, err := NewJWKS(log, conf.JWKS)
+		if err != nil {
+			return nil, closer, fmt.Errorf("failed to load JWKS: %w", err)
+		}
+		tokenVerifiers = append(tokenVerifiers, &JWTVerifier{
+			Keys:        jwks,
+			Issuer:      conf.JWTIssuer,
+			Audience:    conf.JWTAudience,
+			UserClaim:   conf.JWTUserClaim,
+			GroupsClaim: conf.JWTGroupsClaim,
+		})
+	}
+	if len(tokenVerifiers) > 0 {
+		bearerAuth := NewBearerAuthMiddleware(handler, tokenVerifiers)
+		bearerAuth.AllowAnonymous = conf.ACLFile != ""
+		if authenticate != nil {
+			bearerAuth.Fallback = authenticate
+		}
+		authenticate = bearerAuth
+	}
+	if conf.ClientCA != "" {
+		certAuth := NewClientCertAuthMiddleware(handler)
+		certAuth.AllowAnonymous = conf.ACLFile != ""
+		if authenticate != nil {
+			certAuth.Fallback = authenticate
+		}
+		authenticate = certAuth
+	}
+	if conf.URLSigningKey != "" {
+		signedURLs := NewSignedURLMiddleware(handler, []byte(conf.URLSigningKey))
+		if authenticate != nil {
+			signedURLs.Fallback = authenticate
+		}
+		authenticate = signedURLs
+	}
+	if handler.ShareLinks != nil {
+		shareLinks := NewShareLinkMiddleware(handler, handler.ShareLinks)
+		if authenticate != nil {
+			shareLinks.Fallback = authenticate
+		}
+		authenticate = shareLinks
+	}
+	if authenticate != nil {
+		return authenticate, closer, nil
+	}
+	return handler, closer, nil
+}
+
+// isInDir returns true if the file is in the directory or its subdirectories, so it would be
+// served.
+func isInDir(dir, name string) (bool, error) {
+	absName, err := filepath.Abs(name)
+	if err != nil {
+		return false, fmt.Errorf("failed to get absolute path of %s: %w", name, err)
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false, fmt.Errorf("failed to get absolute path of serve directory: %w", err)
 	}
-	return withLogging, closer, nil
+	return absName == absDir || strings.HasPrefix(absName, absDir+string(filepath.Separator)), nil
 }
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errInvalidAPIKey = errors.New("invalid API key")
+	errExpiredAPIKey = errors.New("expired API key")
+)
+
+// NewAPIKeys loads API keys from a file, one per line, in the format:
+//
+//	# Comment.
+//	<name> <sha256 hex of key> scopes=<permissions> [prefixes=<path>,...] [expires=<time>]
+//
+// Scopes are a comma separated list of read, write and delete, or all. Prefixes limit the key to
+// URL paths within them, e.g. /releases. Expiry is an RFC 3339 time or a date, e.g. 2027-01-01,
+// which is the start of the day in UTC. The file is reloaded when it changes.
+func NewAPIKeys(log *slog.Logger, name string) (k *APIKeys, err error) {
+	k = &APIKeys{
+		log:         log,
+		now:         time.Now,
+		watchedFile: watchedFile{name: name, checkInterval: fileCheckInterval},
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if err = k.load(fi); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+type APIKeys struct {
+	log *slog.Logger
+	now func() time.Time
+
+	mu sync.Mutex
+	watchedFile
+	// keys are indexed by the SHA-256 hash of the key, so that the keys themselves are never
+	// stored.
+	keys map[[sha256.Size]byte]apiKey
+}
+
+type apiKey struct {
+	name    string
+	scope   Scope
+	expires time.Time
+}
+
+// Identity returns the identity of the key, named after the key, and scoped to its permissions
+// and prefixes.
+func (k *APIKeys) Identity(ctx context.Context, token string) (*Identity, error) {
+	key, ok := k.key(sha256.Sum256([]byte(token)))
+	if !ok {
+		return nil, errInvalidAPIKey
+	}
+	if !key.expires.IsZero() && !k.now().Before(key.expires) {
+		LoggerFromContext(ctx, k.log).Warn("Rejected expired API key", slog.String("key", key.name), slog.Time("expires", key.expires))
+		return nil, errExpiredAPIKey
+	}
+	return &Identity{Name: key.name, Method: "bearer", Scope: &key.scope}, nil
+}
+
+// key returns the key with the hash, reloading the file first if it's changed.
+func (k *APIKeys) key(hash [sha256.Size]byte) (key apiKey, ok bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	fi, changed, err := k.changed()
+	if err != nil {
+		k.log.Error("Failed to check API key file", slog.String("path", k.name), slog.Any("error", err))
+	} else if changed {
+		if err = k.load(fi); err != nil {
+			k.log.Error("Failed to reload API key file, using previous keys", slog.String("path", k.name), slog.Any("error", err))
+		}
+	}
+	key, ok = k.keys[hash]
+	return key, ok
+}
+
+// load reads the file. It must be called with the mutex held, or before k is shared.
+func (k *APIKeys) load(fi os.FileInfo) error {
+	data, err := os.ReadFile(k.name)
+	if err != nil {
+		return err
+	}
+	keys := make(map[[sha256.Size]byte]apiKey)
+	names := make(map[string]struct{})
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	var lineNumber int
+	for scanner.Scan() {
+		lineNumber++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		hash, key, err := parseAPIKey(fields)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", k.name, lineNumber, err)
+		}
+		if _, exists := names[key.name]; exists {
+			return fmt.Errorf("%s:%d: duplicate key name %q", k.name, lineNumber, key.name)
+		}
+		names[key.name] = struct{}{}
+		keys[hash] = key
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if k.keys != nil {
+		k.log.Info("Reloaded API key file", slog.String("path", k.name), slog.Int("keys", len(keys)))
+	}
+	k.keys = keys
+	k.loaded(fi)
+	return nil
+}
+
+func parseAPIKey(fields []string) (hash [sha256.Size]byte, key apiKey, err error) {
+	if len(fields) < 3 {
+		return hash, key, fmt.Errorf("expected <name> <sha256> scopes=<permissions>")
+	}
+	key.name = fields[0]
+	decoded, err := hex.DecodeString(fields[1])
+	if err != nil || len(decoded) != sha256.Size {
+		return hash, key, fmt.Errorf("expected the hex encoded SHA-256 hash of the key, e.g. from sha256sum")
+	}
+	copy(hash[:], decoded)
+	var hasScopes bool
+	for _, option := range fields[2:] {
+		name, value, _ := strings.Cut(option, "=")
+		switch name {
+		case "scopes":
+			if key.scope.Permissions, err = ParsePermission(value); err != nil {
+				return hash, key, err
+			}
+			hasScopes = true
+		case "prefixes":
+			for prefix := range strings.SplitSeq(value, ",") {
+				if !strings.HasPrefix(prefix, "/") {
+					return hash, key, fmt.Errorf("prefix %q must start with /", prefix)
+				}
+				key.scope.Prefixes = append(key.scope.Prefixes, prefix)
+			}
+		case "expires":
+			if key.expires, err = time.Parse(time.RFC3339, value); err != nil {
+				if key.expires, err = time.Parse(time.DateOnly, value); err != nil {
+					return hash, key, fmt.Errorf("invalid expiry %q, expected a date or RFC 3339 time", value)
+				}
+			}
+		default:
+			return hash, key, fmt.Errorf("unknown option %q, expected scopes, prefixes or expires", name)
+		}
+	}
+	if !hasScopes {
+		return hash, key, fmt.Errorf("missing scopes")
+	}
+	return hash, key, nil
+}
+
+// bearerToken returns the token from an Authorization: Bearer header.
+func bearerToken(r *http.Request) (token string, ok bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
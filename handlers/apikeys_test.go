@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAPIKeyHash(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func TestAPIKeys(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "keys")
+	content := "# CI jobs.\n" +
+		"ci-deploy " + testAPIKeyHash("deploy-secret") + " scopes=read,write prefixes=/releases\n" +
+		"ci-read " + testAPIKeyHash("read-secret") + " scopes=read\n" +
+		"old " + testAPIKeyHash("old-secret") + " scopes=all expires=2026-01-01\n"
+	if err := os.WriteFile(name, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write API key file: %v", err)
+	}
+	keys, err := NewAPIKeys(slog.New(slog.DiscardHandler), name)
+	if err != nil {
+		t.Fatalf("Failed to load API keys: %v", err)
+	}
+	keys.now = func() time.Time { return time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC) }
+
+	t.Run("Keys are identified by name and scoped", func(t *testing.T) {
+		id, err := keys.Identity(context.Background(), "deploy-secret")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if id.Name != "ci-deploy" || id.Method != "bearer" {
+			t.Errorf("Unexpected identity: %+v", id)
+		}
+		tests := []struct {
+			urlPath  string
+			perm     Permission
+			expected bool
+		}{
+			{urlPath: "/releases", perm: PermissionRead, expected: true},
+			{urlPath: "/releases/v1/app.zip", perm: PermissionWrite, expected: true},
+			{urlPath: "/releases/v1/app.zip", perm: PermissionDelete, expected: false},
+			{urlPath: "/releases-old/app.zip", perm: PermissionRead, expected: false},
+			{urlPath: "/", perm: PermissionRead, expected: false},
+		}
+		for _, tt := range tests {
+			if actual := id.Scope.Allows(tt.urlPath, tt.perm); actual != tt.expected {
+				t.Errorf("%s %v: expected %v, got %v", tt.urlPath, tt.perm, tt.expected, actual)
+			}
+		}
+	})
+	t.Run("Unknown keys are rejected", func(t *testing.T) {
+		if _, err := keys.Identity(context.Background(), "ci-deploy"); err != errInvalidAPIKey {
+			t.Errorf("Expected errInvalidAPIKey, got %v", err)
+		}
+	})
+	t.Run("Expired keys are rejected", func(t *testing.T) {
+		if _, err := keys.Identity(context.Background(), "old-secret"); err != errExpiredAPIKey {
+			t.Errorf("Expected errExpiredAPIKey, got %v", err)
+		}
+	})
+	t.Run("Invalid files are rejected", func(t *testing.T) {
+		for _, content := range []string{
+			"ci " + testAPIKeyHash("a"),
+			"ci not-a-hash scopes=read",
+			"ci " + testAPIKeyHash("a") + " scopes=execute",
+			"ci " + testAPIKeyHash("a") + " scopes=read prefixes=releases",
+			"ci " + testAPIKeyHash("a") + " scopes=read expires=tomorrow",
+			"ci " + testAPIKeyHash("a") + " scopes=read\nci " + testAPIKeyHash("b") + " scopes=read",
+		} {
+			name := filepath.Join(t.TempDir(), "keys")
+			if err := os.WriteFile(name, []byte(content), 0600); err != nil {
+				t.Fatalf("Failed to write API key file: %v", err)
+			}
+			if _, err := NewAPIKeys(slog.New(slog.DiscardHandler), name); err == nil {
+				t.Errorf("%q: expected an error", content)
+			}
+		}
+	})
+}
+
+func TestBearerAuthMiddleware(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "releases"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "readme.txt"), []byte("readme"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	name := filepath.Join(t.TempDir(), "keys")
+	content := "ci-deploy " + testAPIKeyHash("deploy-secret") + " scopes=read,write prefixes=/releases\n"
+	if err := os.WriteFile(name, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write API key file: %v", err)
+	}
+	log := slog.New(slog.DiscardHandler)
+	keys, err := NewAPIKeys(log, name)
+	if err != nil {
+		t.Fatalf("Failed to load API keys: %v", err)
+	}
+	fh, closer, err := NewFileHandler(log, dir, false)
+	if err != nil {
+		t.Fatalf("Failed to create FileHandler: %v", err)
+	}
+	defer closer()
+	handler := NewBearerAuthMiddleware(fh, keys)
+	handler.Fallback = NewBasicAuthMiddleware(fh, "admin", "secret")
+
+	serve := func(method, target string, setAuth func(r *http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader("content"))
+		setAuth(req)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	bearer := func(token string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	t.Run("Keys can write within their prefixes", func(t *testing.T) {
+		if w := serve(http.MethodPut, "/releases/app.zip", bearer("deploy-secret")); w.Code != http.StatusCreated {
+			t.Errorf("Expected status 201, got %d", w.Code)
+		}
+	})
+	t.Run("Keys can't write outside their prefixes", func(t *testing.T) {
+		if w := serve(http.MethodPut, "/app.zip", bearer("deploy-secret")); w.Code != http.StatusForbidden {
+			t.Errorf("Expected status 403, got %d", w.Code)
+		}
+	})
+	t.Run("Keys can't exceed their scopes", func(t *testing.T) {
+		if w := serve(http.MethodDelete, "/releases/app.zip", bearer("deploy-secret")); w.Code != http.StatusForbidden {
+			t.Errorf("Expected status 403, got %d", w.Code)
+		}
+	})
+	t.Run("Invalid keys return 401", func(t *testing.T) {
+		w := serve(http.MethodGet, "/releases/app.zip", bearer("wrong"))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d", w.Code)
+		}
+		if !strings.Contains(w.Header().Get("WWW-Authenticate"), `error="invalid_token"`) {
+			t.Errorf("Expected an invalid_token challenge, got %q", w.Header().Get("WWW-Authenticate"))
+		}
+	})
+	t.Run("Requests without a bearer token use the fallback", func(t *testing.T) {
+		if w := serve(http.MethodGet, "/readme.txt", func(r *http.Request) {}); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d", w.Code)
+		}
+		if w := serve(http.MethodDelete, "/releases/app.zip", func(r *http.Request) { r.SetBasicAuth("admin", "secret") }); w.Code != http.StatusNoContent {
+			t.Errorf("Expected status 204, got %d", w.Code)
+		}
+	})
+}
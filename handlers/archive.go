@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+type archiveEntry struct {
+	// name is the path of the entry within the archive.
+	name string
+	// fsPath is the path of the file within the root.
+	fsPath string
+	info   fs.FileInfo
+}
+
+// archiveEntries walks dir, returning the directories and files the user can read, to include in
+// an archive.
+// Symlinks to files are followed as allowed by the symlink policy, but symlinks to directories
+// are not, to avoid loops.
+func (h *FileHandler) archiveEntries(r *http.Request, dir string) (entries []archiveEntry, err error) {
+	fsys := h.readFS()
+	var files int64
+	var size int64
+	err = fs.WalkDir(fsys, dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name == dir {
+				return err
+			}
+			return nil
+		}
+		if name == dir {
+			return nil
+		}
+		if h.isHidden(name) || !h.isAuthorized(r, name, PermissionRead) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		fi, err := fs.Stat(fsys, name)
+		if err != nil || (d.Type()&fs.ModeSymlink != 0 && fi.IsDir()) {
+			return nil
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			return nil
+		}
+		if fi.Mode().IsRegular() {
+			files++
+			size += fi.Size()
+			if h.ArchiveMaxFiles > 0 && files > h.ArchiveMaxFiles {
+				return fmt.Errorf("%w, it exceeds the maximum of %d files", errArchiveLimit, h.ArchiveMaxFiles)
+			}
+			if h.ArchiveMaxSize > 0 && size > h.ArchiveMaxSize {
+				return fmt.Errorf("%w, it exceeds the maximum size of %d bytes", errArchiveLimit, h.ArchiveMaxSize)
+			}
+		}
+		rel := name
+		if dir != "." {
+			rel = strings.TrimPrefix(name, dir+"/")
+		}
+		entries = append(entries, archiveEntry{name: rel, fsPath: name, info: fi})
+		return nil
+	})
+	return entries, err
+}
+
+// errArchiveLimit is returned for directories that have too many files, or files that are too
+// large in total, to archive.
+var errArchiveLimit = errors.New("directory is too large to archive")
+
+// ServeArchive streams the contents of dir as a zip or tar.gz archive, built as it's sent.
+func (h *FileHandler) ServeArchive(w http.ResponseWriter, r *http.Request, dir, format string) {
+	var contentType, ext string
+	switch format {
+	case "zip":
+		contentType, ext = "application/zip", ".zip"
+	case "tar.gz", "tgz":
+		contentType, ext = "application/gzip", ".tar.gz"
+	default:
+		http.Error(w, "invalid archive format, must be zip or tar.gz", http.StatusBadRequest)
+		return
+	}
+	entries, err := h.archiveEntries(r, dir)
+	if errors.Is(err, errArchiveLimit) {
+		h.logger(r).Warn("Refused to create archive", slog.String("path", dir), slog.Any("error", err))
+		http.Error(w, err.Error()+", download a subdirectory or individual files instead", http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		h.logger(r).Error("Failed to create archive", slog.String("path", dir), slog.Any("error", err))
+		http.Error(w, "failed to create archive", http.StatusInternalServerError)
+		return
+	}
+
+	name := path.Base(dir)
+	if dir == "." {
+		name = "archive"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ext}))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if format == "zip" {
+		err = h.writeZip(w, entries)
+	} else {
+		err = h.writeTarGz(w, entries)
+	}
+	if err != nil {
+		// The status has already been sent, so the client will see a truncated archive.
+		h.logger(r).Error("Failed to write archive", slog.String("path", dir), slog.Any("error", err))
+	}
+}
+
+func (h *FileHandler) writeZip(w io.Writer, entries []archiveEntry) error {
+	zw := zip.NewWriter(w)
+	for _, e := range entries {
+		hdr, err := zip.FileInfoHeader(e.info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = e.name
+		if e.info.IsDir() {
+			hdr.Name += "/"
+			if _, err = zw.CreateHeader(hdr); err != nil {
+				return err
+			}
+			continue
+		}
+		hdr.Method = zip.Deflate
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if err = h.copyFile(fw, e); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func (h *FileHandler) writeTarGz(w io.Writer, entries []archiveEntry) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		hdr, err := tar.FileInfoHeader(e.info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = e.name
+		if e.info.IsDir() {
+			hdr.Name += "/"
+		}
+		// Don't leak the server's user and group names.
+		hdr.Uname, hdr.Gname = "", ""
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if e.info.Mode().IsRegular() {
+			if err = h.copyFile(tw, e); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// copyFile copies exactly the number of bytes that were in the file when the archive was
+// planned, so that the archive stays valid if the file changes size.
+func (h *FileHandler) copyFile(w io.Writer, e archiveEntry) error {
+	f, err := h.readFS().Open(e.fsPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(w, f, e.info.Size())
+	return err
+}
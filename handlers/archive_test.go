@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	for name, content := range map[string]string{
+		"docs/a.txt":          "a",
+		"docs/sub/b.txt":      "bb",
+		"docs/.secret":        "hidden",
+		"docs/.env..bak":      "hidden",
+		stagingDir + "/x":     "hidden",
+		stagingDir + "/x..y":  "hidden",
+		"other.txt":           "other",
+		"résumé \"v1\"/a.txt": "a",
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "passwd"), []byte("secret"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := os.Symlink("../other.txt", filepath.Join(dir, "docs", "link.txt")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "passwd"), filepath.Join(dir, "docs", "escape.txt")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := os.Symlink("..", filepath.Join(dir, "docs", "loop")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	log := slog.New(slog.DiscardHandler)
+	fh, closer, err := NewFileHandler(log, dir, true)
+	if err != nil {
+		t.Fatalf("Failed to create FileHandler: %v", err)
+	}
+	defer closer()
+	fh.HideDotfiles = true
+
+	t.Run("Directories can be downloaded as a zip", func(t *testing.T) {
+		w := testArchive(t, fh, "/docs/?archive=zip", http.StatusOK)
+		if ct := w.Header().Get("Content-Type"); ct != "application/zip" {
+			t.Errorf("Expected application/zip, got %q", ct)
+		}
+		if cd := w.Header().Get("Content-Disposition"); cd != "attachment; filename=docs.zip" {
+			t.Errorf("Unexpected Content-Disposition: %q", cd)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+		if err != nil {
+			t.Fatalf("Failed to read zip: %v", err)
+		}
+		files := map[string]string{}
+		for _, f := range zr.File {
+			if strings.HasSuffix(f.Name, "/") {
+				files[f.Name] = ""
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatalf("Failed to open %s: %v", f.Name, err)
+			}
+			content, _ := io.ReadAll(rc)
+			rc.Close()
+			files[f.Name] = string(content)
+		}
+		expected := map[string]string{
+			"a.txt":     "a",
+			"link.txt":  "other",
+			"sub/":      "",
+			"sub/b.txt": "bb",
+		}
+		if len(files) != len(expected) {
+			t.Errorf("Expected %v, got %v", expected, files)
+		}
+		for name, content := range expected {
+			if files[name] != content {
+				t.Errorf("Expected %s to contain %q, got %q", name, content, files[name])
+			}
+		}
+	})
+	t.Run("Directories can be downloaded as a tar.gz", func(t *testing.T) {
+		w := testArchive(t, fh, "/?archive=tar.gz", http.StatusOK)
+		if cd := w.Header().Get("Content-Disposition"); cd != "attachment; filename=archive.tar.gz" {
+			t.Errorf("Unexpected Content-Disposition: %q", cd)
+		}
+		gr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("Failed to read gzip: %v", err)
+		}
+		tr := tar.NewReader(gr)
+		var names []string
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Failed to read tar: %v", err)
+			}
+			names = append(names, hdr.Name)
+		}
+		slices.Sort(names)
+		if got := strings.Join(names, ","); got != "docs/,docs/a.txt,docs/link.txt,docs/sub/,docs/sub/b.txt,other.txt,résumé \"v1\"/,résumé \"v1\"/a.txt" {
+			t.Errorf("Unexpected archive contents: %s", got)
+		}
+	})
+	t.Run("Filenames with quotes and non-ASCII characters are encoded", func(t *testing.T) {
+		w := testArchive(t, fh, "/r%C3%A9sum%C3%A9%20%22v1%22/?archive=zip", http.StatusOK)
+		_, params, err := mime.ParseMediaType(w.Header().Get("Content-Disposition"))
+		if err != nil || params["filename"] != `résumé "v1".zip` {
+			t.Errorf("Unexpected Content-Disposition %q: %v", w.Header().Get("Content-Disposition"), err)
+		}
+	})
+	t.Run("Invalid formats are rejected", func(t *testing.T) {
+		testArchive(t, fh, "/docs/?archive=rar", http.StatusBadRequest)
+	})
+	t.Run("Archives over the size limit are rejected", func(t *testing.T) {
+		fh.ArchiveMaxSize = 2
+		defer func() { fh.ArchiveMaxSize = 0 }()
+		w := testArchive(t, fh, "/docs/?archive=zip", http.StatusUnprocessableEntity)
+		if !strings.Contains(w.Body.String(), "maximum size of 2 bytes") {
+			t.Errorf("Expected the limit in the response, got %q", w.Body.String())
+		}
+	})
+	t.Run("Archives over the file limit are rejected", func(t *testing.T) {
+		fh.ArchiveMaxFiles = 2
+		defer func() { fh.ArchiveMaxFiles = 0 }()
+		w := testArchive(t, fh, "/docs/?archive=zip", http.StatusUnprocessableEntity)
+		if !strings.Contains(w.Body.String(), "maximum of 2 files") {
+			t.Errorf("Expected the limit in the response, got %q", w.Body.String())
+		}
+	})
+	t.Run("Hidden directories can't be archived", func(t *testing.T) {
+		testArchive(t, fh, "/"+stagingDir+"/?archive=zip", http.StatusNotFound)
+	})
+	t.Run("Hidden files can't be downloaded", func(t *testing.T) {
+		for _, target := range []string{"/docs/.secret", "/docs/.env..bak", "/" + stagingDir + "/x", "/" + stagingDir + "/x..y"} {
+			testArchive(t, fh, target, http.StatusNotFound)
+		}
+	})
+}
+
+func testArchive(t *testing.T, fh *FileHandler, target string, expectedStatus int) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	fh.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	if w.Code != expectedStatus {
+		t.Fatalf("Expected status %d, got %d: %s", expectedStatus, w.Code, w.Body.String())
+	}
+	return w
+}
@@ -0,0 +1,335 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry records a request that modified, or tried to modify, the served directory.
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// User is the authenticated user, or empty if anonymous.
+	User       string `json:"user,omitempty"`
+	AuthMethod string `json:"auth_method,omitempty"`
+	ClientIP   string `json:"client_ip"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	// Destination is the path that a WebDAV COPY or MOVE is to.
+	Destination string `json:"destination,omitempty"`
+	// Size is the number of bytes uploaded.
+	Size int64 `json:"size,omitempty"`
+	// SHA256 is the hex encoded hash of the uploaded content.
+	SHA256 string `json:"sha256,omitempty"`
+	// Status is the HTTP status of the response, which shows whether the request succeeded.
+	Status int `json:"status"`
+	// Prev is the Hash of the previous entry, or empty for the first entry.
+	Prev string `json:"prev"`
+	// Hash is the hex encoded HMAC-SHA256 of the entry without the Hash, which includes Prev, so
+	// that entries can't be changed, removed or reordered without breaking the chain, and the
+	// chain can't be rewritten without the key.
+	Hash string `json:"hash,omitempty"`
+}
+
+func (e AuditEntry) hash(key []byte) string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewAuditLog appends entries to the JSON lines file at name, continuing the hash chain of any
+// existing entries. The key is used to sign the entries, and is needed to verify them. The
+// existing entries are verified first, so that a log that has been tampered with, or was written
+// with a different key, isn't extended.
+func NewAuditLog(name string, key []byte) (*AuditLog, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, last, err := VerifyAuditLog(f, key)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to verify audit log: %w", err)
+	}
+	return &AuditLog{f: f, key: key, last: last}, nil
+}
+
+type AuditLog struct {
+	mu   sync.Mutex
+	f    *os.File
+	key  []byte
+	last string
+	// err is set if an entry couldn't be written, after which the log can't be trusted to be
+	// complete, so no more changes are allowed.
+	err error
+}
+
+// Record sets the Prev and Hash of the entry, and appends it to the log. The file is synced,
+// so that recorded entries aren't lost if the server crashes. Once an entry fails to be
+// recorded, every later entry fails too.
+func (l *AuditLog) Record(e *AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+	e.Prev = l.last
+	e.Hash = e.hash(l.key)
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err = l.f.Write(append(data, '\n')); err == nil {
+		err = l.f.Sync()
+	}
+	if err != nil {
+		l.err = fmt.Errorf("audit log failed: %w", err)
+		return l.err
+	}
+	l.last = e.Hash
+	return nil
+}
+
+// Err returns the error that stopped entries being recorded, if any.
+func (l *AuditLog) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+func (l *AuditLog) Close() error {
+	return l.f.Close()
+}
+
+var errAuditChain = errors.New("audit log hash chain is broken")
+
+// VerifyAuditLog checks the hash chain of an audit log with the key it was written with,
+// returning the number of entries, and the hash of the last entry. An error is returned for the
+// first entry that was modified, or follows a removed entry.
+//
+// Entries removed from the end of the log can't be detected from the log alone, so compare the
+// head with a copy kept elsewhere.
+func VerifyAuditLog(r io.Reader, key []byte) (entries int, head string, err error) {
+	scanner := newAuditScanner(r)
+	for scanner.Scan() {
+		entries++
+		var e AuditEntry
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.DisallowUnknownFields()
+		if err = decoder.Decode(&e); err != nil {
+			return entries - 1, head, fmt.Errorf("line %d: invalid entry: %w", entries, err)
+		}
+		if e.Prev != head {
+			return entries - 1, head, fmt.Errorf("line %d: %w, entry doesn't follow the previous entry", entries, errAuditChain)
+		}
+		if !hmac.Equal([]byte(e.Hash), []byte(e.hash(key))) {
+			return entries - 1, head, fmt.Errorf("line %d: %w, entry has been modified, or the key is wrong", entries, errAuditChain)
+		}
+		head = e.Hash
+	}
+	if err = scanner.Err(); err != nil {
+		return entries, head, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	return entries, head, nil
+}
+
+func newAuditScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	return scanner
+}
+
+// auditDigest hashes and counts the content of an upload as it's read.
+type auditDigest struct {
+	r    io.Reader
+	hash hash.Hash
+	size int64
+}
+
+func (d *auditDigest) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.hash.Write(p[:n])
+	d.size += int64(n)
+	return n, err
+}
+
+// isAudited returns true for the methods of requests that can change the served directory.
+func isAudited(method string) bool {
+	switch method {
+	case http.MethodPut, http.MethodPost, http.MethodPatch, http.MethodDelete, "MKCOL", "COPY", "MOVE":
+		return true
+	}
+	return false
+}
+
+type auditContextKey struct{}
+
+// auditRecord collects the audit entry of a request as it's served. Handlers add the details
+// they know with auditBody, setAuditPath, setAuditDestination and auditObject.
+type auditRecord struct {
+	h           *FileHandler
+	r           *http.Request
+	w           *auditWriter
+	path        string
+	destination string
+	digest      *auditDigest
+	// objects are the entries of requests that change many objects, which are recorded instead
+	// of an entry for the request.
+	objects []AuditEntry
+}
+
+// startAudit starts recording a request that can change the served directory, returning the
+// ResponseWriter and request to serve it with, and a function that records the entry once it
+// has been served. The response is held back until the entry is recorded, so that clients are
+// never told that a change succeeded if it wasn't recorded. If the audit log has failed, a 503
+// response is written, and false is returned, so that no more changes are made.
+//
+// Requests that are already being recorded, e.g. by ServeHTTP before Put, aren't recorded twice.
+func (h *FileHandler) startAudit(w http.ResponseWriter, r *http.Request, cleaned string) (http.ResponseWriter, *http.Request, func(), bool) {
+	if h.AuditLog == nil || !isAudited(r.Method) || auditFromContext(r.Context()) != nil {
+		return w, r, func() {}, true
+	}
+	if err := h.AuditLog.Err(); err != nil {
+		h.logger(r).Error("Refused change, because the audit log failed", slog.String("method", r.Method), slog.String("path", "/"+cleaned), slog.Any("error", err))
+		http.Error(w, "audit log unavailable", http.StatusServiceUnavailable)
+		return w, r, nil, false
+	}
+	a := &auditRecord{h: h, w: &auditWriter{ResponseWriter: w}, path: cleaned}
+	a.r = r.WithContext(context.WithValue(r.Context(), auditContextKey{}, a))
+	return a.w, a.r, a.record, true
+}
+
+func auditFromContext(ctx context.Context) *auditRecord {
+	a, _ := ctx.Value(auditContextKey{}).(*auditRecord)
+	return a
+}
+
+// auditBody returns a reader that hashes and counts the content of an upload, if the request is
+// being recorded.
+func auditBody(r *http.Request, body io.Reader) io.Reader {
+	a := auditFromContext(r.Context())
+	if a == nil {
+		return body
+	}
+	a.digest = &auditDigest{r: body, hash: sha256.New()}
+	return a.digest
+}
+
+// setAuditPath sets the path of the entry, for requests that change a path other than the
+// request path, e.g. tus uploads.
+func setAuditPath(r *http.Request, cleaned string) {
+	if a := auditFromContext(r.Context()); a != nil {
+		a.path = cleaned
+	}
+}
+
+// setAuditDestination sets the destination of a WebDAV COPY or MOVE.
+func setAuditDestination(r *http.Request, cleaned string) {
+	if a := auditFromContext(r.Context()); a != nil {
+		a.destination = cleaned
+	}
+}
+
+// auditObject adds an entry for one of the objects changed by a request that changes many,
+// e.g. an S3 DeleteObjects request.
+func auditObject(r *http.Request, cleaned string, status int) {
+	if a := auditFromContext(r.Context()); a != nil {
+		a.objects = append(a.objects, a.entry(cleaned, status))
+	}
+}
+
+func (a *auditRecord) entry(cleaned string, status int) AuditEntry {
+	e := AuditEntry{
+		Time:     time.Now().UTC(),
+		ClientIP: ClientIP(a.r).String(),
+		Method:   a.r.Method,
+		Path:     "/" + cleaned,
+		Status:   status,
+	}
+	if id := IdentityFromContext(a.r.Context()); id != nil {
+		e.User, e.AuthMethod = id.Name, id.Method
+	}
+	return e
+}
+
+func (a *auditRecord) record() {
+	entries := a.objects
+	if len(entries) == 0 {
+		e := a.entry(a.path, a.w.Status())
+		if a.destination != "" {
+			e.Destination = "/" + a.destination
+		}
+		if a.digest != nil && a.digest.size > 0 {
+			e.Size = a.digest.size
+			e.SHA256 = hex.EncodeToString(a.digest.hash.Sum(nil))
+		}
+		entries = []AuditEntry{e}
+	}
+	for _, e := range entries {
+		if err := a.h.AuditLog.Record(&e); err != nil {
+			a.h.logger(a.r).Error("Failed to write audit log", slog.String("method", e.Method), slog.String("path", e.Path), slog.Any("error", err))
+			a.w.fail()
+			break
+		}
+	}
+	a.w.flush()
+}
+
+// auditWriter holds back the response to a change until it has been recorded.
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	failed bool
+}
+
+func (w *auditWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *auditWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// fail replaces the response with an error, because the change couldn't be recorded.
+func (w *auditWriter) fail() {
+	w.failed = true
+}
+
+func (w *auditWriter) flush() {
+	if w.failed {
+		w.Header().Del("ETag")
+		w.Header().Del("Location")
+		http.Error(w.ResponseWriter, "failed to write audit log", http.StatusInternalServerError)
+		return
+	}
+	w.ResponseWriter.WriteHeader(w.Status())
+	_, _ = w.body.WriteTo(w.ResponseWriter)
+}
@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var testAuditKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(t.TempDir(), "audit.jsonl")
+	fh, closer, err := NewFileHandler(slog.New(slog.DiscardHandler), dir, false)
+	if err != nil {
+		t.Fatalf("Failed to create FileHandler: %v", err)
+	}
+	defer closer()
+	if fh.AuditLog, err = NewAuditLog(name, testAuditKey); err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+
+	serve := func(method, target, body string, id *Identity) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		if id != nil {
+			req = req.WithContext(WithIdentity(req.Context(), id))
+		}
+		fh.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	serve(http.MethodPut, "/docs/report.txt", "hello", &Identity{Name: "alice", Method: "basic"})
+	fh.IsReadOnly = true
+	serve(http.MethodDelete, "/docs/report.txt", "", nil)
+	fh.IsReadOnly = false
+	serve(http.MethodDelete, "/docs/report.txt", "", &Identity{Name: "bob", Method: "session"})
+	if err = fh.AuditLog.Close(); err != nil {
+		t.Fatalf("Failed to close audit log: %v", err)
+	}
+
+	// Reopening the log continues the chain.
+	if fh.AuditLog, err = NewAuditLog(name, testAuditKey); err != nil {
+		t.Fatalf("Failed to reopen audit log: %v", err)
+	}
+	serve(http.MethodPost, "/upload.bin", "data", nil)
+	fh.AuditLog.Close()
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected 4 entries, got %d:\n%s", len(lines), data)
+	}
+	var entries []AuditEntry
+	for _, line := range lines {
+		var e AuditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("Failed to decode entry %q: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	expected := []struct {
+		user, method, path string
+		status             int
+		size               int64
+	}{
+		{user: "alice", method: http.MethodPut, path: "/docs/report.txt", status: http.StatusCreated, size: 5},
+		{user: "", method: http.MethodDelete, path: "/docs/report.txt", status: http.StatusMethodNotAllowed},
+		{user: "bob", method: http.MethodDelete, path: "/docs/report.txt", status: http.StatusNoContent},
+		{user: "", method: http.MethodPost, path: "/upload.bin", status: http.StatusCreated, size: 4},
+	}
+	for i, e := range entries {
+		exp := expected[i]
+		if e.User != exp.user || e.Method != exp.method || e.Path != exp.path || e.Status != exp.status || e.Size != exp.size || e.ClientIP != "192.0.2.1" {
+			t.Errorf("Entry %d: unexpected %+v", i, e)
+		}
+	}
+	// sha256 of "hello".
+	if entries[0].SHA256 != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("Unexpected hash %s", entries[0].SHA256)
+	}
+
+	t.Run("the chain is valid", func(t *testing.T) {
+		n, head, err := VerifyAuditLog(bytes.NewReader(data), testAuditKey)
+		if err != nil || n != 4 {
+			t.Errorf("Expected 4 valid entries, got %d: %v", n, err)
+		}
+		if head != entries[3].Hash {
+			t.Errorf("Expected the head to be the hash of the last entry, got %q", head)
+		}
+	})
+	t.Run("modified entries are detected", func(t *testing.T) {
+		modified := strings.Replace(string(data), `"user":"bob"`, `"user":"carol"`, 1)
+		n, _, err := VerifyAuditLog(strings.NewReader(modified), testAuditKey)
+		if !errors.Is(err, errAuditChain) || n != 2 {
+			t.Errorf("Expected the third entry to fail, got %d: %v", n, err)
+		}
+	})
+	t.Run("removed entries are detected", func(t *testing.T) {
+		removed := strings.Join(append(lines[:1:1], lines[2:]...), "\n")
+		n, _, err := VerifyAuditLog(strings.NewReader(removed), testAuditKey)
+		if !errors.Is(err, errAuditChain) || n != 1 {
+			t.Errorf("Expected the second entry to fail, got %d: %v", n, err)
+		}
+	})
+	t.Run("chains rewritten without the key are detected", func(t *testing.T) {
+		n, _, err := VerifyAuditLog(bytes.NewReader(data), []byte("fedcba9876543210fedcba9876543210"))
+		if !errors.Is(err, errAuditChain) || n != 0 {
+			t.Errorf("Expected the first entry to fail, got %d: %v", n, err)
+		}
+	})
+	t.Run("modified logs can't be reopened", func(t *testing.T) {
+		modified := filepath.Join(t.TempDir(), "audit.jsonl")
+		if err := os.WriteFile(modified, []byte(strings.Replace(string(data), `"user":"bob"`, `"user":"carol"`, 1)), 0600); err != nil {
+			t.Fatalf("Failed to write audit log: %v", err)
+		}
+		if l, err := NewAuditLog(modified, testAuditKey); !errors.Is(err, errAuditChain) {
+			t.Errorf("Expected the modified log to be rejected, got %v", err)
+			if l != nil {
+				l.Close()
+			}
+		}
+		if l, err := NewAuditLog(name, []byte("fedcba9876543210fedcba9876543210")); !errors.Is(err, errAuditChain) {
+			t.Errorf("Expected the log to be rejected with the wrong key, got %v", err)
+			if l != nil {
+				l.Close()
+			}
+		}
+	})
+}
+
+func TestAuditLogCoverage(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "bucket"), 0755); err != nil {
+		t.Fatalf("Failed to create bucket: %v", err)
+	}
+	name := filepath.Join(t.TempDir(), "audit.jsonl")
+	log := slog.New(slog.DiscardHandler)
+	fh, closer, err := NewFileHandler(log, dir, false)
+	if err != nil {
+		t.Fatalf("Failed to create FileHandler: %v", err)
+	}
+	defer closer()
+	fh.WebDAV = true
+	fh.TusEnabled = true
+	if fh.AuditLog, err = NewAuditLog(name, testAuditKey); err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer fh.AuditLog.Close()
+	s3 := NewS3Handler(log, fh, map[string]string{testAccessKey: testSecretKey}, "us-east-1")
+
+	serve := func(method, target string, header map[string]string) {
+		req := httptest.NewRequest(method, target, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		fh.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	serve("MKCOL", "/docs", nil)
+	serve("COPY", "/docs", map[string]string{"Destination": "/copy"})
+	serve("MOVE", "/copy", map[string]string{"Destination": "/moved"})
+	location := tusCreate(t, fh, 5, "tus.txt").Header().Get("Location")
+	tusPatch(t, fh, location, "0", "hello")
+	s3Request(t, s3, http.MethodPut, "/bucket/a.txt", "hello")
+	s3Request(t, s3, http.MethodPost, "/bucket?delete", `<Delete><Object><Key>a.txt</Key></Object><Object><Key>../x</Key></Object></Delete>`)
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	var actual []string
+	for line := range strings.SplitSeq(strings.TrimSpace(string(data)), "\n") {
+		var e AuditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("Failed to decode entry %q: %v", line, err)
+		}
+		actual = append(actual, fmt.Sprintf("%s %s %s %d %d %s", e.Method, e.Path, e.Destination, e.Status, e.Size, e.User))
+	}
+	expected := []string{
+		"MKCOL /docs  201 0 ",
+		"COPY /docs /copy 201 0 ",
+		"MOVE /copy /moved 201 0 ",
+		"POST /tus.txt  201 0 ",
+		"PATCH /tus.txt  204 5 ",
+		"PUT /bucket/a.txt  200 5 " + testAccessKey,
+		"POST /bucket/a.txt  204 0 " + testAccessKey,
+		"POST /x  400 0 " + testAccessKey,
+	}
+	if !slices.Equal(actual, expected) {
+		t.Errorf("Expected entries:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+}
+
+func TestAuditLogFailure(t *testing.T) {
+	dir := t.TempDir()
+	fh, closer, err := NewFileHandler(slog.New(slog.DiscardHandler), dir, false)
+	if err != nil {
+		t.Fatalf("Failed to create FileHandler: %v", err)
+	}
+	defer closer()
+	if fh.AuditLog, err = NewAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"), testAuditKey); err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	// Closing the file makes writing the next entry fail.
+	fh.AuditLog.Close()
+
+	put := func(name string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		fh.ServeHTTP(w, httptest.NewRequest(http.MethodPut, name, strings.NewReader("hello")))
+		return w
+	}
+	if w := put("/a.txt"); w.Code != http.StatusInternalServerError || w.Header().Get("ETag") != "" {
+		t.Errorf("Expected a change that wasn't recorded to fail, got %d", w.Code)
+	}
+	if w := put("/b.txt"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected changes to be refused once the audit log has failed, got %d", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected the file not to be written")
+	}
+	w := httptest.NewRecorder()
+	fh.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/a.txt", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected reads to be allowed, got %d", w.Code)
+	}
+}
@@ -1,36 +1,130 @@
 package handlers
 
 import (
-	"crypto/subtle"
+	"context"
 	"net/http"
 )
 
-func NewBasicAuthMiddleware(next http.Handler, username, password string) http.Handler {
+func NewBasicAuthMiddleware(next http.Handler, username, password string) *BasicAuthMiddleware {
+	return NewBasicAuthMiddlewareWithVerifier(next, staticPassword{username: username, password: password})
+}
+
+// NewBasicAuthMiddlewareWithVerifier requires basic auth credentials that are accepted by the
+// verifier, e.g. an Htpasswd file.
+func NewBasicAuthMiddlewareWithVerifier(next http.Handler, verifier PasswordVerifier) *BasicAuthMiddleware {
 	return &BasicAuthMiddleware{
 		next:     next,
-		username: username,
-		password: password,
+		verifier: verifier,
 	}
 }
 
 type BasicAuthMiddleware struct {
 	next     http.Handler
-	username string
-	password string
+	verifier PasswordVerifier
+	// AllowAnonymous passes requests without credentials through as anonymous, leaving the
+	// Authorizer to decide what they can access. Invalid credentials are still rejected.
+	AllowAnonymous bool
+	// Throttle slows down password guessing, no throttling if nil.
+	Throttle *Throttle
 }
 
-func (m *BasicAuthMiddleware) credentialsMatch(user, pass string) bool {
-	userMatches := subtle.ConstantTimeCompare([]byte(user), []byte(m.username)) == 1
-	passMatches := subtle.ConstantTimeCompare([]byte(pass), []byte(m.password)) == 1
-	return userMatches && passMatches
-}
+const basicAuthChallenge = `Basic realm="Restricted"`
 
 func (m *BasicAuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	user, pass, ok := r.BasicAuth()
-	if !ok || !m.credentialsMatch(user, pass) {
-		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+	if !ok && m.AllowAnonymous {
+		m.next.ServeHTTP(w, withChallenge(r, basicAuthChallenge))
+		return
+	}
+	if !ok {
+		w.Header().Set("WWW-Authenticate", basicAuthChallenge)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ip := ClientIP(r).String()
+	if m.Throttle != nil {
+		if wait := m.Throttle.Wait(ip, user); wait > 0 {
+			tooManyRequests(w, wait)
+			return
+		}
+	}
+	if !m.verifier.Verify(user, pass) {
+		if m.Throttle != nil {
+			m.Throttle.Fail(ip, user)
+		}
+		w.Header().Set("WWW-Authenticate", basicAuthChallenge)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if m.Throttle != nil {
+		m.Throttle.Succeed(user)
+	}
+	m.next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), &Identity{Name: user, Method: "basic"})))
+}
+
+// TokenVerifier returns the identity of a bearer token, e.g. an API key or JWT. The context is
+// that of the request.
+type TokenVerifier interface {
+	Identity(ctx context.Context, token string) (*Identity, error)
+}
+
+// TokenVerifiers tries each verifier in turn, returning the first identity.
+type TokenVerifiers []TokenVerifier
+
+func (v TokenVerifiers) Identity(ctx context.Context, token string) (id *Identity, err error) {
+	err = errInvalidAPIKey
+	for _, verifier := range v {
+		if id, err = verifier.Identity(ctx, token); err == nil {
+			return id, nil
+		}
+	}
+	return nil, err
+}
+
+// NewBearerAuthMiddleware requires an Authorization: Bearer header with a token that's accepted
+// by the verifier, e.g. APIKeys.
+func NewBearerAuthMiddleware(next http.Handler, verifier TokenVerifier) *BearerAuthMiddleware {
+	return &BearerAuthMiddleware{
+		next:     next,
+		verifier: verifier,
+	}
+}
+
+type BearerAuthMiddleware struct {
+	next     http.Handler
+	verifier TokenVerifier
+	// Fallback handles requests without a bearer token, e.g. a BasicAuthMiddleware, so that
+	// people and CI jobs can use different credentials.
+	Fallback http.Handler
+	// AllowAnonymous passes requests without credentials through as anonymous, leaving the
+	// Authorizer to decide what they can access. Invalid keys are still rejected.
+	AllowAnonymous bool
+}
+
+const bearerAuthChallenge = `Bearer realm="Restricted"`
+
+func (m *BearerAuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := bearerToken(r)
+	if !ok {
+		if m.AllowAnonymous {
+			r = withChallenge(r, bearerAuthChallenge)
+		}
+		switch {
+		case m.Fallback != nil:
+			m.Fallback.ServeHTTP(w, r)
+		case m.AllowAnonymous:
+			m.next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("WWW-Authenticate", bearerAuthChallenge)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		}
+		return
+	}
+	id, err := m.verifier.Identity(r.Context(), token)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", bearerAuthChallenge+`, error="invalid_token"`)
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	m.next.ServeHTTP(w, r)
+	m.next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), id)))
 }
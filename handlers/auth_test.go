@@ -48,4 +48,42 @@ func TestBasicAuthMiddleware(t *testing.T) {
 			t.Error("expected next handler to be called, but it was not")
 		}
 	})
+	t.Run("anonymous requests are allowed through when enabled", func(t *testing.T) {
+		var id *Identity
+		var challenges []string
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id = IdentityFromContext(r.Context())
+			challenges = authChallenges(r)
+		})
+		m := NewBasicAuthMiddleware(next, "admin", "secret")
+		m.AllowAnonymous = true
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+		if id != nil {
+			t.Errorf("expected no identity, got %v", id)
+		}
+		if len(challenges) != 1 {
+			t.Errorf("expected a challenge, got %v", challenges)
+		}
+
+		req = httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth("admin", "secret")
+		m.ServeHTTP(httptest.NewRecorder(), req)
+		if id == nil || id.Name != "admin" {
+			t.Errorf("expected the admin identity, got %v", id)
+		}
+
+		req = httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth("admin", "wrongpassword")
+		w = httptest.NewRecorder()
+		m.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401, got %d", w.Code)
+		}
+	})
 }
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// LoadClientCAs reads the PEM encoded CA certificates that client certificates must be signed by.
+func LoadClientCAs(name string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM encoded certificates found", name)
+	}
+	return pool, nil
+}
+
+// NewClientCertAuthMiddleware authenticates requests by their verified TLS client certificate.
+// The TLS server must be configured to verify client certificates against trusted CAs.
+func NewClientCertAuthMiddleware(next http.Handler) *ClientCertAuthMiddleware {
+	return &ClientCertAuthMiddleware{
+		next: next,
+	}
+}
+
+type ClientCertAuthMiddleware struct {
+	next http.Handler
+	// Fallback handles requests without a client certificate, e.g. a BasicAuthMiddleware, so that
+	// services can use certificates while people use passwords.
+	Fallback http.Handler
+	// AllowAnonymous passes requests without credentials through as anonymous, leaving the
+	// Authorizer to decide what they can access.
+	AllowAnonymous bool
+}
+
+func (m *ClientCertAuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		switch {
+		case m.Fallback != nil:
+			m.Fallback.ServeHTTP(w, r)
+		case m.AllowAnonymous:
+			m.next.ServeHTTP(w, r)
+		default:
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		}
+		return
+	}
+	id := clientCertIdentity(r.TLS.VerifiedChains[0][0])
+	if id.Name == "" {
+		http.Error(w, "client certificate has no subject common name or SAN", http.StatusUnauthorized)
+		return
+	}
+	m.next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), id)))
+}
+
+// clientCertIdentity names the user after the subject common name of the certificate, or its
+// first email, DNS or URI SAN if it doesn't have one. The subject organisational units are used
+// as groups.
+func clientCertIdentity(cert *x509.Certificate) *Identity {
+	id := &Identity{
+		Name:   cert.Subject.CommonName,
+		Groups: cert.Subject.OrganizationalUnit,
+		Method: "mtls",
+	}
+	switch {
+	case id.Name != "":
+	case len(cert.EmailAddresses) > 0:
+		id.Name = cert.EmailAddresses[0]
+	case len(cert.DNSNames) > 0:
+		id.Name = cert.DNSNames[0]
+	case len(cert.URIs) > 0:
+		id.Name = cert.URIs[0].String()
+	}
+	return id
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCert(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return cert, key
+}
+
+func TestClientCertAuthMiddleware(t *testing.T) {
+	ca, caKey := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	client, clientKey := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "build-agent", OrganizationalUnit: []string{"ci"}},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "releases"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	log := slog.New(slog.DiscardHandler)
+	fh, closer, err := NewFileHandler(log, dir, false)
+	if err != nil {
+		t.Fatalf("Failed to create FileHandler: %v", err)
+	}
+	defer closer()
+	if fh.Authorizer, err = ParseACL(strings.NewReader("@ci /releases/** all\nadmin /** all\n")); err != nil {
+		t.Fatalf("Failed to parse ACL: %v", err)
+	}
+	certAuth := NewClientCertAuthMiddleware(fh)
+	certAuth.Fallback = NewBasicAuthMiddleware(fh, "admin", "secret")
+
+	server := httptest.NewUnstartedServer(certAuth)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	server.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	server.StartTLS()
+	defer server.Close()
+
+	withCert := server.Client()
+	withCert.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{{
+		Certificate: [][]byte{client.Raw},
+		PrivateKey:  clientKey,
+	}}
+	withoutCert := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}}}
+
+	put := func(client *http.Client, path string, setAuth func(r *http.Request)) int {
+		req, err := http.NewRequest(http.MethodPut, server.URL+path, strings.NewReader("content"))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		setAuth(req)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode
+	}
+
+	t.Run("Certificate groups are used for access control", func(t *testing.T) {
+		if code := put(withCert, "/releases/app.zip", func(r *http.Request) {}); code != http.StatusCreated {
+			t.Errorf("Expected status 201, got %d", code)
+		}
+		if code := put(withCert, "/app.zip", func(r *http.Request) {}); code != http.StatusForbidden {
+			t.Errorf("Expected status 403, got %d", code)
+		}
+	})
+	t.Run("Clients without certificates can use basic auth", func(t *testing.T) {
+		if code := put(withoutCert, "/app.zip", func(r *http.Request) {}); code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d", code)
+		}
+		if code := put(withoutCert, "/app.zip", func(r *http.Request) { r.SetBasicAuth("admin", "secret") }); code != http.StatusCreated {
+			t.Errorf("Expected status 201, got %d", code)
+		}
+	})
+	t.Run("Certificates without a common name use the SAN", func(t *testing.T) {
+		cert, _ := newTestCert(t, &x509.Certificate{EmailAddresses: []string{"bot@example.com"}}, ca, caKey)
+		if id := clientCertIdentity(cert); id.Name != "bot@example.com" || id.Method != "mtls" {
+			t.Errorf("Unexpected identity: %+v", id)
+		}
+	})
+}
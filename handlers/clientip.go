@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ParsePrefixes parses a comma separated list of CIDR ranges or IP addresses, e.g.
+// 10.0.0.0/8,192.0.2.1.
+func ParsePrefixes(s string) (prefixes []netip.Prefix, err error) {
+	for item := range strings.SplitSeq(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if strings.Contains(item, "/") {
+			prefix, err := netip.ParsePrefix(item)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address or CIDR range %q", item)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type clientIPContextKey struct{}
+
+// ClientIP returns the IP address of the client, resolved from the X-Forwarded-For or Forwarded
+// headers by the ClientIPMiddleware if the request came through a trusted proxy, or the address
+// of the peer otherwise. It's invalid if the address can't be parsed.
+func ClientIP(r *http.Request) netip.Addr {
+	if addr, ok := r.Context().Value(clientIPContextKey{}).(netip.Addr); ok {
+		return addr
+	}
+	return peerIP(r)
+}
+
+func peerIP(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, _ := netip.ParseAddr(host)
+	return addr.Unmap()
+}
+
+// ProxyHeaders are the headers that trusted proxies set with the address and protocol of the client.
+const (
+	// ProxyHeadersXForwarded is the X-Forwarded-For and X-Forwarded-Proto headers.
+	ProxyHeadersXForwarded = "x-forwarded"
+	// ProxyHeadersForwarded is the Forwarded header (RFC 7239).
+	ProxyHeadersForwarded = "forwarded"
+)
+
+// NewClientIPMiddleware resolves the IP address of the client, see ClientIP.
+func NewClientIPMiddleware(next http.Handler, trustedProxies []netip.Prefix) *ClientIPMiddleware {
+	return &ClientIPMiddleware{
+		next:           next,
+		trustedProxies: trustedProxies,
+		ProxyHeaders:   ProxyHeadersXForwarded,
+	}
+}
+
+type ClientIPMiddleware struct {
+	next           http.Handler
+	trustedProxies []netip.Prefix
+	// ProxyHeaders are the headers that the trusted proxies set, ProxyHeadersXForwarded or
+	// ProxyHeadersForwarded. The other headers are ignored, since a proxy passes them on from
+	// the client unchanged, so they could be used to spoof the client's address.
+	ProxyHeaders string
+}
+
+func (m *ClientIPMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), clientIPContextKey{}, m.resolve(r))
+	if peer := peerIP(r); peer.IsValid() && containsAddr(m.trustedProxies, peer) && strings.EqualFold(m.forwardedProto(r), "https") {
+		ctx = context.WithValue(ctx, forwardedHTTPSContextKey{}, true)
+	}
+	m.next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+type forwardedHTTPSContextKey struct{}
+
+// isHTTPS returns true if the request was made over TLS, either to the server, or to a trusted
+// proxy that terminates TLS, according to the Forwarded or X-Forwarded-Proto header.
+func isHTTPS(r *http.Request) bool {
+	forwarded, _ := r.Context().Value(forwardedHTTPSContextKey{}).(bool)
+	return r.TLS != nil || forwarded
+}
+
+// forwardedProto returns the protocol that the client used to connect to the first proxy.
+func (m *ClientIPMiddleware) forwardedProto(r *http.Request) string {
+	if m.ProxyHeaders == ProxyHeadersForwarded {
+		element, _, _ := strings.Cut(r.Header.Get("Forwarded"), ",")
+		return forwardedParam(element, "proto")
+	}
+	proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	return strings.TrimSpace(proto)
+}
+
+// resolve walks the chain of forwarded addresses from the peer backwards, skipping trusted
+// proxies, since only the addresses added by trusted proxies can be relied on.
+func (m *ClientIPMiddleware) resolve(r *http.Request) netip.Addr {
+	addr := peerIP(r)
+	if !addr.IsValid() || !containsAddr(m.trustedProxies, addr) {
+		return addr
+	}
+	chain := m.forwardedFor(r)
+	for i := len(chain) - 1; i >= 0; i-- {
+		next, err := parseForwardedAddr(chain[i])
+		if err != nil {
+			// Obfuscated or unknown addresses can't be resolved further.
+			return addr
+		}
+		addr = next
+		if !containsAddr(m.trustedProxies, addr) {
+			return addr
+		}
+	}
+	return addr
+}
+
+// forwardedFor returns the client addresses of the proxy headers, in the order that they were
+// added.
+func (m *ClientIPMiddleware) forwardedFor(r *http.Request) (chain []string) {
+	if m.ProxyHeaders == ProxyHeadersForwarded {
+		for _, header := range r.Header.Values("Forwarded") {
+			for element := range strings.SplitSeq(header, ",") {
+				chain = append(chain, forwardedParam(element, "for"))
+			}
+		}
+		return chain
+	}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for item := range strings.SplitSeq(header, ",") {
+			chain = append(chain, strings.TrimSpace(item))
+		}
+	}
+	return chain
+}
+
+// forwardedParam returns the value of a parameter of an element of a Forwarded header, e.g. for
+// or proto.
+func forwardedParam(element, name string) string {
+	for pair := range strings.SplitSeq(element, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		if strings.EqualFold(key, name) {
+			return strings.Trim(value, `"`)
+		}
+	}
+	return ""
+}
+
+// parseForwardedAddr parses an address that may have a port, and brackets around IPv6 addresses,
+// e.g. 192.0.2.1, 192.0.2.1:4711 or [2001:db8::1]:4711.
+func parseForwardedAddr(s string) (netip.Addr, error) {
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), nil
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	return addr.Unmap(), err
+}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParsePrefixes("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatalf("Failed to parse prefixes: %v", err)
+	}
+	tests := []struct {
+		name         string
+		proxyHeaders string
+		remoteAddr   string
+		headers      map[string]string
+		expected     string
+	}{
+		{
+			name:       "the peer is used without a proxy",
+			remoteAddr: "203.0.113.5:1234",
+			expected:   "203.0.113.5",
+		},
+		{
+			name:       "headers from untrusted peers are ignored",
+			remoteAddr: "203.0.113.5:1234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			expected:   "203.0.113.5",
+		},
+		{
+			name:       "X-Forwarded-For from a trusted proxy is used",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			expected:   "198.51.100.1",
+		},
+		{
+			name:       "addresses added by the client are ignored",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "127.0.0.1, 198.51.100.1, 10.0.0.2"},
+			expected:   "198.51.100.1",
+		},
+		{
+			name:       "Forwarded is ignored if the proxies set X-Forwarded-For",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"Forwarded": "for=198.51.100.7", "X-Forwarded-For": "203.0.113.5"},
+			expected:   "203.0.113.5",
+		},
+		{
+			name:       "Forwarded isn't used instead of a missing X-Forwarded-For",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"Forwarded": "for=198.51.100.7"},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:         "Forwarded from a trusted proxy is used",
+			proxyHeaders: ProxyHeadersForwarded,
+			remoteAddr:   "192.0.2.1:1234",
+			headers:      map[string]string{"Forwarded": `for="[2001:db8::17]:4711";proto=https, for=10.1.1.1`},
+			expected:     "2001:db8::17",
+		},
+		{
+			name:         "X-Forwarded-For is ignored if the proxies set Forwarded",
+			proxyHeaders: ProxyHeadersForwarded,
+			remoteAddr:   "10.0.0.1:1234",
+			headers:      map[string]string{"Forwarded": "for=203.0.113.5", "X-Forwarded-For": "198.51.100.7"},
+			expected:     "203.0.113.5",
+		},
+		{
+			name:         "obfuscated addresses stop the resolution",
+			proxyHeaders: ProxyHeadersForwarded,
+			remoteAddr:   "10.0.0.1:1234",
+			headers:      map[string]string{"Forwarded": "for=198.51.100.1, for=_hidden"},
+			expected:     "10.0.0.1",
+		},
+		{
+			name:       "IPv4-mapped IPv6 addresses are unmapped",
+			remoteAddr: "[::ffff:10.0.0.1]:1234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			expected:   "198.51.100.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var actual string
+			handler := NewClientIPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				actual = ClientIP(r).String()
+			}), trusted)
+			if tt.proxyHeaders != "" {
+				handler.ProxyHeaders = tt.proxyHeaders
+			}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			if actual != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, actual)
+			}
+		})
+	}
+	t.Run("invalid prefixes are rejected", func(t *testing.T) {
+		if _, err := ParsePrefixes("10.0.0.0/33"); err == nil {
+			t.Error("Expected an error")
+		}
+		if _, err := ParsePrefixes("example.com"); err == nil {
+			t.Error("Expected an error")
+		}
+	})
+}
+
+func TestIsHTTPS(t *testing.T) {
+	trusted, _ := ParsePrefixes("10.0.0.1")
+	tests := []struct {
+		name         string
+		proxyHeaders string
+		remoteAddr   string
+		headers      map[string]string
+		expected     bool
+	}{
+		{name: "plain HTTP", remoteAddr: "10.0.0.1:1234", expected: false},
+		{name: "X-Forwarded-Proto from a trusted proxy", remoteAddr: "10.0.0.1:1234", headers: map[string]string{"X-Forwarded-Proto": "https"}, expected: true},
+		{name: "X-Forwarded-Proto from other clients", remoteAddr: "192.0.2.1:1234", headers: map[string]string{"X-Forwarded-Proto": "https"}, expected: false},
+		{name: "the protocol of the first proxy is used", remoteAddr: "10.0.0.1:1234", headers: map[string]string{"X-Forwarded-Proto": "http, https"}, expected: false},
+		{name: "Forwarded is ignored if the proxies set X-Forwarded-Proto", remoteAddr: "10.0.0.1:1234", headers: map[string]string{"Forwarded": `for=198.51.100.1;proto=https`}, expected: false},
+		{name: "Forwarded from a trusted proxy", proxyHeaders: ProxyHeadersForwarded, remoteAddr: "10.0.0.1:1234", headers: map[string]string{"Forwarded": `for=198.51.100.1;proto=https`, "X-Forwarded-Proto": "http"}, expected: true},
+		{name: "X-Forwarded-Proto is ignored if the proxies set Forwarded", proxyHeaders: ProxyHeadersForwarded, remoteAddr: "10.0.0.1:1234", headers: map[string]string{"X-Forwarded-Proto": "https"}, expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var actual bool
+			handler := NewClientIPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				actual = isHTTPS(r)
+			}), trusted)
+			if tt.proxyHeaders != "" {
+				handler.ProxyHeaders = tt.proxyHeaders
+			}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			if actual != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestIPFilterMiddleware(t *testing.T) {
+	office, _ := ParsePrefixes("198.51.100.0/24")
+	blocked, _ := ParsePrefixes("198.51.100.66")
+	trusted, _ := ParsePrefixes("10.0.0.1")
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	var logs bytes.Buffer
+	handler := NewClientIPMiddleware(NewIPFilterMiddleware(slog.New(slog.NewTextHandler(&logs, nil)), next,
+		IPFilter{Deny: blocked},
+		IPFilter{Allow: office, Deny: blocked},
+	), trusted)
+
+	tests := []struct {
+		method     string
+		remoteAddr string
+		forwarded  string
+		expected   int
+	}{
+		{method: http.MethodGet, remoteAddr: "203.0.113.5:1234", expected: http.StatusOK},
+		{method: http.MethodPut, remoteAddr: "203.0.113.5:1234", expected: http.StatusForbidden},
+		{method: http.MethodPut, remoteAddr: "198.51.100.5:1234", expected: http.StatusOK},
+		{method: http.MethodDelete, remoteAddr: "198.51.100.66:1234", expected: http.StatusForbidden},
+		{method: http.MethodGet, remoteAddr: "198.51.100.66:1234", expected: http.StatusForbidden},
+		{method: "PROPFIND", remoteAddr: "203.0.113.5:1234", expected: http.StatusOK},
+		{method: http.MethodPut, remoteAddr: "10.0.0.1:1234", forwarded: "198.51.100.5", expected: http.StatusOK},
+		{method: http.MethodPut, remoteAddr: "10.0.0.1:1234", forwarded: "203.0.113.5", expected: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/file.txt", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.expected {
+			t.Errorf("%s from %s (forwarded for %q): expected status %d, got %d", tt.method, tt.remoteAddr, tt.forwarded, tt.expected, w.Code)
+		}
+	}
+	if !strings.Contains(logs.String(), "client_ip=203.0.113.5") {
+		t.Errorf("Expected denied requests to be logged with the client IP, got %q", logs.String())
+	}
+}
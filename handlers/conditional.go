@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+var errPreconditionFailed = errors.New("precondition failed")
+
+// preconditionsMet evaluates the If-Match and If-None-Match headers of a write request against
+// the current state of the file, which is nil if the file doesn't exist.
+//
+// If-None-Match: * only allows the file to be created, while If-Match allows a client to only
+// overwrite or delete the version of the file it last read.
+func preconditionsMet(r *http.Request, current fs.FileInfo) bool {
+	var currentETag string
+	if current != nil && current.Mode().IsRegular() {
+		currentETag = etag(current)
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if current == nil {
+			return false
+		}
+		if !etagListContains(ifMatch, currentETag, false) {
+			return false
+		}
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if current != nil && etagListContains(ifNoneMatch, currentETag, true) {
+			return false
+		}
+	}
+	return true
+}
+
+// etagListContains returns true if the comma separated list of entity tags in header matches
+// the ETag, or is "*". Weak entity tags only match if weak comparison is allowed.
+func etagListContains(header, etag string, weak bool) bool {
+	for tag := range strings.SplitSeq(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if etag != "" && tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// stat returns the file's info, or nil if it doesn't exist.
+func (h *FileHandler) stat(name string) (fs.FileInfo, error) {
+	fi, err := h.rootedFileSystem.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return fi, err
+}
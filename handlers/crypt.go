@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SHA-crypt, as used by glibc's crypt for $5$ (SHA-256) and $6$ (SHA-512) hashes.
+// See https://www.akkadia.org/drepper/SHA-crypt.txt
+
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSalt       = 16
+	cryptAlphabet         = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+var errInvalidCryptHash = errors.New("invalid crypt hash")
+
+// The order in which the bytes of the digest are encoded, in groups of three.
+var (
+	sha256CryptOrder = []int{
+		0, 10, 20, 21, 1, 11, 12, 22, 2, 3, 13, 23, 24, 4, 14,
+		15, 25, 5, 6, 16, 26, 27, 7, 17, 18, 28, 8, 9, 19, 29,
+		31, 30,
+	}
+	sha512CryptOrder = []int{
+		0, 21, 42, 22, 43, 1, 44, 2, 23, 3, 24, 45, 25, 46, 4,
+		47, 5, 26, 6, 27, 48, 28, 49, 7, 50, 8, 29, 9, 30, 51,
+		31, 52, 10, 53, 11, 32, 12, 33, 54, 34, 55, 13, 56, 14, 35,
+		15, 36, 57, 37, 58, 16, 59, 17, 38, 18, 39, 60, 40, 61, 19,
+		62, 20, 41,
+		63,
+	}
+)
+
+// shaCrypt hashes the password with the settings ($5$rounds=N$salt or $6$salt) at the start of
+// the hash, returning the complete hash in the same format.
+func shaCrypt(password, hashed string) (string, error) {
+	var newHash func() hash.Hash
+	var order []int
+	switch {
+	case strings.HasPrefix(hashed, "$5$"):
+		newHash, order = sha256.New, sha256CryptOrder
+	case strings.HasPrefix(hashed, "$6$"):
+		newHash, order = sha512.New, sha512CryptOrder
+	default:
+		return "", errInvalidCryptHash
+	}
+	prefix, settings := hashed[:3], hashed[3:]
+
+	rounds, customRounds := shaCryptDefaultRounds, false
+	if after, ok := strings.CutPrefix(settings, "rounds="); ok {
+		roundsText, rest, ok := strings.Cut(after, "$")
+		if !ok {
+			return "", errInvalidCryptHash
+		}
+		n, err := strconv.Atoi(roundsText)
+		if err != nil {
+			return "", errInvalidCryptHash
+		}
+		rounds, customRounds, settings = min(max(n, shaCryptMinRounds), shaCryptMaxRounds), true, rest
+	}
+	salt, _, _ := strings.Cut(settings, "$")
+	if len(salt) > shaCryptMaxSalt {
+		salt = salt[:shaCryptMaxSalt]
+	}
+	p, s := []byte(password), []byte(salt)
+
+	// Digest B is P + S + P.
+	h := newHash()
+	h.Write(p)
+	h.Write(s)
+	h.Write(p)
+	b := h.Sum(nil)
+	size := len(b)
+
+	// Digest A is P + S, followed by B for each byte of P, then B or P for each bit of len(P).
+	h.Reset()
+	h.Write(p)
+	h.Write(s)
+	n := len(p)
+	for ; n > size; n -= size {
+		h.Write(b)
+	}
+	h.Write(b[:n])
+	for n = len(p); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(p)
+		}
+	}
+	a := h.Sum(nil)
+
+	// P' is the digest of P repeated len(P) times, repeated to the length of P.
+	h.Reset()
+	for range p {
+		h.Write(p)
+	}
+	pBytes := repeatBytes(h.Sum(nil), len(p))
+
+	// S' is the digest of S repeated 16 + A[0] times, repeated to the length of S.
+	h.Reset()
+	for range 16 + int(a[0]) {
+		h.Write(s)
+	}
+	sBytes := repeatBytes(h.Sum(nil), len(s))
+
+	for i := range rounds {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(pBytes)
+		} else {
+			h.Write(a)
+		}
+		if i%3 != 0 {
+			h.Write(sBytes)
+		}
+		if i%7 != 0 {
+			h.Write(pBytes)
+		}
+		if i&1 != 0 {
+			h.Write(a)
+		} else {
+			h.Write(pBytes)
+		}
+		a = h.Sum(a[:0])
+	}
+
+	var sb strings.Builder
+	sb.WriteString(prefix)
+	if customRounds {
+		sb.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	sb.WriteString(salt)
+	sb.WriteByte('$')
+	for i := 0; i < len(order); i += 3 {
+		group := order[i:min(i+3, len(order))]
+		var v uint
+		for _, idx := range group {
+			v = v<<8 | uint(a[idx])
+		}
+		for range len(group) + 1 {
+			sb.WriteByte(cryptAlphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	return sb.String(), nil
+}
+
+func repeatBytes(digest []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, digest[:min(len(digest), n-len(out))]...)
+	}
+	return out
+}
@@ -0,0 +1,428 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// maxCompressionRatio is the maximum ratio between the extracted and uploaded size of an
+	// archive, to reject zip bombs even if there's no size limit.
+	maxCompressionRatio = 200
+	// minCompressionRatioSize is the extracted size above which the compression ratio is checked,
+	// so that small, highly compressible files aren't rejected.
+	minCompressionRatioSize = 1 << 20
+)
+
+var (
+	errInvalidArchive  = errors.New("invalid archive")
+	errArchiveTooLarge = errors.New("archive too large")
+	errExtractConflict = errors.New("conflict")
+)
+
+// Extract unpacks the tar, tar.gz or zip archive in the request body into the directory at
+// cleaned. The archive is unpacked into the staging area first, and checked for conflicts with
+// the directory before any file is moved into place, so that invalid archives don't leave
+// partially extracted files behind. Hidden files, e.g. dotfiles with HideDotfiles, are skipped.
+//
+// By default, the files are added to the directory, replacing existing files with the same name.
+// With ?replace=true, the directory is replaced by the contents of the archive.
+func (h *FileHandler) Extract(w http.ResponseWriter, r *http.Request, cleaned string) {
+	format := r.URL.Query().Get("extract")
+	if format != "true" && format != "zip" && format != "tar" && format != "tar.gz" {
+		http.Error(w, "invalid extract parameter, must be true, zip, tar or tar.gz", http.StatusBadRequest)
+		return
+	}
+	replace := r.URL.Query().Get("replace") == "true"
+	if cleaned == "" {
+		if replace {
+			http.Error(w, "the root directory can't be replaced", http.StatusBadRequest)
+			return
+		}
+		cleaned = "."
+	}
+	if fi, err := h.stat(cleaned); err != nil || (fi != nil && !fi.IsDir()) {
+		http.Error(w, "the target of an extract must be a directory", http.StatusConflict)
+		return
+	}
+
+	reader, err := h.getReader(r)
+	if err != nil {
+		h.logger(r).Error("Failed to get file reader", slog.Any("error", err))
+		http.Error(w, "failed to read file content", http.StatusBadRequest)
+		return
+	}
+
+	e := &extractor{
+		h:        h,
+		target:   cleaned,
+		dir:      path.Join(stagingDir, "extract", rand.Text()),
+		maxSize:  h.ExtractMaxSize,
+		maxFiles: h.ExtractMaxFiles,
+	}
+	defer func() {
+		if err := h.rootedFileSystem.RemoveAll(e.dir); err != nil {
+			h.logger(r).Warn("Failed to remove extracted files", slog.String("path", e.dir), slog.Any("error", err))
+		}
+	}()
+	if err = h.rootedFileSystem.MkdirAll(e.dir, 0755); err == nil {
+		err = e.extract(reader, format)
+	}
+	// Every extracted file needs to be writable, and replacing the directory deletes everything
+	// within it.
+	if err == nil && (!h.isAuthorizedTree(r, e.dir, cleaned, PermissionWrite) || (replace && !h.isAuthorizedTree(r, cleaned, cleaned, PermissionDelete))) {
+		deny(w, r)
+		return
+	}
+	if err == nil && replace {
+		err = e.replace()
+	} else if err == nil {
+		err = e.merge()
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidArchive):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, errArchiveTooLarge):
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		case errors.Is(err, errExtractConflict):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			h.logger(r).Error("Failed to extract archive", slog.String("path", cleaned), slog.Any("error", err))
+			http.Error(w, "failed to extract archive", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+type extractor struct {
+	h *FileHandler
+	// target is the directory the archive is being extracted to.
+	target string
+	// dir is the staging directory the archive is extracted into.
+	dir string
+	// compressed counts the bytes of the uploaded archive.
+	compressed int64
+	// size is the number of bytes extracted so far.
+	size     int64
+	files    int64
+	maxSize  int64
+	maxFiles int64
+}
+
+// extract unpacks the archive into the staging directory. If format is "true", the format is
+// detected from the content.
+func (e *extractor) extract(r io.Reader, format string) error {
+	br := bufio.NewReader(&countingReader{r: r, n: &e.compressed})
+	if format == "true" {
+		magic, _ := br.Peek(4)
+		switch {
+		case bytes.HasPrefix(magic, []byte("PK\x03\x04")) || bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+			format = "zip"
+		case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+			format = "tar.gz"
+		default:
+			format = "tar"
+		}
+	}
+	switch format {
+	case "zip":
+		return e.extractZip(br)
+	case "tar.gz":
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidArchive, err)
+		}
+		return e.extractTar(gr)
+	default:
+		return e.extractTar(br)
+	}
+}
+
+func (e *extractor) extractTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidArchive, err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = e.addDir(hdr.Name)
+		case tar.TypeReg:
+			err = e.addFile(hdr.Name, tr, hdr.ModTime)
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			// Symlinks and hard links could point outside the target, and devices have no place
+			// in a file server.
+			err = fmt.Errorf("%w: %q is not a regular file or directory", errInvalidArchive, hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// extractZip spools the archive to the staging area, because the zip directory is at the end of
+// the file.
+func (e *extractor) extractZip(r io.Reader) (err error) {
+	f, name, err := e.h.createTemp()
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = e.h.rootedFileSystem.Remove(name)
+	}()
+	if e.maxSize > 0 {
+		r = io.LimitReader(r, e.maxSize+1)
+	}
+	size, err := f.ReadFrom(r)
+	if err != nil {
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if e.maxSize > 0 && size > e.maxSize {
+		return fmt.Errorf("%w: the maximum size is %d bytes", errArchiveTooLarge, e.maxSize)
+	}
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidArchive, err)
+	}
+	if e.maxFiles > 0 && int64(len(zr.File)) > e.maxFiles {
+		return fmt.Errorf("%w: the maximum number of files is %d", errArchiveTooLarge, e.maxFiles)
+	}
+	for _, zf := range zr.File {
+		mode := zf.Mode()
+		switch {
+		case mode.IsDir():
+			err = e.addDir(zf.Name)
+		case mode.IsRegular():
+			err = e.addZipFile(zf)
+		default:
+			err = fmt.Errorf("%w: %q is not a regular file or directory", errInvalidArchive, zf.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *extractor) addZipFile(zf *zip.File) error {
+	rc, err := zf.Open()
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidArchive, err)
+	}
+	defer rc.Close()
+	return e.addFile(zf.Name, rc, zf.Modified)
+}
+
+// entryName validates the name of an archive entry, returning an empty name for the entry of
+// the target directory itself.
+func (e *extractor) entryName(name string) (string, error) {
+	cleaned := strings.TrimSuffix(strings.TrimPrefix(name, "./"), "/")
+	if cleaned == "" || cleaned == "." {
+		return "", nil
+	}
+	if !fs.ValidPath(cleaned) || strings.Contains(cleaned, `\`) || isStagingPath(path.Join(e.target, cleaned)) {
+		return "", fmt.Errorf("%w: %q is outside the target directory", errInvalidArchive, name)
+	}
+	return cleaned, nil
+}
+
+// isHidden returns true if the entry would be hidden once it's extracted, so it's skipped.
+func (e *extractor) isHidden(name string) bool {
+	return e.h.isHidden(path.Join(e.target, name))
+}
+
+func (e *extractor) addDir(name string) error {
+	name, err := e.entryName(name)
+	if err != nil || name == "" || e.isHidden(name) {
+		return err
+	}
+	return e.h.rootedFileSystem.MkdirAll(path.Join(e.dir, name), 0755)
+}
+
+func (e *extractor) addFile(name string, r io.Reader, modTime time.Time) (err error) {
+	name, err = e.entryName(name)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return fmt.Errorf("%w: file entry without a name", errInvalidArchive)
+	}
+	if e.isHidden(name) {
+		return nil
+	}
+	e.files++
+	if e.maxFiles > 0 && e.files > e.maxFiles {
+		return fmt.Errorf("%w: the maximum number of files is %d", errArchiveTooLarge, e.maxFiles)
+	}
+	name = path.Join(e.dir, name)
+	if err = e.h.rootedFileSystem.MkdirAll(path.Dir(name), 0755); err != nil {
+		return fmt.Errorf("%w: %v", errExtractConflict, err)
+	}
+	// Permissions from the archive are ignored, so that setuid bits etc. aren't extracted.
+	f, err := e.h.rootedFileSystem.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errExtractConflict, err)
+	}
+	if _, err = io.Copy(&extractWriter{w: f, e: e}, r); err != nil {
+		_ = f.Close()
+		if errors.Is(err, errArchiveTooLarge) {
+			return err
+		}
+		return fmt.Errorf("%w: %v", errInvalidArchive, err)
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if !modTime.IsZero() {
+		_ = e.h.rootedFileSystem.Chtimes(name, modTime, modTime)
+	}
+	return nil
+}
+
+// merge moves the extracted files into the target directory, replacing existing files. Every
+// file is checked for conflicts before the first is moved, so that a conflict doesn't leave some
+// of the files moved into place.
+func (e *extractor) merge() error {
+	if err := e.h.rootedFileSystem.MkdirAll(e.target, 0755); err != nil {
+		return fmt.Errorf("%w: failed to create directory %q: %v", errExtractConflict, e.target, err)
+	}
+	err := e.walk(func(name, target string, isDir bool) error {
+		return e.checkConflict(target, isDir)
+	})
+	if err != nil {
+		return err
+	}
+	// The targets are checked again as they're moved, in case they changed since.
+	return e.walk(func(name, target string, isDir bool) error {
+		if isDir {
+			if err := e.checkConflict(target, true); err != nil {
+				return err
+			}
+			if err := e.h.rootedFileSystem.MkdirAll(target, 0755); err != nil {
+				return fmt.Errorf("%w: failed to create directory %q: %v", errExtractConflict, target, err)
+			}
+			return nil
+		}
+		e.h.commitMu.Lock()
+		defer e.h.commitMu.Unlock()
+		if err := e.checkConflict(target, false); err != nil {
+			return err
+		}
+		return e.h.rootedFileSystem.Rename(name, target)
+	})
+}
+
+// walk calls fn for each extracted file and directory, with the path it has in the target
+// directory.
+func (e *extractor) walk(fn func(name, target string, isDir bool) error) error {
+	return fs.WalkDir(e.h.rootedFileSystem.FS(), e.dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == e.dir {
+			return nil
+		}
+		return fn(name, path.Join(e.target, strings.TrimPrefix(name, e.dir+"/")), d.IsDir())
+	})
+}
+
+// checkConflict returns an error if an extracted file or directory can't be moved to target,
+// because it's a symlink that isn't allowed, or a directory that would replace a file or a file
+// that would replace a directory.
+func (e *extractor) checkConflict(target string, isDir bool) error {
+	if err := e.h.checkSymlinks(target); err != nil {
+		return fmt.Errorf("%w: %q: %v", errExtractConflict, target, err)
+	}
+	current, err := e.h.stat(target)
+	if err != nil {
+		return fmt.Errorf("%w: %q: %v", errExtractConflict, target, err)
+	}
+	if current != nil && current.IsDir() != isDir {
+		if isDir {
+			return fmt.Errorf("%w: %q is a file", errExtractConflict, target)
+		}
+		return fmt.Errorf("%w: %q is a directory", errExtractConflict, target)
+	}
+	return nil
+}
+
+// replace swaps the target directory for the extracted directory. os.Root can't exchange two
+// directories in one operation, so the target briefly doesn't exist between the two renames, but
+// it's never seen partially extracted.
+func (e *extractor) replace() error {
+	if err := e.h.rootedFileSystem.MkdirAll(path.Dir(e.target), 0755); err != nil {
+		return fmt.Errorf("%w: %v", errExtractConflict, err)
+	}
+	old := e.dir + ".old"
+	e.h.commitMu.Lock()
+	err := e.h.rootedFileSystem.Rename(e.target, old)
+	exists := err == nil
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		e.h.commitMu.Unlock()
+		return fmt.Errorf("failed to move directory aside: %w", err)
+	}
+	if err = e.h.rootedFileSystem.Rename(e.dir, e.target); err != nil && exists {
+		_ = e.h.rootedFileSystem.Rename(old, e.target)
+	}
+	e.h.commitMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to move extracted directory into place: %w", err)
+	}
+	if exists {
+		return e.h.rootedFileSystem.RemoveAll(old)
+	}
+	return nil
+}
+
+// extractWriter enforces the size and compression ratio limits as files are extracted, so that
+// the limits can't be bypassed by archive headers that lie about their sizes.
+type extractWriter struct {
+	w io.Writer
+	e *extractor
+}
+
+func (ew *extractWriter) Write(p []byte) (n int, err error) {
+	e := ew.e
+	e.size += int64(len(p))
+	if e.maxSize > 0 && e.size > e.maxSize {
+		return 0, fmt.Errorf("%w: the maximum size is %d bytes", errArchiveTooLarge, e.maxSize)
+	}
+	if e.size > minCompressionRatioSize && e.size > e.compressed*maxCompressionRatio {
+		return 0, fmt.Errorf("%w: the compression ratio is over %d", errArchiveTooLarge, maxCompressionRatio)
+	}
+	return ew.w.Write(p)
+}
+
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err error) {
+	n, err = cr.r.Read(p)
+	*cr.n += int64(n)
+	return n, err
+}
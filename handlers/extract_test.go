@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testArchiveEntry struct {
+	name     string
+	content  string
+	typeflag byte
+}
+
+func TestExtract(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "site"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	for name, content := range map[string]string{
+		"site/old.html":  "old",
+		"site/keep.html": "keep",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+	log := slog.New(slog.DiscardHandler)
+	fh, closer, err := NewFileHandler(log, dir, false)
+	if err != nil {
+		t.Fatalf("Failed to create FileHandler: %v", err)
+	}
+	defer closer()
+
+	t.Run("tar.gz archives are merged into the directory", func(t *testing.T) {
+		body := testTarGz(t, []testArchiveEntry{
+			{name: "./", typeflag: tar.TypeDir},
+			{name: "./index.html", content: "index"},
+			{name: "./old.html", content: "new"},
+			{name: "./css/site.css", content: "css"},
+		})
+		testExtract(t, fh, "/site?extract=true", body, http.StatusCreated)
+		testFileContent(t, dir, "site/index.html", "index")
+		testFileContent(t, dir, "site/old.html", "new")
+		testFileContent(t, dir, "site/css/site.css", "css")
+		testFileContent(t, dir, "site/keep.html", "keep")
+	})
+	t.Run("zip archives can replace the directory", func(t *testing.T) {
+		body := testZip(t, map[string]string{"index.html": "replaced", "img/logo.svg": "svg"})
+		testExtract(t, fh, "/site?extract=zip&replace=true", body, http.StatusCreated)
+		testFileContent(t, dir, "site/index.html", "replaced")
+		testFileContent(t, dir, "site/img/logo.svg", "svg")
+		if _, err := os.Stat(filepath.Join(dir, "site", "keep.html")); !os.IsNotExist(err) {
+			t.Errorf("Expected keep.html to be removed, got %v", err)
+		}
+	})
+	t.Run("Archives can be extracted to new directories", func(t *testing.T) {
+		body := testTarGz(t, []testArchiveEntry{{name: "a.txt", content: "a"}})
+		testExtract(t, fh, "/new/dir?extract=tar.gz&replace=true", body, http.StatusCreated)
+		testFileContent(t, dir, "new/dir/a.txt", "a")
+	})
+	t.Run("Archives are extracted to targets with .. in their name", func(t *testing.T) {
+		body := testTarGz(t, []testArchiveEntry{{name: "a..b.txt", content: "v1..2"}})
+		testExtract(t, fh, "/releases/v1..2?extract=true", body, http.StatusCreated)
+		testFileContent(t, dir, "releases/v1..2/a..b.txt", "v1..2")
+		if _, err := os.Stat(filepath.Join(dir, "a..b.txt")); !os.IsNotExist(err) {
+			t.Errorf("Expected nothing to be extracted to the root, got %v", err)
+		}
+	})
+	t.Run("Entries outside the target are rejected", func(t *testing.T) {
+		for _, name := range []string{"../escape.txt", "/abs.txt", "a/../../escape.txt", stagingDir + "/tmp/x"} {
+			body := testTarGz(t, []testArchiveEntry{{name: "ok.txt", content: "ok"}, {name: name, content: "bad"}})
+			testExtract(t, fh, "/?extract=true", body, http.StatusBadRequest)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "ok.txt")); !os.IsNotExist(err) {
+			t.Errorf("Expected nothing to be extracted from an invalid archive, got %v", err)
+		}
+	})
+	t.Run("Symlinks and hard links are rejected", func(t *testing.T) {
+		for _, typeflag := range []byte{tar.TypeSymlink, tar.TypeLink, tar.TypeChar} {
+			body := testTarGz(t, []testArchiveEntry{{name: "link", content: "/etc/passwd", typeflag: typeflag}})
+			testExtract(t, fh, "/site?extract=tar.gz", body, http.StatusBadRequest)
+		}
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		hdr := &zip.FileHeader{Name: "link"}
+		hdr.SetMode(os.ModeSymlink | 0777)
+		fw, _ := zw.CreateHeader(hdr)
+		fw.Write([]byte("/etc/passwd"))
+		zw.Close()
+		testExtract(t, fh, "/site?extract=zip", buf.Bytes(), http.StatusBadRequest)
+	})
+	t.Run("Zip bombs are rejected", func(t *testing.T) {
+		body := testZip(t, map[string]string{"zeros": string(make([]byte, 10<<20))})
+		testExtract(t, fh, "/bomb?extract=true", body, http.StatusRequestEntityTooLarge)
+		if _, err := os.Stat(filepath.Join(dir, "bomb")); !os.IsNotExist(err) {
+			t.Errorf("Expected nothing to be extracted, got %v", err)
+		}
+	})
+	t.Run("Archives over the limits are rejected", func(t *testing.T) {
+		fh.ExtractMaxFiles = 1
+		defer func() { fh.ExtractMaxFiles = 0 }()
+		body := testTarGz(t, []testArchiveEntry{{name: "a.txt", content: "a"}, {name: "b.txt", content: "b"}})
+		testExtract(t, fh, "/limits?extract=true", body, http.StatusRequestEntityTooLarge)
+	})
+	t.Run("The root can't be replaced", func(t *testing.T) {
+		body := testTarGz(t, []testArchiveEntry{{name: "a.txt", content: "a"}})
+		testExtract(t, fh, "/?extract=true&replace=true", body, http.StatusBadRequest)
+	})
+	t.Run("Files can't be extracted to", func(t *testing.T) {
+		body := testTarGz(t, []testArchiveEntry{{name: "a.txt", content: "a"}})
+		testExtract(t, fh, "/site/index.html?extract=true", body, http.StatusConflict)
+	})
+	t.Run("Conflicts are found before any file is moved", func(t *testing.T) {
+		if err := os.MkdirAll(filepath.Join(dir, "conflict", "b"), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		body := testTarGz(t, []testArchiveEntry{{name: "a.txt", content: "a"}, {name: "b", content: "b"}})
+		testExtract(t, fh, "/conflict?extract=true", body, http.StatusConflict)
+		if _, err := os.Stat(filepath.Join(dir, "conflict", "a.txt")); !os.IsNotExist(err) {
+			t.Errorf("Expected nothing to be extracted, got %v", err)
+		}
+	})
+	t.Run("Dotfiles are skipped with HideDotfiles", func(t *testing.T) {
+		fh.HideDotfiles = true
+		defer func() { fh.HideDotfiles = false }()
+		body := testTarGz(t, []testArchiveEntry{
+			{name: ".git/", typeflag: tar.TypeDir},
+			{name: ".git/config", content: "config"},
+			{name: ".env", content: "secret"},
+			{name: "a.txt", content: "a"},
+		})
+		testExtract(t, fh, "/dotfiles?extract=true", body, http.StatusCreated)
+		testFileContent(t, dir, "dotfiles/a.txt", "a")
+		for _, name := range []string{".git", ".env"} {
+			if _, err := os.Stat(filepath.Join(dir, "dotfiles", name)); !os.IsNotExist(err) {
+				t.Errorf("Expected %s not to be extracted, got %v", name, err)
+			}
+		}
+	})
+	t.Run("Read-only handlers reject extracts", func(t *testing.T) {
+		fh.IsReadOnly = true
+		defer func() { fh.IsReadOnly = false }()
+		body := testTarGz(t, []testArchiveEntry{{name: "a.txt", content: "a"}})
+		testExtract(t, fh, "/site?extract=true", body, http.StatusMethodNotAllowed)
+	})
+}
+
+func testExtract(t *testing.T, fh *FileHandler, target string, body []byte, expectedStatus int) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	fh.ServeHTTP(w, httptest.NewRequest(http.MethodPut, target, bytes.NewReader(body)))
+	if w.Code != expectedStatus {
+		t.Fatalf("Expected status %d, got %d: %s", expectedStatus, w.Code, w.Body.String())
+	}
+}
+
+func testFileContent(t *testing.T, dir, name, expected string) {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", name, err)
+	}
+	if string(content) != expected {
+		t.Errorf("Expected %s to contain %q, got %q", name, expected, content)
+	}
+}
+
+func testTarGz(t *testing.T, entries []testArchiveEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: e.typeflag}
+		switch e.typeflag {
+		case 0:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(e.content))
+		case tar.TypeSymlink, tar.TypeLink:
+			hdr.Linkname = e.content
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Failed to write tar header: %v", err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte(e.content))
+		}
+	}
+	tw.Close()
+	gw.Close()
+	return buf.Bytes()
+}
+
+func testZip(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("Failed to create zip entry: %v", err)
+		}
+		fw.Write([]byte(content))
+	}
+	zw.Close()
+	return buf.Bytes()
+}
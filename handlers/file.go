@@ -1,25 +1,40 @@
 package handlers
 
 import (
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
+	"io/fs"
 	"log/slog"
 	"net/http"
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
 )
 
+// stagingDir is the directory, relative to the served directory, used to hold incomplete uploads.
+// It is never served, and can't be written to directly.
+const stagingDir = ".serve"
+
 func NewFileHandler(log *slog.Logger, dir string, readOnly bool) (fh *FileHandler, closer func() error, err error) {
 	fh = &FileHandler{
 		Log:        log,
 		IsReadOnly: readOnly,
-		fileServer: http.FileServer(http.Dir(dir)),
+		Authorizer: AllowAll,
+		dir:        dir,
 	}
 	fh.rootedFileSystem, err = os.OpenRoot(dir)
 	if err != nil {
 		return fh, nil, fmt.Errorf("failed to open root directory: %w", err)
 	}
+	fh.locks = webdav.NewMemLS()
+	fh.webdav = newWebDAVHandler(fh)
 	closer = func() error {
 		return fh.rootedFileSystem.Close()
 	}
@@ -27,13 +42,64 @@ func NewFileHandler(log *slog.Logger, dir string, readOnly bool) (fh *FileHandle
 }
 
 type FileHandler struct {
-	Log              *slog.Logger
-	IsReadOnly       bool
-	fileServer       http.Handler
+	Log *slog.Logger
+	// IsReadOnly denies writes and deletes, whatever the Authorizer allows.
+	IsReadOnly bool
+	// Authorizer decides which users can read, write and delete each path.
+	Authorizer Authorizer
+	// TusEnabled serves the tus resumable upload protocol from TusPath.
+	TusEnabled bool
+	// TusMaxSize is the maximum size of a tus upload, or zero for no limit.
+	TusMaxSize int64
+	// TusExpiry is how long an incomplete tus or S3 multipart upload is kept without receiving
+	// data, or zero to keep it forever.
+	TusExpiry time.Duration
+	// WebDAV enables the WebDAV methods (PROPFIND, MKCOL, COPY, MOVE etc.) in addition to GET, PUT and DELETE.
+	WebDAV bool
+	// IndexTemplate renders directory listings, DefaultIndexTemplate is used if nil.
+	IndexTemplate *template.Template
+	// HideDotfiles hides files and directories whose names start with a dot from downloads,
+	// listings, archives and WebDAV, and skips them when archives are extracted.
+	HideDotfiles bool
+	// ArchiveMaxSize is the maximum total size of the files in a directory archive, or zero for no limit.
+	ArchiveMaxSize int64
+	// ArchiveMaxFiles is the maximum number of files in a directory archive, or zero for no limit.
+	ArchiveMaxFiles int64
+	// ExtractMaxSize is the maximum total size of the files extracted from an uploaded archive, or zero for no limit.
+	ExtractMaxSize int64
+	// ExtractMaxFiles is the maximum number of files extracted from an uploaded archive, or zero for no limit.
+	ExtractMaxFiles int64
+	// Symlinks is the policy for symlinks within the directory, SymlinksWithinRoot is used if empty.
+	Symlinks SymlinkPolicy
+	// ShareLinks enables the share link endpoint at ShareLinksPath, if set.
+	ShareLinks *ShareLinks
+	// AuditLog records uploads and deletes, if set.
+	AuditLog *AuditLog
+
+	webdav http.Handler
+	// locks are the WebDAV locks, which are also checked for PUT, POST and DELETE.
+	locks    webdav.LockSystem
+	tusLocks sync.Map
+	// commitMu is held while checking preconditions and replacing or deleting a file.
+	commitMu         sync.Mutex
+	dir              string
 	rootedFileSystem *os.Root
 }
 
 func (h *FileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.ShareLinks != nil && strings.HasPrefix(r.URL.Path, ShareLinksPath) {
+		h.ServeShareLinks(w, r)
+		return
+	}
+	w, r, record, ok := h.startAudit(w, r, h.cleanPath(r.URL.Path))
+	if !ok {
+		return
+	}
+	defer record()
+	if h.TusEnabled && strings.HasPrefix(r.URL.Path, TusPath) {
+		h.ServeTus(w, r)
+		return
+	}
 	switch r.Method {
 	case http.MethodGet, http.MethodHead:
 		h.Get(w, r)
@@ -42,71 +108,292 @@ func (h *FileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case http.MethodDelete:
 		h.Delete(w, r)
 	default:
+		if h.WebDAV {
+			h.ServeWebDAV(w, r)
+			return
+		}
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
+// logger returns the logger of the request, which includes its ID, see LoggerFromContext.
+func (h *FileHandler) logger(r *http.Request) *slog.Logger {
+	return LoggerFromContext(r.Context(), h.Log)
+}
+
 func (h *FileHandler) Get(w http.ResponseWriter, r *http.Request) {
-	h.fileServer.ServeHTTP(w, r)
+	cleaned := h.cleanPath(r.URL.Path)
+	if h.isHidden(cleaned) {
+		http.NotFound(w, r)
+		return
+	}
+	if !h.authorize(w, r, cleaned, PermissionRead) {
+		return
+	}
+	// Serve the cleaned path that was authorized, rather than the path of the request.
+	r = withPath(r, cleaned)
+	// Setting the ETag allows the file server to handle If-Match, If-None-Match and If-Range.
+	if cleaned == "" {
+		cleaned = "."
+	}
+	fsys := h.readFS()
+	fi, err := fs.Stat(fsys, cleaned)
+	if err == nil && fi.Mode().IsRegular() {
+		w.Header().Set("ETag", etag(fi))
+	}
+	if err == nil && fi.IsDir() {
+		w.Header().Add("Vary", "Accept")
+		if format := r.URL.Query().Get("archive"); format != "" {
+			h.ServeArchive(w, r, cleaned, format)
+			return
+		}
+		if wantsJSON(r) {
+			h.ListJSON(w, r, cleaned)
+			return
+		}
+		if !h.hasIndexFile(r, cleaned) {
+			if !strings.HasSuffix(r.URL.Path, "/") {
+				u := *r.URL
+				u.Path += "/"
+				http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+				return
+			}
+			h.ListHTML(w, r, cleaned)
+			return
+		}
+	}
+	// The file server redirects paths of files that end in / or /index.html.
+	if err == nil && fi.Mode().IsRegular() && !strings.HasSuffix(r.URL.Path, "/") && !strings.HasSuffix(r.URL.Path, "/index.html") {
+		if h.serveContent(w, r, fsys, cleaned, fi) {
+			return
+		}
+	}
+	http.FileServerFS(fsys).ServeHTTP(w, r)
+}
+
+// withPath returns a copy of the request for the cleaned path, which keeps any trailing slash of
+// the request path, since the file server redirects based on it.
+func withPath(r *http.Request, cleaned string) *http.Request {
+	u := *r.URL
+	u.Path, u.RawPath = "/"+cleaned, ""
+	if cleaned != "" && strings.HasSuffix(r.URL.Path, "/") {
+		u.Path += "/"
+	}
+	r2 := *r
+	r2.URL = &u
+	return &r2
+}
+
+// serveContent serves a regular file with http.ServeContent, which, unlike http.FileServerFS,
+// passes the *os.File to the ResponseWriter, so that it can be sent with the sendfile system
+// call. It returns false if the file can't be served that way.
+func (h *FileHandler) serveContent(w http.ResponseWriter, r *http.Request, fsys fs.FS, name string, fi fs.FileInfo) bool {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		return false
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), content)
+	return true
 }
 
+// cleanPath returns the path relative to the served directory, or empty for the directory itself.
+// The path is cleaned as an absolute path, which removes any ".." segments, so that the result
+// can't be outside of the directory, while names that contain "..", e.g. "a..b.txt", are kept.
 func (h *FileHandler) cleanPath(p string) string {
-	cleaned := path.Clean(p)
-	if cleaned == "." || strings.Contains(cleaned, "..") {
-		cleaned = ""
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+func isStagingPath(cleaned string) bool {
+	return cleaned == stagingDir || strings.HasPrefix(cleaned, stagingDir+"/")
+}
+
+// isHidden returns true if the path is in the staging directory, or is a dotfile (or within a
+// dot directory) and dotfiles are hidden.
+func (h *FileHandler) isHidden(cleaned string) bool {
+	if isStagingPath(cleaned) {
+		return true
+	}
+	if !h.HideDotfiles {
+		return false
+	}
+	for segment := range strings.SplitSeq(cleaned, "/") {
+		if strings.HasPrefix(segment, ".") && segment != "." {
+			return true
+		}
 	}
-	return strings.TrimPrefix(cleaned, "/")
+	return false
 }
 
 func (h *FileHandler) Put(w http.ResponseWriter, r *http.Request) {
-	if h.IsReadOnly {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	cleaned := h.cleanPath(r.URL.Path)
+	w, r, record, ok := h.startAudit(w, r, cleaned)
+	if !ok {
 		return
 	}
-	cleaned := h.cleanPath(r.URL.Path)
-	if cleaned == "" {
+	defer record()
+	if isStagingPath(cleaned) {
 		http.Error(w, "Invalid file path", http.StatusBadRequest)
 		return
 	}
+	perm := PermissionWrite
+	if r.URL.Query().Get("replace") == "true" {
+		// Replacing a directory deletes the files that aren't in the archive.
+		perm |= PermissionDelete
+	}
+	if !h.authorize(w, r, cleaned, perm) {
+		return
+	}
 	if r.Body == nil {
 		http.Error(w, "No file content provided", http.StatusBadRequest)
 		return
 	}
 	defer r.Body.Close()
+	if err := h.checkSymlinks(cleaned); err != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	release, ok := h.confirmLocks(w, r, cleaned)
+	if !ok {
+		return
+	}
+	defer release()
+	if r.URL.Query().Has("extract") {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{auditBody(r, r.Body), r.Body}
+		h.Extract(w, r, cleaned)
+		return
+	}
+	if cleaned == "" {
+		http.Error(w, "Invalid file path", http.StatusBadRequest)
+		return
+	}
 
-	// Create the file.
-	err := h.rootedFileSystem.MkdirAll(path.Dir(cleaned), 0755)
+	// Fail fast, before reading the body, if the preconditions can't be met.
+	current, err := h.stat(cleaned)
 	if err != nil {
-		h.Log.Error("Failed to create directories for file", slog.String("path", cleaned), slog.Any("error", err))
-		http.Error(w, "failed to create file", http.StatusInternalServerError)
+		h.logger(r).Error("Failed to stat file", slog.String("path", cleaned), slog.Any("error", err))
+		http.Error(w, "failed to write file", http.StatusInternalServerError)
 		return
 	}
-	f, err := h.rootedFileSystem.Create(cleaned)
-	if err != nil {
-		h.Log.Error("Failed to create file", slog.String("path", cleaned), slog.Any("error", err))
-		http.Error(w, "failed to create file", http.StatusInternalServerError)
+	if !preconditionsMet(r, current) {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
 		return
 	}
-	defer f.Close()
 
 	// Read the file content from the request body.
 	reader, err := h.getReader(r)
 	if err != nil {
-		h.Log.Error("Failed to get file reader", slog.Any("error", err))
+		h.logger(r).Error("Failed to get file reader", slog.Any("error", err))
 		http.Error(w, "failed to read file content", http.StatusBadRequest)
 		return
 	}
+	reader = auditBody(r, reader)
 
-	_, err = f.ReadFrom(reader)
-	if err != nil {
-		h.Log.Error("Failed to write file content", slog.String("path", cleaned), slog.Any("error", err))
+	precondition := func(current fs.FileInfo) bool {
+		return preconditionsMet(r, current)
+	}
+	if _, err = h.writeFileIf(cleaned, reader, precondition); err != nil {
+		if errors.Is(err, errPreconditionFailed) {
+			http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+			return
+		}
+		h.logger(r).Error("Failed to write file content", slog.String("path", cleaned), slog.Any("error", err))
 		http.Error(w, "failed to write file", http.StatusInternalServerError)
 		return
 	}
 
+	if fi, err := h.rootedFileSystem.Stat(cleaned); err == nil {
+		w.Header().Set("ETag", etag(fi))
+	}
 	w.WriteHeader(http.StatusCreated)
 }
 
+// writeFile streams r into a temporary file in the staging area, and only renames it over name
+// once the whole of r has been read, so that readers never see a partially written file, and a
+// failed upload leaves any existing file intact.
+func (h *FileHandler) writeFile(name string, r io.Reader) (n int64, err error) {
+	return h.writeFileIf(name, r, nil)
+}
+
+// writeFileIf is writeFile, but only replaces the file if precondition returns true for the
+// current state of the file (nil if it doesn't exist) immediately before it's replaced. If not,
+// errPreconditionFailed is returned.
+func (h *FileHandler) writeFileIf(name string, r io.Reader, precondition func(current fs.FileInfo) bool) (n int64, err error) {
+	tmp, tmpName, err := h.createTemp()
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = h.rootedFileSystem.Remove(tmpName)
+		}
+	}()
+	n, err = tmp.ReadFrom(r)
+	if err != nil {
+		_ = tmp.Close()
+		return n, fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return n, fmt.Errorf("failed to close temporary file: %w", err)
+	}
+	return n, h.commit(tmpName, name, precondition)
+}
+
+// commit renames the complete file tmpName, in the staging area, over name, if precondition is
+// nil or returns true for the current state of the file immediately before it's replaced. If not,
+// errPreconditionFailed is returned.
+func (h *FileHandler) commit(tmpName, name string, precondition func(current fs.FileInfo) bool) error {
+	if err := h.rootedFileSystem.MkdirAll(path.Dir(name), 0755); err != nil {
+		return fmt.Errorf("failed to create directories for file: %w", err)
+	}
+	h.commitMu.Lock()
+	defer h.commitMu.Unlock()
+	if precondition != nil {
+		current, err := h.stat(name)
+		if err != nil {
+			return fmt.Errorf("failed to stat file: %w", err)
+		}
+		if !precondition(current) {
+			return errPreconditionFailed
+		}
+	}
+	if err := h.rootedFileSystem.Rename(tmpName, name); err != nil {
+		return fmt.Errorf("failed to move temporary file into place: %w", err)
+	}
+	return nil
+}
+
+// createTemp creates a new, empty file in the staging area.
+func (h *FileHandler) createTemp() (f *os.File, name string, err error) {
+	dir := path.Join(stagingDir, "tmp")
+	if err = h.rootedFileSystem.MkdirAll(dir, 0755); err != nil {
+		return nil, "", err
+	}
+	name = path.Join(dir, rand.Text())
+	f, err = h.rootedFileSystem.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	return f, name, err
+}
+
+// etag returns an entity tag for the file, based on its modification time, size, inode and change
+// time. Uploads replace files rather than writing to them, so the inode changes with every upload,
+// and unlike the modification time, the change time can't be set back, so the tag is strong. On
+// platforms without inodes, the tag is weak, so it never matches If-Match, which needs a strong
+// comparison, and writes can't overwrite a version that only looks the same.
+func etag(fi fs.FileInfo) string {
+	ino, ctime, ok := fileIdentity(fi)
+	if !ok {
+		return fmt.Sprintf(`W/"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+	}
+	return fmt.Sprintf(`"%x-%x-%x-%x"`, fi.ModTime().UnixNano(), fi.Size(), ino, ctime)
+}
+
 func (h *FileHandler) getReader(r *http.Request) (io.Reader, error) {
 	isMultipart := strings.Contains(r.Header.Get("Content-Type"), "multipart/form-data")
 	if !isMultipart {
@@ -133,14 +420,48 @@ loop:
 }
 
 func (h *FileHandler) Delete(w http.ResponseWriter, r *http.Request) {
-	if h.IsReadOnly {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	cleaned := h.cleanPath(r.URL.Path)
+	w, r, record, ok := h.startAudit(w, r, cleaned)
+	if !ok {
 		return
 	}
-	cleaned := h.cleanPath(r.URL.Path)
-	err := h.rootedFileSystem.Remove(cleaned)
+	defer record()
+	if cleaned == "" || isStagingPath(cleaned) {
+		http.Error(w, "Invalid file path", http.StatusBadRequest)
+		return
+	}
+	authorize, remove := h.authorize, h.rootedFileSystem.Remove
+	if h.WebDAV {
+		// WebDAV clients expect collections to be deleted along with their contents.
+		authorize, remove = h.authorizeTree, h.rootedFileSystem.RemoveAll
+	}
+	if !authorize(w, r, cleaned, PermissionDelete) {
+		return
+	}
+	if err := h.checkSymlinks(cleaned); err != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	release, ok := h.confirmLocks(w, r, cleaned)
+	if !ok {
+		return
+	}
+	defer release()
+	h.commitMu.Lock()
+	defer h.commitMu.Unlock()
+	current, err := h.stat(cleaned)
+	if err != nil {
+		h.logger(r).Error("Failed to stat file", slog.String("path", cleaned), slog.Any("error", err))
+		http.Error(w, "failed to delete file", http.StatusInternalServerError)
+		return
+	}
+	if !preconditionsMet(r, current) {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	}
+	err = remove(cleaned)
 	if err != nil {
-		h.Log.Error("Failed to delete file", slog.String("path", cleaned), slog.Any("error", err))
+		h.logger(r).Error("Failed to delete file", slog.String("path", cleaned), slog.Any("error", err))
 		http.Error(w, "failed to delete file", http.StatusInternalServerError)
 		return
 	}
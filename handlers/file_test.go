@@ -81,6 +81,138 @@ func TestFileHandler(t *testing.T) {
 		testMultipartUpload(t, fh, "/multipart.txt", "Multipart content", http.StatusCreated)
 		testGet(t, fh, "/multipart.txt", http.StatusOK, "Multipart content")
 	})
+	t.Run("Failed uploads leave existing files intact", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPut, "/newfile.txt", strings.NewReader("--boundary--"))
+		req.Header.Set("Content-Type", "multipart/form-data; boundary=boundary")
+		w := httptest.NewRecorder()
+		fh.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+		}
+		testGet(t, fh, "/newfile.txt", http.StatusOK, "New content")
+	})
+	t.Run("Uploads leave no temporary files behind", func(t *testing.T) {
+		testWrite(t, fh, http.MethodPut, "/newfile.txt", "Replaced content", http.StatusCreated)
+		testGet(t, fh, "/newfile.txt", http.StatusOK, "Replaced content")
+		entries, err := os.ReadDir(filepath.Join(dir, stagingDir, "tmp"))
+		if err != nil {
+			t.Fatalf("Failed to read staging directory: %v", err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("Expected no temporary files, got %d", len(entries))
+		}
+	})
+	t.Run("Staging directory is not served or writable", func(t *testing.T) {
+		testGet(t, fh, "/"+stagingDir+"/tmp/", http.StatusNotFound, "404 page not found\n")
+		testWrite(t, fh, http.MethodPut, "/"+stagingDir+"/tmp/file.txt", "content", http.StatusBadRequest)
+	})
+}
+
+func TestFileHandlerConditionalWrites(t *testing.T) {
+	dir := t.TempDir()
+	log := slog.New(slog.DiscardHandler)
+	fh, closer, err := NewFileHandler(log, dir, false)
+	if err != nil {
+		t.Fatalf("Failed to create FileHandler: %v", err)
+	}
+	defer closer()
+
+	t.Run("If-None-Match: * creates new files", func(t *testing.T) {
+		w := testConditionalWrite(t, fh, http.MethodPut, "/file.txt", "v1", "If-None-Match", "*")
+		if w.Code != http.StatusCreated {
+			t.Errorf("Expected status %d, got %d", http.StatusCreated, w.Code)
+		}
+		if w.Header().Get("ETag") == "" {
+			t.Error("Expected an ETag in the response")
+		}
+	})
+	t.Run("If-None-Match: * does not overwrite existing files", func(t *testing.T) {
+		w := testConditionalWrite(t, fh, http.MethodPut, "/file.txt", "v2", "If-None-Match", "*")
+		if w.Code != http.StatusPreconditionFailed {
+			t.Errorf("Expected status %d, got %d", http.StatusPreconditionFailed, w.Code)
+		}
+		testGet(t, fh, "/file.txt", http.StatusOK, "v1")
+	})
+	t.Run("GET returns a strong ETag", func(t *testing.T) {
+		etag := testGetETag(t, fh, "/file.txt")
+		if etag == "" || strings.HasPrefix(etag, "W/") {
+			t.Errorf("Expected a strong ETag, got %q", etag)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/file.txt", nil)
+		req.Header.Set("If-None-Match", etag)
+		w := httptest.NewRecorder()
+		fh.ServeHTTP(w, req)
+		if w.Code != http.StatusNotModified {
+			t.Errorf("Expected status %d, got %d", http.StatusNotModified, w.Code)
+		}
+	})
+	t.Run("ETags change if a file is changed without changing its modification time or size", func(t *testing.T) {
+		name := filepath.Join(dir, "file.txt")
+		before := testGetETag(t, fh, "/file.txt")
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("Failed to stat file: %v", err)
+		}
+		if err = os.WriteFile(name, []byte("v9"), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		if err = os.Chtimes(name, fi.ModTime(), fi.ModTime()); err != nil {
+			t.Fatalf("Failed to set modification time: %v", err)
+		}
+		if after := testGetETag(t, fh, "/file.txt"); after == before {
+			t.Errorf("Expected the ETag to change, got %q", after)
+		}
+	})
+	t.Run("If-Match allows writes to the current version", func(t *testing.T) {
+		etag := testGetETag(t, fh, "/file.txt")
+		w := testConditionalWrite(t, fh, http.MethodPut, "/file.txt", "v2", "If-Match", etag)
+		if w.Code != http.StatusCreated {
+			t.Errorf("Expected status %d, got %d", http.StatusCreated, w.Code)
+		}
+		testGet(t, fh, "/file.txt", http.StatusOK, "v2")
+	})
+	t.Run("If-Match rejects writes to other versions", func(t *testing.T) {
+		w := testConditionalWrite(t, fh, http.MethodPut, "/file.txt", "v3", "If-Match", `"stale"`)
+		if w.Code != http.StatusPreconditionFailed {
+			t.Errorf("Expected status %d, got %d", http.StatusPreconditionFailed, w.Code)
+		}
+		testGet(t, fh, "/file.txt", http.StatusOK, "v2")
+	})
+	t.Run("If-Match rejects writes to missing files", func(t *testing.T) {
+		w := testConditionalWrite(t, fh, http.MethodPut, "/missing.txt", "v1", "If-Match", "*")
+		if w.Code != http.StatusPreconditionFailed {
+			t.Errorf("Expected status %d, got %d", http.StatusPreconditionFailed, w.Code)
+		}
+	})
+	t.Run("If-Match rejects deletes of other versions", func(t *testing.T) {
+		w := testConditionalWrite(t, fh, http.MethodDelete, "/file.txt", "", "If-Match", `"stale"`)
+		if w.Code != http.StatusPreconditionFailed {
+			t.Errorf("Expected status %d, got %d", http.StatusPreconditionFailed, w.Code)
+		}
+		testGet(t, fh, "/file.txt", http.StatusOK, "v2")
+	})
+	t.Run("If-Match allows deletes of the current version", func(t *testing.T) {
+		etag := testGetETag(t, fh, "/file.txt")
+		w := testConditionalWrite(t, fh, http.MethodDelete, "/file.txt", "", "If-Match", etag)
+		if w.Code != http.StatusNoContent {
+			t.Errorf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+		}
+	})
+}
+
+func testGetETag(t *testing.T, fh *FileHandler, urlPath string) string {
+	req := httptest.NewRequest(http.MethodGet, urlPath, nil)
+	w := httptest.NewRecorder()
+	fh.ServeHTTP(w, req)
+	return w.Header().Get("ETag")
+}
+
+func testConditionalWrite(t *testing.T, fh *FileHandler, method, urlPath, body, header, value string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, urlPath, strings.NewReader(body))
+	req.Header.Set(header, value)
+	w := httptest.NewRecorder()
+	fh.ServeHTTP(w, req)
+	return w
 }
 
 func testGet(t *testing.T, fh *FileHandler, urlPath string, expectedStatus int, expectedBody string) {
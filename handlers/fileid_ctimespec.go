@@ -0,0 +1,17 @@
+//go:build darwin || freebsd || netbsd
+
+package handlers
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileIdentity returns the inode and change time of the file, if they're available.
+func fileIdentity(fi fs.FileInfo) (ino uint64, ctime int64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(st.Ino), st.Ctimespec.Nano(), true
+}
@@ -0,0 +1,11 @@
+//go:build !(linux || openbsd || dragonfly || solaris || illumos || aix || darwin || freebsd || netbsd)
+
+package handlers
+
+import "io/fs"
+
+// fileIdentity returns the inode and change time of the file, which aren't available on this
+// platform.
+func fileIdentity(fi fs.FileInfo) (ino uint64, ctime int64, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// fileCheckInterval is how often the htpasswd and API key files are checked for changes.
+	fileCheckInterval = time.Second
+	// htpasswdCacheSize limits the number of successful verifications that are remembered.
+	htpasswdCacheSize = 1024
+)
+
+// dummyBcryptHash is compared against when the user doesn't exist, so that the response time
+// doesn't reveal which users exist.
+var dummyBcryptHash = []byte("$2a$10$g7ex/oQhCZHmZSiQgjHgluFhqh5qRAQR7dDtQhE8PMA3JeJMWZdvq")
+
+// PasswordVerifier checks a username and password.
+type PasswordVerifier interface {
+	Verify(username, password string) bool
+}
+
+// staticPassword is a PasswordVerifier for a single user.
+type staticPassword struct {
+	username string
+	password string
+}
+
+func (p staticPassword) Verify(username, password string) bool {
+	userMatches := subtle.ConstantTimeCompare([]byte(username), []byte(p.username)) == 1
+	passMatches := subtle.ConstantTimeCompare([]byte(password), []byte(p.password)) == 1
+	return userMatches && passMatches
+}
+
+// NewHtpasswd loads users from an Apache htpasswd file, with bcrypt ($2y$), SHA-256 crypt ($5$),
+// SHA-512 crypt ($6$) or argon2id ($argon2id$) hashes. The file is reloaded when it changes.
+func NewHtpasswd(log *slog.Logger, name string) (h *Htpasswd, err error) {
+	h = &Htpasswd{
+		log:         log,
+		watchedFile: watchedFile{name: name, checkInterval: fileCheckInterval},
+		cacheKey:    []byte(rand.Text()),
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if err = h.load(fi); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+type Htpasswd struct {
+	log *slog.Logger
+
+	mu sync.Mutex
+	watchedFile
+	users map[string]string
+	// verified caches successful verifications, because bcrypt and argon2 are deliberately slow,
+	// and clients send their credentials with every request. Keys are HMACs of the credentials.
+	verified map[string]struct{}
+	cacheKey []byte
+}
+
+func (h *Htpasswd) Verify(username, password string) bool {
+	hashed, ok := h.user(username)
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyBcryptHash, []byte(password))
+		return false
+	}
+	mac := hmac.New(sha256.New, h.cacheKey)
+	fmt.Fprintf(mac, "%s\x00%s\x00%s", username, password, hashed)
+	key := string(mac.Sum(nil))
+	h.mu.Lock()
+	_, cached := h.verified[key]
+	h.mu.Unlock()
+	if cached {
+		return true
+	}
+	if !verifyPasswordHash(hashed, password) {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.verified) >= htpasswdCacheSize {
+		clear(h.verified)
+	}
+	h.verified[key] = struct{}{}
+	return true
+}
+
+// user returns the password hash of the user, reloading the file first if it's changed.
+func (h *Htpasswd) user(username string) (hashed string, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fi, changed, err := h.changed()
+	if err != nil {
+		h.log.Error("Failed to check htpasswd file", slog.String("path", h.name), slog.Any("error", err))
+	} else if changed {
+		if err = h.load(fi); err != nil {
+			h.log.Error("Failed to reload htpasswd file, using previous users", slog.String("path", h.name), slog.Any("error", err))
+		}
+	}
+	hashed, ok = h.users[username]
+	return hashed, ok
+}
+
+// load reads the file. It must be called with the mutex held, or before h is shared.
+func (h *Htpasswd) load(fi os.FileInfo) error {
+	data, err := os.ReadFile(h.name)
+	if err != nil {
+		return err
+	}
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	var lineNumber int
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hashed, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			return fmt.Errorf("%s:%d: expected username:hash", h.name, lineNumber)
+		}
+		if !isSupportedPasswordHash(hashed) {
+			h.log.Warn("Skipping user with unsupported password hash, use bcrypt, SHA-256/512 crypt or argon2id", slog.String("path", h.name), slog.Int("line", lineNumber), slog.String("user", username))
+			continue
+		}
+		users[username] = hashed
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if h.users != nil {
+		h.log.Info("Reloaded htpasswd file", slog.String("path", h.name), slog.Int("users", len(users)))
+	}
+	h.users = users
+	h.loaded(fi)
+	h.verified = make(map[string]struct{})
+	return nil
+}
+
+func isSupportedPasswordHash(hashed string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$5$", "$6$", "$argon2id$"} {
+		if strings.HasPrefix(hashed, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func verifyPasswordHash(hashed, password string) bool {
+	switch {
+	case strings.HasPrefix(hashed, "$argon2id$"):
+		return verifyArgon2id(hashed, password)
+	case strings.HasPrefix(hashed, "$5$"), strings.HasPrefix(hashed, "$6$"):
+		computed, err := shaCrypt(password, hashed)
+		return err == nil && subtle.ConstantTimeCompare([]byte(computed), []byte(hashed)) == 1
+	default:
+		return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password)) == nil
+	}
+}
+
+// verifyArgon2id verifies a hash in the PHC string format used by htpasswd and the argon2
+// command line tool, e.g. $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>.
+func verifyArgon2id(hashed, password string) bool {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 6 || parts[2] != "v="+strconv.Itoa(argon2.Version) {
+		return false
+	}
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil || iterations < 1 || threads < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+	computed := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(expected)))
+	return subtle.ConstantTimeCompare(computed, expected) == 1
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestShaCrypt(t *testing.T) {
+	// Test vectors from https://www.akkadia.org/drepper/SHA-crypt.txt
+	tests := []struct {
+		settings string
+		password string
+		expected string
+	}{
+		{
+			settings: "$5$saltstring",
+			password: "Hello world!",
+			expected: "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5",
+		},
+		{
+			settings: "$5$rounds=10000$saltstringsaltstring",
+			password: "Hello world!",
+			expected: "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA",
+		},
+		{
+			settings: "$5$rounds=10$roundstoolow",
+			password: "the minimum number is still observed",
+			expected: "$5$rounds=1000$roundstoolow$yfvwcWrQ8l/K0DAWyuPMDNHpIVlTQebY9l/gL972bIC",
+		},
+		{
+			settings: "$6$saltstring",
+			password: "Hello world!",
+			expected: "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+		},
+		{
+			settings: "$6$rounds=10000$saltstringsaltstring",
+			password: "Hello world!",
+			expected: "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+		},
+		{
+			settings: "$6$rounds=1400$anotherlongsaltstring",
+			password: "a very much longer text to encrypt.  This one even stretches over morethan one line.",
+			expected: "$6$rounds=1400$anotherlongsalts$POfYwTEok97VWcjxIiSOjiykti.o/pQs.wPvMxQ6Fm7I6IoYN3CmLs66x9t0oSwbtEW7o7UmJEiDwGqd8p4ur1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.settings, func(t *testing.T) {
+			actual, err := shaCrypt(tt.password, tt.settings)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if actual != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, actual)
+			}
+			if !verifyPasswordHash(tt.expected, tt.password) {
+				t.Error("Expected the password to be verified")
+			}
+			if verifyPasswordHash(tt.expected, "wrong") {
+				t.Error("Expected the wrong password to be rejected")
+			}
+		})
+	}
+}
+
+func TestHtpasswd(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	salt := []byte("0123456789abcdef")
+	argon2Hash := fmt.Sprintf("$argon2id$v=19$m=1024,t=1,p=1$%s$%s",
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("argon2-password"), salt, 1, 1024, 1, 32)))
+
+	name := filepath.Join(t.TempDir(), "htpasswd")
+	content := "# Users\n" +
+		"alice:" + string(bcryptHash) + "\n" +
+		"bob:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5\n" +
+		"carol:$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1\n" +
+		"dave:" + argon2Hash + "\n" +
+		"eve:{SHA}unsupported=\n"
+	if err = os.WriteFile(name, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write htpasswd file: %v", err)
+	}
+	htpasswd, err := NewHtpasswd(slog.New(slog.DiscardHandler), name)
+	if err != nil {
+		t.Fatalf("Failed to load htpasswd file: %v", err)
+	}
+	htpasswd.checkInterval = 0
+
+	tests := []struct {
+		username string
+		password string
+		expected bool
+	}{
+		{username: "alice", password: "bcrypt-password", expected: true},
+		{username: "alice", password: "bcrypt-password", expected: true},
+		{username: "alice", password: "wrong", expected: false},
+		{username: "bob", password: "Hello world!", expected: true},
+		{username: "bob", password: "wrong", expected: false},
+		{username: "carol", password: "Hello world!", expected: true},
+		{username: "dave", password: "argon2-password", expected: true},
+		{username: "dave", password: "wrong", expected: false},
+		{username: "eve", password: "", expected: false},
+		{username: "mallory", password: "bcrypt-password", expected: false},
+	}
+	for _, tt := range tests {
+		if actual := htpasswd.Verify(tt.username, tt.password); actual != tt.expected {
+			t.Errorf("%s/%s: expected %v, got %v", tt.username, tt.password, tt.expected, actual)
+		}
+	}
+
+	t.Run("The file is reloaded when it changes", func(t *testing.T) {
+		content := "bob:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5\n"
+		if err := os.WriteFile(name, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write htpasswd file: %v", err)
+		}
+		future := time.Now().Add(time.Minute)
+		if err := os.Chtimes(name, future, future); err != nil {
+			t.Fatalf("Failed to change modification time: %v", err)
+		}
+		if htpasswd.Verify("alice", "bcrypt-password") {
+			t.Error("Expected alice to be removed")
+		}
+		if !htpasswd.Verify("bob", "Hello world!") {
+			t.Error("Expected bob to remain")
+		}
+	})
+	t.Run("Invalid files are rejected", func(t *testing.T) {
+		name := filepath.Join(t.TempDir(), "htpasswd")
+		if err := os.WriteFile(name, []byte("no colon\n"), 0600); err != nil {
+			t.Fatalf("Failed to write htpasswd file: %v", err)
+		}
+		if _, err := NewHtpasswd(slog.New(slog.DiscardHandler), name); err == nil {
+			t.Error("Expected an error")
+		}
+	})
+}
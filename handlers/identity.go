@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Identity is the authenticated user of a request.
+type Identity struct {
+	// Name is the username, or the name of the credential used to authenticate.
+	Name string
+	// Groups the user is a member of, in addition to any groups defined in the ACL.
+	Groups []string
+	// Method is how the user authenticated, e.g. basic.
+	Method string
+	// Scope limits the identity to a subset of the permissions granted by the Authorizer, e.g.
+	// to those of an API key. Nil means no limit.
+	Scope *Scope
+}
+
+// Scope is a set of permissions, optionally limited to paths within some prefixes.
+type Scope struct {
+	Permissions Permission
+	// Prefixes are URL paths, e.g. /releases, that the scope is limited to. Empty means any path.
+	Prefixes []string
+}
+
+// Allows returns true if the scope includes the permission for the URL path. Prefixes match
+// whole path segments, so /releases doesn't include /releases-old.
+func (s *Scope) Allows(urlPath string, perm Permission) bool {
+	if s.Permissions&perm != perm {
+		return false
+	}
+	if len(s.Prefixes) == 0 {
+		return true
+	}
+	urlPath = "/" + strings.Join(pathSegments(urlPath), "/")
+	for _, prefix := range s.Prefixes {
+		prefix = "/" + strings.Join(pathSegments(prefix), "/")
+		if prefix == "/" || urlPath == prefix || strings.HasPrefix(urlPath, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+type identityContextKey struct{}
+
+// WithIdentity returns a copy of ctx with the authenticated identity set. The identity is also
+// passed back to middleware outside of authentication that used withIdentityRecorder.
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	if recorder, ok := ctx.Value(identityRecorderContextKey{}).(*identityRecorder); ok {
+		recorder.id = id
+	}
+	return context.WithValue(ctx, identityContextKey{}, id)
+}
+
+type identityRecorderContextKey struct{}
+
+// identityRecorder is filled in with the identity set by authentication middleware, so that
+// middleware that wraps authentication, e.g. logging, can find out who made the request.
+type identityRecorder struct {
+	id *Identity
+}
+
+func withIdentityRecorder(ctx context.Context) (context.Context, *identityRecorder) {
+	recorder := &identityRecorder{id: IdentityFromContext(ctx)}
+	return context.WithValue(ctx, identityRecorderContextKey{}, recorder), recorder
+}
+
+// IdentityFromContext returns the authenticated identity, or nil if the request is anonymous.
+func IdentityFromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityContextKey{}).(*Identity)
+	return id
+}
+
+type challengesContextKey struct{}
+
+// withChallenge records a WWW-Authenticate challenge for an anonymous request that was allowed
+// through authentication, so that it can be sent if the request turns out to need credentials.
+func withChallenge(r *http.Request, challenge string) *http.Request {
+	challenges := append(authChallenges(r), challenge)
+	return r.WithContext(context.WithValue(r.Context(), challengesContextKey{}, challenges))
+}
+
+func authChallenges(r *http.Request) []string {
+	challenges, _ := r.Context().Value(challengesContextKey{}).([]string)
+	return challenges[:len(challenges):len(challenges)]
+}
+
+// deny writes a 401 response with the authentication challenges if the request is anonymous
+// and could authenticate, or a 403 response otherwise.
+func deny(w http.ResponseWriter, r *http.Request) {
+	challenges := authChallenges(r)
+	if IdentityFromContext(r.Context()) == nil && len(challenges) > 0 {
+		for _, challenge := range challenges {
+			w.Header().Add("WWW-Authenticate", challenge)
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	http.Error(w, "Forbidden", http.StatusForbidden)
+}
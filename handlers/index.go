@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+//go:embed index.html
+var defaultIndexTemplateText string
+
+// DefaultIndexTemplate is used to render directory listings if no custom template is set.
+var DefaultIndexTemplate = template.Must(template.New("index").Parse(defaultIndexTemplateText))
+
+// ParseIndexTemplate reads a custom html/template from the file at name, which is executed with
+// an IndexData to render each directory listing.
+func ParseIndexTemplate(name string) (*template.Template, error) {
+	return template.ParseFiles(name)
+}
+
+// IndexData is passed to the directory index template.
+type IndexData struct {
+	// Path is the URL path of the directory, e.g. /docs/.
+	Path string
+	// Parent is the URL of the parent directory, or empty at the root.
+	Parent      string
+	Breadcrumbs []Breadcrumb
+	Entries     []IndexEntry
+	// Sort is the column being sorted by: name, size or modtime.
+	Sort string
+	// Order is asc or desc.
+	Order string
+	// SortURLs link to the listing sorted by each column, reversing the order of the current column.
+	SortURLs struct {
+		Name    string
+		Size    string
+		ModTime string
+	}
+	// User is the name of the authenticated user, or empty if anonymous.
+	User string
+	// LogoutURL ends the session of users that logged in with the login form, or is empty.
+	LogoutURL string
+}
+
+type Breadcrumb struct {
+	Name string
+	URL  string
+}
+
+type IndexEntry struct {
+	Name        string
+	URL         string
+	IsDir       bool
+	Size        int64
+	HumanSize   string
+	ModTime     time.Time
+	ContentType string
+	Icon        string
+}
+
+// ListHTML renders the directory using the index template.
+func (h *FileHandler) ListHTML(w http.ResponseWriter, r *http.Request, dir string) {
+	sortBy, order := r.URL.Query().Get("sort"), r.URL.Query().Get("order")
+	if !slices.Contains([]string{"name", "size", "modtime"}, sortBy) {
+		sortBy = "name"
+	}
+	if order != "desc" {
+		order = "asc"
+	}
+	entries, err := h.readDir(r, dir, 1)
+	if err != nil {
+		h.logger(r).Error("Failed to list directory", slog.String("path", dir), slog.Any("error", err))
+		http.Error(w, "failed to list directory", http.StatusInternalServerError)
+		return
+	}
+	sortListing(entries, sortBy, order)
+
+	data := IndexData{
+		Path:        urlPath(dir),
+		Breadcrumbs: breadcrumbs(dir),
+		Sort:        sortBy,
+		Order:       order,
+	}
+	if dir != "." {
+		data.Parent = urlPath(path.Dir(dir))
+	}
+	data.SortURLs.Name = sortURL("name", sortBy, order)
+	data.SortURLs.Size = sortURL("size", sortBy, order)
+	data.SortURLs.ModTime = sortURL("modtime", sortBy, order)
+	if id := IdentityFromContext(r.Context()); id != nil {
+		data.User = id.Name
+		if id.Method == "session" {
+			data.LogoutURL = LogoutPath
+		}
+	}
+	for _, e := range entries {
+		entry := IndexEntry{
+			Name:        e.Name,
+			URL:         (&url.URL{Path: e.Name}).String(),
+			IsDir:       e.IsDir,
+			Size:        e.Size,
+			HumanSize:   humanSize(e.Size),
+			ModTime:     e.ModTime,
+			ContentType: e.ContentType,
+			Icon:        icon(e),
+		}
+		// Prevent names containing colons from being treated as a URL scheme.
+		if strings.Contains(strings.SplitN(e.Name, "/", 2)[0], ":") {
+			entry.URL = "./" + entry.URL
+		}
+		if e.IsDir {
+			entry.URL += "/"
+		}
+		data.Entries = append(data.Entries, entry)
+	}
+
+	tmpl := h.IndexTemplate
+	if tmpl == nil {
+		tmpl = DefaultIndexTemplate
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err = tmpl.Execute(w, data); err != nil {
+		h.logger(r).Error("Failed to render directory index", slog.String("path", dir), slog.Any("error", err))
+	}
+}
+
+// hasIndexFile returns true if the directory contains an index.html, which is served instead of a
+// listing.
+func (h *FileHandler) hasIndexFile(r *http.Request, dir string) bool {
+	fi, err := fs.Stat(h.readFS(), path.Join(dir, "index.html"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		h.logger(r).Warn("Failed to check for index.html", slog.String("path", dir), slog.Any("error", err))
+	}
+	return err == nil && fi.Mode().IsRegular()
+}
+
+func breadcrumbs(dir string) []Breadcrumb {
+	crumbs := []Breadcrumb{{Name: "/", URL: "/"}}
+	if dir == "." {
+		return crumbs
+	}
+	current := ""
+	for segment := range strings.SplitSeq(dir, "/") {
+		current = path.Join(current, segment)
+		crumbs = append(crumbs, Breadcrumb{Name: segment, URL: (&url.URL{Path: urlPath(current)}).String()})
+	}
+	return crumbs
+}
+
+func sortURL(column, sortBy, order string) string {
+	newOrder := "asc"
+	if column == sortBy && order == "asc" {
+		newOrder = "desc"
+	}
+	return "?" + url.Values{"sort": {column}, "order": {newOrder}}.Encode()
+}
+
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func icon(e listingEntry) string {
+	if e.IsDir {
+		return "📁"
+	}
+	mediaType, _, _ := strings.Cut(e.ContentType, ";")
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		return "🖼️"
+	case strings.HasPrefix(mediaType, "video/"):
+		return "🎞️"
+	case strings.HasPrefix(mediaType, "audio/"):
+		return "🎵"
+	case slices.Contains([]string{"application/zip", "application/gzip", "application/x-tar", "application/x-gzip"}, mediaType):
+		return "📦"
+	}
+	return "📄"
+}
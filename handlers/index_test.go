@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListHTML(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"small.txt":            "a",
+		"large.bin":            strings.Repeat("x", 2048),
+		"docs/guide.md":        "guide",
+		"site/index.html":      "<h1>Site</h1>",
+		"<script>alert(1).txt": "escaped",
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+	log := slog.New(slog.DiscardHandler)
+	fh, closer, err := NewFileHandler(log, dir, true)
+	if err != nil {
+		t.Fatalf("Failed to create FileHandler: %v", err)
+	}
+	defer closer()
+
+	t.Run("Directories are listed with sizes and breadcrumbs", func(t *testing.T) {
+		body := testListHTML(t, fh, "/")
+		for _, expected := range []string{`href="large.bin"`, "2.0 KiB", "1 B", `href="docs/"`, `id="filter"`} {
+			if !strings.Contains(body, expected) {
+				t.Errorf("Expected listing to contain %q", expected)
+			}
+		}
+		if strings.Contains(body, "<script>alert(1)") {
+			t.Error("Expected file names to be escaped")
+		}
+		body = testListHTML(t, fh, "/docs/")
+		if !strings.Contains(body, `<a href="/docs/">docs</a>`) {
+			t.Errorf("Expected breadcrumb to docs, got %s", body)
+		}
+	})
+	t.Run("Listings can be sorted", func(t *testing.T) {
+		body := testListHTML(t, fh, "/?sort=size&order=desc")
+		if strings.Index(body, "large.bin") > strings.Index(body, "small.txt") {
+			t.Error("Expected large.bin to be listed before small.txt")
+		}
+		if !strings.Contains(body, `href="?order=asc&amp;sort=size"`) {
+			t.Error("Expected the size column to link to the reverse order")
+		}
+	})
+	t.Run("Directories without a trailing slash are redirected", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/docs", nil)
+		w := httptest.NewRecorder()
+		fh.ServeHTTP(w, req)
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/docs/" {
+			t.Errorf("Expected redirect to /docs/, got %d %q", w.Code, w.Header().Get("Location"))
+		}
+	})
+	t.Run("index.html is served instead of a listing", func(t *testing.T) {
+		testGet(t, fh, "/site/", http.StatusOK, "<h1>Site</h1>")
+	})
+	t.Run("Custom templates can be used", func(t *testing.T) {
+		fh.IndexTemplate = template.Must(template.New("custom").Parse(`{{ .Path }}:{{ range .Entries }}{{ .Name }},{{ end }}`))
+		defer func() { fh.IndexTemplate = nil }()
+		testGet(t, fh, "/docs/", http.StatusOK, "/docs/:guide.md,")
+	})
+}
+
+func testListHTML(t *testing.T, fh *FileHandler, urlPath string) string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, urlPath, nil)
+	w := httptest.NewRecorder()
+	fh.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	return w.Body.String()
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"net/netip"
+)
+
+// IPFilter allows or denies client IP addresses. Denied ranges take precedence over allowed
+// ranges, and if there are allowed ranges, addresses outside them are denied.
+type IPFilter struct {
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+}
+
+func (f IPFilter) Allows(addr netip.Addr) bool {
+	if len(f.Allow) == 0 && len(f.Deny) == 0 {
+		return true
+	}
+	if !addr.IsValid() || containsAddr(f.Deny, addr) {
+		return false
+	}
+	return len(f.Allow) == 0 || containsAddr(f.Allow, addr)
+}
+
+// NewIPFilterMiddleware restricts requests by the client IP address, see ClientIP, with
+// separate filters for reads and writes.
+func NewIPFilterMiddleware(log *slog.Logger, next http.Handler, read, write IPFilter) http.Handler {
+	return &IPFilterMiddleware{
+		log:   log,
+		next:  next,
+		read:  read,
+		write: write,
+	}
+}
+
+type IPFilterMiddleware struct {
+	log         *slog.Logger
+	next        http.Handler
+	read, write IPFilter
+}
+
+func (m *IPFilterMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	filter := m.write
+	if isReadMethod(r.Method) {
+		filter = m.read
+	}
+	if addr := ClientIP(r); !filter.Allows(addr) {
+		LoggerFromContext(r.Context(), m.log).Warn("Request denied by IP filter", slog.String("method", r.Method), slog.String("url", redactURL(r.URL)), slog.String("client_ip", addr.String()))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	m.next.ServeHTTP(w, r)
+}
+
+// isReadMethod returns true for methods that don't modify the served directory.
+func isReadMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,393 @@
+package handlers
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksRefreshInterval is how often a JWKS URL is fetched again, so that rotated keys are used.
+	jwksRefreshInterval = time.Hour
+	// jwksMinRefreshInterval limits how often a token with an unknown key ID can cause a fetch.
+	jwksMinRefreshInterval = time.Minute
+	// jwtLeeway allows for clock differences between the server and the identity provider.
+	jwtLeeway = time.Minute
+	// jwksMaxSize limits the size of a JWKS document.
+	jwksMaxSize = 1 << 20
+)
+
+var (
+	errInvalidJWT = errors.New("invalid JWT")
+	errUnknownJWK = errors.New("unknown JWT signing key")
+)
+
+// NewJWKS loads JSON Web Keys from a file, which is reloaded when it changes, or from an https
+// URL, which is fetched again every hour, or sooner when a token is signed by an unknown key.
+func NewJWKS(log *slog.Logger, source string) (k *JWKS, err error) {
+	return newJWKS(log, source, &http.Client{Timeout: 10 * time.Second})
+}
+
+func newJWKS(log *slog.Logger, source string, client *http.Client) (k *JWKS, err error) {
+	// Keys fetched over plain HTTP could be replaced by anyone on the network, who could then
+	// sign their own tokens.
+	if strings.HasPrefix(source, "http://") {
+		return nil, errJWKSInsecure
+	}
+	k = &JWKS{
+		log:         log,
+		client:      client,
+		watchedFile: watchedFile{name: source, checkInterval: fileCheckInterval},
+	}
+	k.isURL = strings.HasPrefix(source, "https://")
+	if !k.isURL {
+		fi, err := os.Stat(k.name)
+		if err != nil {
+			return nil, err
+		}
+		if err = k.load(fi); err != nil {
+			return nil, err
+		}
+		return k, nil
+	}
+	k.fetched = time.Now()
+	if k.keys, err = k.fetch(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+var errJWKSInsecure = errors.New("JWKS URL must use https")
+
+type JWKS struct {
+	log    *slog.Logger
+	client *http.Client
+	isURL  bool
+
+	mu sync.Mutex
+	// watchedFile is only checked for changes if the source is a file, not a URL.
+	watchedFile
+	// fetched is when the keys were last fetched from the URL, or when a fetch started.
+	fetched time.Time
+	keys    []jwk
+}
+
+// jwk is a parsed JSON Web Key.
+type jwk struct {
+	id  string
+	alg string
+	key crypto.PublicKey
+}
+
+// key returns the key for the token header, refreshing the keys first if they're out of date.
+func (k *JWKS) key(kid, alg string) (key jwk, err error) {
+	if !k.isURL {
+		return k.fileKey(kid, alg)
+	}
+	if k.due(jwksRefreshInterval) {
+		k.refresh()
+	}
+	if key, ok := k.find(kid, alg); ok {
+		return key, nil
+	}
+	// The identity provider may have rotated its keys.
+	if kid != "" && k.due(jwksMinRefreshInterval) {
+		k.refresh()
+		if key, ok := k.find(kid, alg); ok {
+			return key, nil
+		}
+	}
+	return key, errUnknownJWK
+}
+
+func (k *JWKS) fileKey(kid, alg string) (key jwk, err error) {
+	k.mu.Lock()
+	fi, changed, err := k.changed()
+	if err != nil {
+		k.log.Error("Failed to check JWKS file", slog.String("path", k.name), slog.Any("error", err))
+	} else if changed {
+		if err = k.load(fi); err != nil {
+			k.log.Error("Failed to reload JWKS file, using previous keys", slog.String("path", k.name), slog.Any("error", err))
+		}
+	}
+	k.mu.Unlock()
+	if key, ok := k.find(kid, alg); ok {
+		return key, nil
+	}
+	return key, errUnknownJWK
+}
+
+// due returns true if the keys were fetched longer ago than the interval. The fetch is then
+// considered started, so that concurrent requests don't all fetch the keys.
+func (k *JWKS) due(interval time.Duration) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if time.Since(k.fetched) < interval {
+		return false
+	}
+	k.fetched = time.Now()
+	return true
+}
+
+func (k *JWKS) find(kid, alg string) (key jwk, ok bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, key := range k.keys {
+		if (kid == "" || key.id == kid) && key.alg == alg {
+			return key, true
+		}
+	}
+	return key, false
+}
+
+// refresh fetches the keys from the URL, without holding the mutex, so that requests with known
+// keys aren't held up by a slow identity provider. The previous keys are kept if it fails.
+func (k *JWKS) refresh() {
+	keys, err := k.fetch()
+	if err != nil {
+		k.log.Error("Failed to refresh JWKS, using previous keys", slog.String("url", k.name), slog.Any("error", err))
+		return
+	}
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+}
+
+func (k *JWKS) fetch() (keys []jwk, err error) {
+	resp, err := k.client.Get(k.name)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, jwksMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
+
+// load reads the keys from the file. It must be called with the mutex held, or before k is
+// shared.
+func (k *JWKS) load(fi os.FileInfo) error {
+	data, err := os.ReadFile(k.name)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", k.name, err)
+	}
+	k.keys = keys
+	k.loaded(fi)
+	return nil
+}
+
+// parseJWKS parses the RS256, ES256 and EdDSA signing keys of a JWKS document, ignoring others.
+func parseJWKS(data []byte) (keys []jwk, err error) {
+	var doc struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Alg string `json:"alg"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+	for i, raw := range doc.Keys {
+		if raw.Use != "" && raw.Use != "sig" {
+			continue
+		}
+		key := jwk{id: raw.Kid}
+		switch {
+		case raw.Kty == "RSA":
+			key.alg = "RS256"
+			n, errN := base64.RawURLEncoding.DecodeString(raw.N)
+			e, errE := base64.RawURLEncoding.DecodeString(raw.E)
+			if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("key %d: invalid RSA key", i)
+			}
+			pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			if pub.N.BitLen() < 2048 {
+				return nil, fmt.Errorf("key %d: RSA keys must be at least 2048 bits", i)
+			}
+			key.key = pub
+		case raw.Kty == "EC" && raw.Crv == "P-256":
+			key.alg = "ES256"
+			x, errX := base64.RawURLEncoding.DecodeString(raw.X)
+			y, errY := base64.RawURLEncoding.DecodeString(raw.Y)
+			if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+				return nil, fmt.Errorf("key %d: invalid EC key", i)
+			}
+			pub, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+			if err != nil {
+				return nil, fmt.Errorf("key %d: invalid EC key: %w", i, err)
+			}
+			key.key = pub
+		case raw.Kty == "OKP" && raw.Crv == "Ed25519":
+			key.alg = "EdDSA"
+			x, err := base64.RawURLEncoding.DecodeString(raw.X)
+			if err != nil || len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("key %d: invalid Ed25519 key", i)
+			}
+			key.key = ed25519.PublicKey(x)
+		default:
+			continue
+		}
+		if raw.Alg != "" && raw.Alg != key.alg {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no RS256, ES256 or EdDSA signing keys")
+	}
+	return keys, nil
+}
+
+// JWTVerifier is a TokenVerifier for JWTs signed by one of the keys of a JWKS.
+type JWTVerifier struct {
+	Keys     *JWKS
+	Issuer   string
+	Audience string
+	// UserClaim is the claim used as the username, e.g. sub or email.
+	UserClaim string
+	// GroupsClaim is the claim containing the groups of the user, which can be granted
+	// permissions by ACL rules.
+	GroupsClaim string
+
+	now func() time.Time
+}
+
+func (v *JWTVerifier) Identity(ctx context.Context, token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidJWT
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, errInvalidJWT
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+	key, err := v.Keys.key(header.Kid, header.Alg)
+	if err != nil {
+		return nil, err
+	}
+	if !verifyJWTSignature(key, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, errInvalidJWT
+	}
+
+	var claims map[string]json.RawMessage
+	if err = decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, errInvalidJWT
+	}
+	var registered struct {
+		Issuer    string      `json:"iss"`
+		Audience  stringOrSet `json:"aud"`
+		Expiry    *float64    `json:"exp"`
+		NotBefore *float64    `json:"nbf"`
+	}
+	if err = decodeJWTPart(parts[1], &registered); err != nil {
+		return nil, errInvalidJWT
+	}
+	now := time.Now
+	if v.now != nil {
+		now = v.now
+	}
+	switch {
+	case registered.Issuer != v.Issuer:
+		return nil, fmt.Errorf("%w: unexpected issuer %q", errInvalidJWT, registered.Issuer)
+	case !slices.Contains(registered.Audience, v.Audience):
+		return nil, fmt.Errorf("%w: unexpected audience", errInvalidJWT)
+	case registered.Expiry == nil || now().Add(-jwtLeeway).After(unixTime(*registered.Expiry)):
+		return nil, fmt.Errorf("%w: expired", errInvalidJWT)
+	case registered.NotBefore != nil && now().Add(jwtLeeway).Before(unixTime(*registered.NotBefore)):
+		return nil, fmt.Errorf("%w: not yet valid", errInvalidJWT)
+	}
+
+	id := &Identity{Method: "jwt"}
+	if err = json.Unmarshal(claims[v.UserClaim], &id.Name); err != nil || id.Name == "" {
+		return nil, fmt.Errorf("%w: missing %s claim", errInvalidJWT, v.UserClaim)
+	}
+	if groups, ok := claims[v.GroupsClaim]; ok {
+		var set stringOrSet
+		if err = json.Unmarshal(groups, &set); err != nil {
+			return nil, fmt.Errorf("%w: invalid %s claim", errInvalidJWT, v.GroupsClaim)
+		}
+		id.Groups = set
+	}
+	return id, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func verifyJWTSignature(key jwk, signingInput, signature []byte) bool {
+	hash := sha256.Sum256(signingInput)
+	switch pub := key.key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], signature) == nil
+	case *ecdsa.PublicKey:
+		if len(signature) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(pub, hash[:], r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, signingInput, signature)
+	}
+	return false
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// stringOrSet is a claim that's either a string or an array of strings, e.g. aud.
+type stringOrSet []string
+
+func (s *stringOrSet) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*s = stringOrSet{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(s))
+}
@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testJWTKeys struct {
+	rsa     *rsa.PrivateKey
+	ecdsa   *ecdsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+}
+
+func newTestJWTKeys(t *testing.T) (keys testJWTKeys, jwks []byte) {
+	var err error
+	if keys.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	if keys.ecdsa, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatalf("Failed to generate ECDSA key: %v", err)
+	}
+	var edPub ed25519.PublicKey
+	if edPub, keys.ed25519, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatalf("Failed to generate Ed25519 key: %v", err)
+	}
+	ecPoint, err := keys.ecdsa.PublicKey.Bytes()
+	if err != nil {
+		t.Fatalf("Failed to encode ECDSA key: %v", err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks, err = json.Marshal(map[string]any{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(keys.rsa.N.Bytes()), "e": b64(big.NewInt(int64(keys.rsa.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecPoint[1:33]), "y": b64(ecPoint[33:])},
+			{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edPub)},
+			{"kty": "oct", "kid": "ignored", "k": "c2VjcmV0"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode JWKS: %v", err)
+	}
+	return keys, jwks
+}
+
+func signTestJWT(t *testing.T, key crypto.Signer, alg, kid string, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signingInput))
+	var signature []byte
+	var err error
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(rand.Reader, key, hash[:]); err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signingInput))
+	}
+	if err != nil {
+		t.Fatalf("Failed to sign JWT: %v", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTVerifier(t *testing.T) {
+	keys, jwks := newTestJWTKeys(t)
+	name := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(name, jwks, 0644); err != nil {
+		t.Fatalf("Failed to write JWKS: %v", err)
+	}
+	log := slog.New(slog.DiscardHandler)
+	set, err := NewJWKS(log, name)
+	if err != nil {
+		t.Fatalf("Failed to load JWKS: %v", err)
+	}
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	verifier := &JWTVerifier{
+		Keys:        set,
+		Issuer:      "https://idp.example.com",
+		Audience:    "serve",
+		UserClaim:   "sub",
+		GroupsClaim: "groups",
+		now:         func() time.Time { return now },
+	}
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{
+			"iss":    "https://idp.example.com",
+			"aud":    []string{"other", "serve"},
+			"sub":    "alice",
+			"groups": []string{"devs"},
+			"exp":    now.Add(time.Hour).Unix(),
+			"nbf":    now.Add(-time.Hour).Unix(),
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	for _, tt := range []struct {
+		alg string
+		kid string
+		key crypto.Signer
+	}{
+		{alg: "RS256", kid: "rsa", key: keys.rsa},
+		{alg: "ES256", kid: "ec", key: keys.ecdsa},
+		{alg: "EdDSA", kid: "ed", key: keys.ed25519},
+	} {
+		t.Run(tt.alg+" tokens are accepted", func(t *testing.T) {
+			id, err := verifier.Identity(context.Background(), signTestJWT(t, tt.key, tt.alg, tt.kid, claims(nil)))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if id.Name != "alice" || id.Method != "jwt" || !slices.Equal(id.Groups, []string{"devs"}) {
+				t.Errorf("Unexpected identity: %+v", id)
+			}
+		})
+	}
+	t.Run("Invalid tokens are rejected", func(t *testing.T) {
+		valid := signTestJWT(t, keys.ed25519, "EdDSA", "ed", claims(nil))
+		_, wrongKey, _ := ed25519.GenerateKey(rand.Reader)
+		header, _, _ := strings.Cut(valid, ".")
+		unsignedHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+		_, payloadAndSignature, _ := strings.Cut(valid, ".")
+		payload, _, _ := strings.Cut(payloadAndSignature, ".")
+		for name, token := range map[string]string{
+			"malformed":          "not.a-jwt",
+			"alg none":           unsignedHeader + "." + payload + ".",
+			"wrong key":          signTestJWT(t, wrongKey, "EdDSA", "ed", claims(nil)),
+			"alg mismatch":       signTestJWT(t, keys.ed25519, "EdDSA", "rsa", claims(nil)),
+			"unknown kid":        signTestJWT(t, keys.ed25519, "EdDSA", "unknown", claims(nil)),
+			"tampered payload":   header + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"mallory"}`)) + "." + strings.Split(valid, ".")[2],
+			"wrong issuer":       signTestJWT(t, keys.ed25519, "EdDSA", "ed", claims(map[string]any{"iss": "https://evil.example.com"})),
+			"wrong audience":     signTestJWT(t, keys.ed25519, "EdDSA", "ed", claims(map[string]any{"aud": "other"})),
+			"expired":            signTestJWT(t, keys.ed25519, "EdDSA", "ed", claims(map[string]any{"exp": now.Add(-2 * time.Minute).Unix()})),
+			"no expiry":          signTestJWT(t, keys.ed25519, "EdDSA", "ed", claims(map[string]any{"exp": nil})),
+			"not yet valid":      signTestJWT(t, keys.ed25519, "EdDSA", "ed", claims(map[string]any{"nbf": now.Add(2 * time.Minute).Unix()})),
+			"missing user claim": signTestJWT(t, keys.ed25519, "EdDSA", "ed", claims(map[string]any{"sub": nil})),
+		} {
+			if _, err := verifier.Identity(context.Background(), token); err == nil {
+				t.Errorf("%s: expected an error", name)
+			}
+		}
+	})
+	t.Run("Tokens within the leeway are accepted", func(t *testing.T) {
+		token := signTestJWT(t, keys.ed25519, "EdDSA", "ed", claims(map[string]any{"exp": now.Add(-30 * time.Second).Unix(), "aud": "serve"}))
+		if _, err := verifier.Identity(context.Background(), token); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+	t.Run("Keys are fetched from a URL", func(t *testing.T) {
+		var fetches atomic.Int32
+		fetching, release := make(chan struct{}), make(chan struct{})
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if fetches.Add(1) > 1 {
+				fetching <- struct{}{}
+				<-release
+			}
+			w.Write(jwks)
+		}))
+		defer server.Close()
+		set, err := newJWKS(log, server.URL, server.Client())
+		if err != nil {
+			t.Fatalf("Failed to load JWKS: %v", err)
+		}
+		verifier := *verifier
+		verifier.Keys = set
+		if _, err := verifier.Identity(context.Background(), signTestJWT(t, keys.rsa, "RS256", "rsa", claims(nil))); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if n := fetches.Load(); n != 1 {
+			t.Errorf("Expected 1 fetch, got %d", n)
+		}
+
+		// Tokens signed by known keys are verified while the keys are being refreshed.
+		set.mu.Lock()
+		set.fetched = time.Now().Add(-2 * jwksRefreshInterval)
+		set.mu.Unlock()
+		token := signTestJWT(t, keys.rsa, "RS256", "rsa", claims(nil))
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			verifier.Identity(context.Background(), token)
+		}()
+		<-fetching
+		if _, err := verifier.Identity(context.Background(), signTestJWT(t, keys.ed25519, "EdDSA", "ed", claims(nil))); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		close(release)
+		<-done
+	})
+	t.Run("Keys aren't fetched over plain HTTP", func(t *testing.T) {
+		if _, err := NewJWKS(log, "http://example.com/jwks.json"); !errors.Is(err, errJWKSInsecure) {
+			t.Errorf("Expected %v, got %v", errJWKSInsecure, err)
+		}
+	})
+}
+
+func TestJWTAuthorization(t *testing.T) {
+	keys, jwks := newTestJWTKeys(t)
+	name := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(name, jwks, 0644); err != nil {
+		t.Fatalf("Failed to write JWKS: %v", err)
+	}
+	log := slog.New(slog.DiscardHandler)
+	set, err := NewJWKS(log, name)
+	if err != nil {
+		t.Fatalf("Failed to load JWKS: %v", err)
+	}
+	fh, closer, err := NewFileHandler(log, t.TempDir(), false)
+	if err != nil {
+		t.Fatalf("Failed to create FileHandler: %v", err)
+	}
+	defer closer()
+	if fh.Authorizer, err = ParseACL(strings.NewReader("@authenticated /** read\n@uploaders /** write\n")); err != nil {
+		t.Fatalf("Failed to parse ACL: %v", err)
+	}
+	handler := NewBearerAuthMiddleware(fh, &JWTVerifier{Keys: set, Issuer: "idp", Audience: "serve", UserClaim: "email", GroupsClaim: "roles"})
+
+	put := func(roles []string) int {
+		token := signTestJWT(t, keys.ecdsa, "ES256", "ec", map[string]any{
+			"iss":   "idp",
+			"aud":   "serve",
+			"email": "alice@example.com",
+			"roles": roles,
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		})
+		req := httptest.NewRequest(http.MethodPut, "/file.txt", strings.NewReader("content"))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := put([]string{"viewers"}); code != http.StatusForbidden {
+		t.Errorf("Expected status 403 without the uploaders group, got %d", code)
+	}
+	if code := put([]string{"viewers", "uploaders"}); code != http.StatusCreated {
+		t.Errorf("Expected status 201 with the uploaders group, got %d", code)
+	}
+}
@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultListingLimit = 1000
+	maxListingLimit     = 10000
+	maxListingDepth     = 16
+	// maxListingEntries limits the work done for a single recursive listing.
+	maxListingEntries = 100000
+)
+
+var errListingTooLarge = errors.New("directory listing too large")
+
+type listingEntry struct {
+	// Name is the path of the entry, relative to the listed directory.
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	Mode        string    `json:"mode"`
+	ModTime     time.Time `json:"mod_time"`
+	IsDir       bool      `json:"is_dir"`
+	ETag        string    `json:"etag,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+}
+
+type listing struct {
+	Path    string         `json:"path"`
+	Total   int            `json:"total"`
+	Offset  int            `json:"offset"`
+	Limit   int            `json:"limit"`
+	Entries []listingEntry `json:"entries"`
+}
+
+// wantsJSON returns true if the client asked for a JSON directory listing.
+func wantsJSON(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "json"
+	}
+	for accept := range strings.SplitSeq(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(accept)
+		if err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// readDir lists the contents of dir, and its subdirectories up to depth levels deep. The staging
+// directory, dotfiles if they're hidden, and anything the user can't read are left out.
+func (h *FileHandler) readDir(r *http.Request, dir string, depth int) (entries []listingEntry, err error) {
+	fsys := h.readFS()
+	entries = []listingEntry{}
+	err = fs.WalkDir(fsys, dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name == dir {
+				return err
+			}
+			// Skip anything that can't be read, rather than failing the whole listing.
+			return nil
+		}
+		if name == dir {
+			return nil
+		}
+		if h.isHidden(name) || !h.isAuthorized(r, name, PermissionRead) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		rel := strings.TrimPrefix(name, dir+"/")
+		if dir == "." {
+			rel = name
+		}
+		if len(entries) >= maxListingEntries {
+			return errListingTooLarge
+		}
+		// Stat follows symlinks, as allowed by the symlink policy.
+		fi, err := fs.Stat(fsys, name)
+		if err != nil {
+			return nil
+		}
+		entry := listingEntry{
+			Name:    rel,
+			Size:    fi.Size(),
+			Mode:    fi.Mode().String(),
+			ModTime: fi.ModTime().UTC(),
+			IsDir:   fi.IsDir(),
+		}
+		if fi.Mode().IsRegular() {
+			entry.ETag = etag(fi)
+			entry.ContentType = mime.TypeByExtension(path.Ext(name))
+		}
+		entries = append(entries, entry)
+		if d.IsDir() && strings.Count(rel, "/")+1 >= depth {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// sortListing sorts entries by the "sort" (name, size or modtime) and "order" (asc or desc)
+// query parameters.
+func sortListing(entries []listingEntry, sortBy, order string) {
+	compare := func(a, b listingEntry) int {
+		return strings.Compare(a.Name, b.Name)
+	}
+	switch sortBy {
+	case "size":
+		compare = func(a, b listingEntry) int {
+			return cmp.Or(cmp.Compare(a.Size, b.Size), strings.Compare(a.Name, b.Name))
+		}
+	case "modtime":
+		compare = func(a, b listingEntry) int {
+			return cmp.Or(a.ModTime.Compare(b.ModTime), strings.Compare(a.Name, b.Name))
+		}
+	}
+	if order == "desc" {
+		slices.SortFunc(entries, func(a, b listingEntry) int { return compare(b, a) })
+		return
+	}
+	slices.SortFunc(entries, compare)
+}
+
+// urlPath returns the URL path of a directory within the root.
+func urlPath(dir string) string {
+	if dir == "." {
+		return "/"
+	}
+	return "/" + dir + "/"
+}
+
+// queryInt returns the value of an integer query parameter, or defaultVal if it isn't set.
+func queryInt(r *http.Request, name string, defaultVal, minVal, maxVal int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return defaultVal, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < minVal || v > maxVal {
+		return 0, fmt.Errorf("invalid %s parameter, must be between %d and %d", name, minVal, maxVal)
+	}
+	return v, nil
+}
+
+// ListJSON writes a JSON listing of the directory, supporting the query parameters sort, order,
+// offset, limit and depth.
+func (h *FileHandler) ListJSON(w http.ResponseWriter, r *http.Request, dir string) {
+	offset, err := queryInt(r, "offset", 0, 0, maxListingEntries)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultListingLimit, 1, maxListingLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	depth, err := queryInt(r, "depth", 1, 1, maxListingDepth)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sortBy, order := r.URL.Query().Get("sort"), r.URL.Query().Get("order")
+	if !slices.Contains([]string{"", "name", "size", "modtime"}, sortBy) || !slices.Contains([]string{"", "asc", "desc"}, order) {
+		http.Error(w, "invalid sort parameters, sort must be name, size or modtime, and order must be asc or desc", http.StatusBadRequest)
+		return
+	}
+
+	entries, err := h.readDir(r, dir, depth)
+	if err != nil {
+		if errors.Is(err, errListingTooLarge) {
+			http.Error(w, "directory listing too large, reduce the depth", http.StatusBadRequest)
+			return
+		}
+		h.logger(r).Error("Failed to list directory", slog.String("path", dir), slog.Any("error", err))
+		http.Error(w, "failed to list directory", http.StatusInternalServerError)
+		return
+	}
+	sortListing(entries, sortBy, order)
+
+	result := listing{
+		Path:    urlPath(dir),
+		Total:   len(entries),
+		Offset:  offset,
+		Limit:   limit,
+		Entries: entries[min(offset, len(entries)):min(offset+limit, len(entries))],
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(result); err != nil {
+		h.logger(r).Error("Failed to write directory listing", slog.String("path", dir), slog.Any("error", err))
+	}
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestListJSON(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"a.txt":           "a",
+		"b.html":          "bbbbb",
+		"c.bin":           "ccc",
+		"sub/d.txt":       "dd",
+		"sub/deep/e.txt":  "e",
+		stagingDir + "/x": "hidden",
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+	log := slog.New(slog.DiscardHandler)
+	fh, closer, err := NewFileHandler(log, dir, true)
+	if err != nil {
+		t.Fatalf("Failed to create FileHandler: %v", err)
+	}
+	defer closer()
+
+	t.Run("Accept: application/json returns a listing", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept", "application/json")
+		result := testListJSON(t, fh, req)
+		if got := listingNames(result); got != "a.txt,b.html,c.bin,sub" {
+			t.Errorf("Unexpected listing: %s", got)
+		}
+		if result.Entries[1].ContentType != "text/html; charset=utf-8" {
+			t.Errorf("Expected HTML content type, got %q", result.Entries[1].ContentType)
+		}
+		if result.Entries[0].ETag == "" || result.Entries[3].ETag != "" {
+			t.Errorf("Expected ETags for files only")
+		}
+		if !result.Entries[3].IsDir {
+			t.Errorf("Expected sub to be a directory")
+		}
+	})
+	t.Run("HTML is returned by default", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		fh.ServeHTTP(w, req)
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+			t.Errorf("Expected HTML, got %q", ct)
+		}
+	})
+	t.Run("Listings can be sorted", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/?format=json&sort=size&order=desc", nil)
+		result := testListJSON(t, fh, req)
+		result.Entries = slices.DeleteFunc(result.Entries, func(e listingEntry) bool { return e.IsDir })
+		if got := listingNames(result); got != "b.html,c.bin,a.txt" {
+			t.Errorf("Unexpected listing: %s", got)
+		}
+	})
+	t.Run("Listings can be paginated", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/?format=json&offset=1&limit=2", nil)
+		result := testListJSON(t, fh, req)
+		if got := listingNames(result); got != "b.html,c.bin" {
+			t.Errorf("Unexpected listing: %s", got)
+		}
+		if result.Total != 4 {
+			t.Errorf("Expected total of 4, got %d", result.Total)
+		}
+	})
+	t.Run("Listings can be recursive", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/sub/?format=json&depth=2", nil)
+		result := testListJSON(t, fh, req)
+		if got := listingNames(result); got != "d.txt,deep,deep/e.txt" {
+			t.Errorf("Unexpected listing: %s", got)
+		}
+		if result.Path != "/sub/" {
+			t.Errorf("Expected path /sub/, got %q", result.Path)
+		}
+	})
+	t.Run("Invalid parameters are rejected", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/?format=json&depth=100", nil)
+		w := httptest.NewRecorder()
+		fh.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+}
+
+func testListJSON(t *testing.T, fh *FileHandler, req *http.Request) (result listing) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	fh.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to decode listing: %v", err)
+	}
+	return result
+}
+
+func listingNames(l listing) string {
+	names := make([]string, len(l.Entries))
+	for i, e := range l.Entries {
+		names[i] = e.Name
+	}
+	return strings.Join(names, ",")
+}
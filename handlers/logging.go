@@ -1,12 +1,19 @@
 package handlers
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 )
 
-func NewLoggingMiddleware(log *slog.Logger, logRemoteAddr bool, next http.Handler) http.Handler {
+func NewLoggingMiddleware(log *slog.Logger, logRemoteAddr bool, next http.Handler) *LoggingMiddleware {
 	return &LoggingMiddleware{
 		log:           log,
 		logRemoteAddr: logRemoteAddr,
@@ -18,41 +25,157 @@ type LoggingMiddleware struct {
 	log           *slog.Logger
 	logRemoteAddr bool
 	next          http.Handler
+	// AccessLog writes requests in an access log format instead of to the log, if set.
+	AccessLog *AccessLog
 }
 
 func (m *LoggingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	args := []any{
-		slog.String("method", r.Method),
-		slog.String("url", r.URL.String()),
+	e := &AccessLogEntry{
+		Time:      time.Now(),
+		Method:    r.Method,
+		URL:       redactURL(&url.URL{Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}),
+		Proto:     r.Proto,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+		RequestID: RequestIDFromContext(r.Context()),
 	}
 	if m.logRemoteAddr {
-		args = append(args, slog.String("remote_addr", r.RemoteAddr))
+		e.RemoteAddr = ClientIP(r).String()
 	}
-
-	start := time.Now()
+	// Requests are logged before they're authenticated, so that denied requests are logged too,
+	// and the user is found out once the request has been served.
+	ctx, identity := withIdentityRecorder(r.Context())
+	r = r.WithContext(ctx)
 
 	sw := &statusWriter{ResponseWriter: w}
+	body := &bodyReader{ReadCloser: r.Body}
+	if r.Body != nil {
+		r.Body = body
+	}
 	m.next.ServeHTTP(sw, r)
-	args = append(args, slog.Duration("duration", time.Since(start)), slog.Int("status", sw.Status()))
+	e.Duration = time.Since(e.Time)
+	e.Status = sw.Status()
+	e.Bytes = sw.bytes
+	e.RequestBytes = body.bytes
+	if !sw.firstByte.IsZero() {
+		e.TTFB = sw.firstByte.Sub(e.Time)
+	}
+	e.Aborted = sw.err != nil || body.aborted() || errors.Is(r.Context().Err(), context.Canceled)
+	if identity.id != nil {
+		e.User = identity.id.Name
+	}
+
+	if m.AccessLog != nil {
+		if err := m.AccessLog.Log(e); err != nil {
+			LoggerFromContext(r.Context(), m.log).Error("Failed to write access log", slog.Any("error", err))
+		}
+		return
+	}
+	log := LoggerFromContext(r.Context(), m.log)
+	args := []any{
+		slog.String("method", r.Method),
+		slog.String("url", redactURL(r.URL)),
+	}
+	if m.logRemoteAddr {
+		args = append(args, slog.String("remote_addr", e.RemoteAddr))
+	}
+	if e.User != "" {
+		args = append(args, slog.String("user", e.User))
+	}
+	args = append(args,
+		slog.Duration("duration", e.Duration),
+		slog.Int("status", e.Status),
+		slog.Int64("bytes", e.Bytes),
+		slog.Int64("request_bytes", e.RequestBytes),
+		slog.Duration("ttfb", e.TTFB),
+	)
+	if e.Aborted {
+		args = append(args, slog.Bool("aborted", true))
+		log.Warn("Request aborted", args...)
+		return
+	}
+	log.Info("Request", args...)
+}
 
-	m.log.Info("Request", args...)
+// redactURL removes URL signatures and share link tokens, so that the logs can't be used to make
+// requests.
+func redactURL(u *url.URL) string {
+	redacted := *u
+	if token, ok := strings.CutPrefix(u.Path, ShareLinksPath); ok && token != "" {
+		redacted.Path, redacted.RawPath = ShareLinksPath+"REDACTED", ""
+	}
+	if query := u.Query(); query.Has(signedURLSignature) {
+		query.Set(signedURLSignature, "REDACTED")
+		redacted.RawQuery = query.Encode()
+	}
+	return redacted.String()
 }
 
 type statusWriter struct {
 	http.ResponseWriter
 	status int
+	// bytes is the number of bytes of the body written.
+	bytes int64
+	// firstByte is when the response started to be written.
+	firstByte time.Time
+	// err is the first error writing the response, e.g. because the client disconnected.
+	err error
 }
 
 func (w *statusWriter) WriteHeader(code int) {
 	w.status = code
+	if w.firstByte.IsZero() {
+		w.firstByte = time.Now()
+	}
 	w.ResponseWriter.WriteHeader(code)
 }
 
-func (w *statusWriter) Write(b []byte) (int, error) {
+// started records the start of the body, which implies a 200 OK if no status was written.
+func (w *statusWriter) started() {
 	if w.status == 0 {
 		w.status = http.StatusOK
 	}
-	return w.ResponseWriter.Write(b)
+	if w.firstByte.IsZero() {
+		w.firstByte = time.Now()
+	}
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.started()
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// ReadFrom copies using the io.ReaderFrom of the ResponseWriter, so that http.ServeContent can
+// send files with the sendfile system call.
+func (w *statusWriter) ReadFrom(src io.Reader) (int64, error) {
+	w.started()
+	n, err := readFrom(w.ResponseWriter, src)
+	w.bytes += n
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// Flush sends buffered data to the client, for streaming responses.
+func (w *statusWriter) Flush() {
+	w.started()
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// Unwrap allows http.ResponseController to use the features of the ResponseWriter, e.g.
+// SetWriteDeadline.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
 func (w *statusWriter) Status() int {
@@ -61,3 +184,35 @@ func (w *statusWriter) Status() int {
 	}
 	return w.status
 }
+
+// bodyReader counts the bytes read from a request body.
+type bodyReader struct {
+	io.ReadCloser
+	bytes int64
+	// err is the first error reading the body, other than io.EOF.
+	err error
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes += int64(n)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// aborted returns true if the body couldn't be read because the client stopped sending it, rather
+// than because it was too large.
+func (r *bodyReader) aborted() bool {
+	var maxBytesErr *http.MaxBytesError
+	return r.err != nil && !errors.As(r.err, &maxBytesErr)
+}
+
+// readFrom copies src to w with the io.ReaderFrom of w if it has one.
+func readFrom(w http.ResponseWriter, src io.Reader) (int64, error) {
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(w, src)
+}
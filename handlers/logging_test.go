@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/a-h/serve/config"
+)
+
+// readFromRecorder records whether ReadFrom was used.
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (w *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	w.readFrom = true
+	return io.Copy(w.ResponseRecorder, src)
+}
+
+func TestStatusWriter(t *testing.T) {
+	log := slog.New(slog.DiscardHandler)
+	t.Run("ReadFrom is passed through", func(t *testing.T) {
+		w := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+		sw := &statusWriter{ResponseWriter: w}
+		n, err := io.Copy(sw, io.LimitReader(strings.NewReader("hello world"), 5))
+		if err != nil {
+			t.Fatalf("Failed to copy: %v", err)
+		}
+		if !w.readFrom {
+			t.Error("Expected ReadFrom of the ResponseWriter to be used")
+		}
+		if n != 5 || sw.bytes != 5 || sw.Status() != http.StatusOK || w.Body.String() != "hello" {
+			t.Errorf("Unexpected copy of %d bytes, recorded %d with status %d: %q", n, sw.bytes, sw.Status(), w.Body.String())
+		}
+	})
+	t.Run("Flush is passed through", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler := NewLoggingMiddleware(log, false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("event"))
+			if err := http.NewResponseController(w).Flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+			}
+		}))
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if !w.Flushed {
+			t.Error("Expected the response to be flushed")
+		}
+	})
+	t.Run("connections can be hijacked", func(t *testing.T) {
+		server := httptest.NewServer(NewLoggingMiddleware(log, false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("Failed to hijack: %v", err)
+				return
+			}
+			defer conn.Close()
+			buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+			buf.Flush()
+		})))
+		defer server.Close()
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatalf("Failed to get: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "hijacked" {
+			t.Errorf("Expected the hijacked response, got %q", body)
+		}
+	})
+	t.Run("hijacking fails if the ResponseWriter doesn't support it", func(t *testing.T) {
+		sw := &statusWriter{ResponseWriter: httptest.NewRecorder()}
+		if _, _, err := sw.Hijack(); err == nil {
+			t.Error("Expected an error")
+		}
+	})
+}
+
+// hiddenInterfacesWriter only has the methods of http.ResponseWriter, hiding the io.ReaderFrom
+// and http.Flusher of the wrapped ResponseWriter, for comparison in benchmarks.
+type hiddenInterfacesWriter struct {
+	w http.ResponseWriter
+}
+
+func (w hiddenInterfacesWriter) Header() http.Header         { return w.w.Header() }
+func (w hiddenInterfacesWriter) Write(b []byte) (int, error) { return w.w.Write(b) }
+func (w hiddenInterfacesWriter) WriteHeader(code int)        { w.w.WriteHeader(code) }
+
+func BenchmarkDownload(b *testing.B) {
+	dir := b.TempDir()
+	const size = 64 << 20
+	f, err := os.Create(filepath.Join(dir, "large.bin"))
+	if err != nil {
+		b.Fatalf("Failed to create file: %v", err)
+	}
+	if err = f.Truncate(size); err != nil {
+		b.Fatalf("Failed to size file: %v", err)
+	}
+	f.Close()
+	log := slog.New(slog.DiscardHandler)
+	fh, closer, err := NewFileHandler(log, dir, true)
+	if err != nil {
+		b.Fatalf("Failed to create FileHandler: %v", err)
+	}
+	defer closer()
+
+	benchmarks := []struct {
+		name    string
+		handler http.Handler
+	}{
+		{name: "unwrapped", handler: fh},
+		{name: "logging", handler: NewLoggingMiddleware(log, false, fh)},
+		{name: "hidden interfaces", handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fh.ServeHTTP(hiddenInterfacesWriter{w: w}, r)
+		})},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			server := httptest.NewServer(bm.handler)
+			defer server.Close()
+			client := server.Client()
+			b.SetBytes(size)
+			for b.Loop() {
+				resp, err := client.Get(server.URL + "/large.bin")
+				if err != nil {
+					b.Fatalf("Failed to get: %v", err)
+				}
+				n, err := io.Copy(io.Discard, bufio.NewReaderSize(resp.Body, 1<<20))
+				resp.Body.Close()
+				if err != nil || n != size {
+					b.Fatalf("Read %d bytes: %v", n, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateLogsDeniedRequests(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	accessLogFile := filepath.Join(t.TempDir(), "access.log")
+	h, closer, err := Create(slog.New(slog.DiscardHandler), &config.Config{
+		Dir:             dir,
+		Auth:            "alice:secret",
+		DenyWrite:       "192.0.2.0/24",
+		Symlinks:        "deny",
+		AccessLogFormat: AccessLogJSON,
+		AccessLogFile:   accessLogFile,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	defer closer()
+
+	serve := func(method string, auth bool) {
+		req := httptest.NewRequest(method, "/a.txt", strings.NewReader("b"))
+		req.RemoteAddr = "192.0.2.1:1234"
+		if auth {
+			req.SetBasicAuth("alice", "secret")
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	serve(http.MethodGet, false)
+	serve(http.MethodGet, true)
+	serve(http.MethodPut, true)
+
+	data, err := os.ReadFile(accessLogFile)
+	if err != nil {
+		t.Fatalf("Failed to read access log: %v", err)
+	}
+	var actual []string
+	for line := range strings.SplitSeq(strings.TrimSpace(string(data)), "\n") {
+		var e struct {
+			User   string `json:"user"`
+			Method string `json:"method"`
+			Status int    `json:"status"`
+		}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("Failed to decode %q: %v", line, err)
+		}
+		actual = append(actual, fmt.Sprintf("%s %s %d", e.Method, e.User, e.Status))
+	}
+	expected := []string{
+		"GET  401",
+		"GET alice 200",
+		"PUT  403",
+	}
+	if !slices.Equal(actual, expected) {
+		t.Errorf("Expected requests:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+}
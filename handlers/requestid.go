@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"log/slog"
+	"net/http"
+	"net/netip"
+)
+
+// RequestIDHeader is the header that request IDs are accepted from trusted proxies in, and
+// returned to clients in.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength limits the length of request IDs accepted from proxies.
+const maxRequestIDLength = 128
+
+type requestIDContextKey struct{}
+
+type loggerContextKey struct{}
+
+// RequestIDFromContext returns the ID of the request, or empty if it doesn't have one.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// LoggerFromContext returns the logger of the request, which includes its ID, or log if the
+// request doesn't have one.
+func LoggerFromContext(ctx context.Context, log *slog.Logger) *slog.Logger {
+	if l, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return log
+}
+
+// NewRequestIDMiddleware gives each request an ID, so that log lines can be correlated with
+// each other and with the error reports of users. The ID is taken from the X-Request-ID header
+// of requests from trusted proxies, or generated, and returned in the X-Request-ID header of the
+// response. A logger that includes the ID is added to the context, see LoggerFromContext.
+func NewRequestIDMiddleware(log *slog.Logger, next http.Handler, trustedProxies []netip.Prefix) http.Handler {
+	return &RequestIDMiddleware{
+		log:            log,
+		next:           next,
+		trustedProxies: trustedProxies,
+	}
+}
+
+type RequestIDMiddleware struct {
+	log            *slog.Logger
+	next           http.Handler
+	trustedProxies []netip.Prefix
+}
+
+func (m *RequestIDMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(RequestIDHeader)
+	if peer := peerIP(r); !peer.IsValid() || !containsAddr(m.trustedProxies, peer) || !validRequestID(id) {
+		id = rand.Text()
+	}
+	w.Header().Set(RequestIDHeader, id)
+	ctx := context.WithValue(r.Context(), requestIDContextKey{}, id)
+	ctx = context.WithValue(ctx, loggerContextKey{}, m.log.With(slog.String("request_id", id)))
+	m.next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// validRequestID returns true if the ID is short, and only contains characters that are safe to
+// log and return in a header.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':' || c == '/' || c == '+' || c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
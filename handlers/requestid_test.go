@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	trusted, _ := ParsePrefixes("10.0.0.1")
+	var logs bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&logs, nil))
+	var id string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id = RequestIDFromContext(r.Context())
+		LoggerFromContext(r.Context(), log).Error("Failed to do something")
+	})
+	handler := NewRequestIDMiddleware(log, next, trusted)
+
+	serve := func(remoteAddr, requestID string) *httptest.ResponseRecorder {
+		logs.Reset()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		if requestID != "" {
+			req.Header.Set(RequestIDHeader, requestID)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("IDs are generated, returned and logged", func(t *testing.T) {
+		w := serve("192.0.2.1:1234", "")
+		if id == "" || w.Header().Get(RequestIDHeader) != id {
+			t.Fatalf("Expected the ID %q to be returned, got %q", id, w.Header().Get(RequestIDHeader))
+		}
+		if !strings.Contains(logs.String(), "request_id="+id) {
+			t.Errorf("Expected the ID to be logged, got %q", logs.String())
+		}
+		first := id
+		serve("192.0.2.1:1234", "")
+		if id == first {
+			t.Error("Expected a different ID for each request")
+		}
+	})
+	t.Run("IDs from trusted proxies are used", func(t *testing.T) {
+		w := serve("10.0.0.1:1234", "abc-123")
+		if id != "abc-123" || w.Header().Get(RequestIDHeader) != "abc-123" {
+			t.Errorf("Expected the proxy's ID, got %q", id)
+		}
+	})
+	t.Run("IDs from other clients are replaced", func(t *testing.T) {
+		if serve("192.0.2.1:1234", "abc-123"); id == "abc-123" {
+			t.Error("Expected the client's ID to be replaced")
+		}
+	})
+	t.Run("invalid IDs are replaced", func(t *testing.T) {
+		for _, invalid := range []string{"abc 123", "abc\"123", strings.Repeat("a", 129)} {
+			if serve("10.0.0.1:1234", invalid); id == invalid {
+				t.Errorf("Expected %q to be replaced", invalid)
+			}
+		}
+	})
+	t.Run("the request log includes the ID", func(t *testing.T) {
+		handler := NewRequestIDMiddleware(log, NewLoggingMiddleware(log, false, http.NotFoundHandler()), nil)
+		logs.Reset()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/missing.txt", nil))
+		if !strings.Contains(logs.String(), `msg=Request `) || !strings.Contains(logs.String(), "request_id="+w.Header().Get(RequestIDHeader)) {
+			t.Errorf("Expected the request to be logged with its ID, got %q", logs.String())
+		}
+	})
+}
@@ -0,0 +1,954 @@
+package handlers
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Namespace     = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3MaxKeys       = 1000
+	s3MaxPartNumber = 10000
+	// s3MaxPartSize is the largest part that S3 accepts, 5 GiB.
+	s3MaxPartSize = 5 << 30
+	s3UploadsDir  = stagingDir + "/s3"
+)
+
+// NewS3Handler creates a handler that serves the directory of fh using the S3 REST API, with
+// path-style addressing. Each top level directory is a bucket, and the files within it are
+// objects. If credentials is empty, requests are not authenticated, otherwise each request must
+// be signed using AWS Signature Version 4 with one of the access key to secret key pairs.
+func NewS3Handler(log *slog.Logger, fh *FileHandler, credentials map[string]string, region string) *S3Handler {
+	return &S3Handler{
+		Log:         log,
+		Region:      region,
+		MaxPartSize: s3MaxPartSize,
+		credentials: credentials,
+		files:       fh,
+	}
+}
+
+// S3Handler implements the subset of the S3 API used by the AWS CLI and SDKs to list, read, write
+// and delete objects. Object metadata, such as Content-Type and x-amz-meta-* headers, is not
+// stored.
+type S3Handler struct {
+	Log    *slog.Logger
+	Region string
+	// MaxPartSize is the maximum size in bytes of each part of a multipart upload. Incomplete
+	// multipart uploads are deleted after the TusExpiry of the FileHandler, in the same way as
+	// tus uploads.
+	MaxPartSize int64
+	credentials map[string]string
+	files       *FileHandler
+}
+
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+	status   int
+}
+
+func newS3Error(status int, code, message string) *s3Error {
+	return &s3Error{Code: code, Message: message, status: status}
+}
+
+var (
+	s3ErrNoSuchBucket       = newS3Error(http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+	s3ErrNoSuchKey          = newS3Error(http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+	s3ErrNoSuchUpload       = newS3Error(http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist.")
+	s3ErrAccessDenied       = newS3Error(http.StatusForbidden, "AccessDenied", "Access Denied")
+	s3ErrInvalidBucket      = newS3Error(http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid.")
+	s3ErrInvalidKey         = newS3Error(http.StatusBadRequest, "InvalidArgument", "The specified key is not valid.")
+	s3ErrInvalidPart        = newS3Error(http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found.")
+	s3ErrInvalidPartNum     = newS3Error(http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000, inclusive.")
+	s3ErrMalformedXML       = newS3Error(http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed.")
+	s3ErrBucketNotEmpty     = newS3Error(http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty.")
+	s3ErrBucketExists       = newS3Error(http.StatusConflict, "BucketAlreadyOwnedByYou", "The bucket already exists.")
+	s3ErrNotImplemented     = newS3Error(http.StatusNotImplemented, "NotImplemented", "The requested operation is not implemented.")
+	s3ErrMethodNotAllowed   = newS3Error(http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+	s3ErrInternalError      = newS3Error(http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.")
+	s3ErrBadDigest          = newS3Error(http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed.")
+	s3ErrSignature          = newS3Error(http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.")
+	s3ErrInvalidAccess      = newS3Error(http.StatusForbidden, "InvalidAccessKeyId", "The AWS access key ID you provided does not exist in our records.")
+	s3ErrRequestExpired     = newS3Error(http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large.")
+	s3ErrPreconditionFailed = newS3Error(http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold.")
+	s3ErrInvalidArgument    = newS3Error(http.StatusBadRequest, "InvalidArgument", "Invalid argument.")
+	s3ErrEntityTooLarge     = newS3Error(http.StatusRequestEntityTooLarge, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed size.")
+)
+
+func (h *S3Handler) writeError(w http.ResponseWriter, r *http.Request, e *s3Error) {
+	resp := *e
+	resp.Resource = r.URL.Path
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(resp.status)
+	if r.Method != http.MethodHead {
+		_ = xml.NewEncoder(w).Encode(resp)
+	}
+}
+
+// logger returns the logger of the request, which includes its ID, see LoggerFromContext.
+func (h *S3Handler) logger(r *http.Request) *slog.Logger {
+	return LoggerFromContext(r.Context(), h.Log)
+}
+
+func (h *S3Handler) writeXML(w http.ResponseWriter, r *http.Request, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		h.logger(r).Error("Failed to write S3 response", slog.Any("error", err))
+	}
+}
+
+func (h *S3Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var sig *sigV4
+	if len(h.credentials) > 0 {
+		verified, err := verifySigV4(r, h.credentials, time.Now())
+		if err != nil {
+			switch err {
+			case errS3SignatureMismatch:
+				h.writeError(w, r, s3ErrSignature)
+			case errS3InvalidAccessKey:
+				h.writeError(w, r, s3ErrInvalidAccess)
+			case errS3RequestExpired:
+				h.writeError(w, r, s3ErrRequestExpired)
+			default:
+				h.writeError(w, r, s3ErrAccessDenied)
+			}
+			return
+		}
+		sig = &verified
+		r = r.WithContext(WithIdentity(r.Context(), &Identity{Name: sig.accessKey, Method: "s3"}))
+	}
+	w, r, record, ok := h.files.startAudit(w, r, h.files.cleanPath(r.URL.Path))
+	if !ok {
+		return
+	}
+	defer record()
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+	body := s3PayloadReader(r, sig)
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket == "" {
+		if r.Method != http.MethodGet {
+			h.writeError(w, r, s3ErrMethodNotAllowed)
+			return
+		}
+		h.listBuckets(w, r)
+		return
+	}
+	if strings.HasPrefix(bucket, ".") || bucket != path.Clean(bucket) {
+		h.writeError(w, r, s3ErrInvalidBucket)
+		return
+	}
+	if perm := s3Permission(r); perm != 0 && !h.files.isAuthorized(r, strings.TrimSuffix(bucket+"/"+key, "/"), perm) {
+		h.writeError(w, r, s3ErrAccessDenied)
+		return
+	}
+	if key == "" {
+		h.serveBucket(w, r, bucket, body)
+		return
+	}
+	h.serveObject(w, r, bucket, key, body)
+}
+
+// s3Permission returns the permission needed for the bucket or object of the request.
+func s3Permission(r *http.Request) Permission {
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return PermissionRead
+	case http.MethodDelete:
+		if query.Has("uploadId") {
+			return PermissionWrite
+		}
+		return PermissionDelete
+	case http.MethodPost:
+		if query.Has("delete") {
+			// Checked for each object.
+			return 0
+		}
+	}
+	return PermissionWrite
+}
+
+func (h *S3Handler) serveBucket(w http.ResponseWriter, r *http.Request, bucket string, body io.Reader) {
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		switch {
+		case query.Has("location"):
+			h.getBucketLocation(w, r, bucket)
+		case query.Has("uploads"), query.Has("versions"), query.Has("policy"), query.Has("acl"):
+			h.writeError(w, r, s3ErrNotImplemented)
+		default:
+			h.listObjects(w, r, bucket)
+		}
+	case http.MethodHead:
+		if !h.bucketExists(bucket) {
+			h.writeError(w, r, s3ErrNoSuchBucket)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPut:
+		h.createBucket(w, r, bucket)
+	case http.MethodDelete:
+		h.deleteBucket(w, r, bucket)
+	case http.MethodPost:
+		if !query.Has("delete") {
+			h.writeError(w, r, s3ErrNotImplemented)
+			return
+		}
+		h.deleteObjects(w, r, bucket, body)
+	default:
+		h.writeError(w, r, s3ErrMethodNotAllowed)
+	}
+}
+
+func (h *S3Handler) serveObject(w http.ResponseWriter, r *http.Request, bucket, key string, body io.Reader) {
+	name := bucket + "/" + key
+	if cleaned := path.Clean(name); cleaned != strings.TrimSuffix(name, "/") || strings.Contains(cleaned, "..") {
+		h.writeError(w, r, s3ErrInvalidKey)
+		return
+	}
+	if !h.bucketExists(bucket) {
+		h.writeError(w, r, s3ErrNoSuchBucket)
+		return
+	}
+	query := r.URL.Query()
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && h.files.checkSymlinks(strings.TrimSuffix(name, "/")) != nil {
+		h.writeError(w, r, s3ErrAccessDenied)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.getObject(w, r, name)
+	case http.MethodPut:
+		switch {
+		case query.Has("uploadId"):
+			h.uploadPart(w, r, bucket, key, body)
+		case r.Header.Get("X-Amz-Copy-Source") != "":
+			h.copyObject(w, r, name)
+		default:
+			h.putObject(w, r, name, body)
+		}
+	case http.MethodPost:
+		switch {
+		case query.Has("uploads"):
+			h.createMultipartUpload(w, r, bucket, key)
+		case query.Has("uploadId"):
+			h.completeMultipartUpload(w, r, bucket, key, body)
+		default:
+			h.writeError(w, r, s3ErrNotImplemented)
+		}
+	case http.MethodDelete:
+		if query.Has("uploadId") {
+			h.abortMultipartUpload(w, r, bucket, key)
+			return
+		}
+		h.deleteObject(w, r, name)
+	default:
+		h.writeError(w, r, s3ErrMethodNotAllowed)
+	}
+}
+
+// bucketExists returns true if the bucket is a directory that can be read, according to the
+// symlink policy.
+func (h *S3Handler) bucketExists(bucket string) bool {
+	fi, err := fs.Stat(h.files.readFS(), bucket)
+	return err == nil && fi.IsDir()
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+func (h *S3Handler) listBuckets(w http.ResponseWriter, r *http.Request) {
+	entries, err := fs.ReadDir(h.files.readFS(), ".")
+	if err != nil {
+		h.logger(r).Error("Failed to list buckets", slog.Any("error", err))
+		h.writeError(w, r, s3ErrInternalError)
+		return
+	}
+	result := s3ListAllMyBucketsResult{Xmlns: s3Namespace, Owner: s3Owner{ID: "serve", DisplayName: "serve"}}
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || h.files.isHidden(entry.Name()) || !h.files.isAuthorized(r, entry.Name(), PermissionRead) {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		result.Buckets = append(result.Buckets, s3Bucket{Name: entry.Name(), CreationDate: s3Time(fi.ModTime())})
+	}
+	h.writeXML(w, r, result)
+}
+
+type s3LocationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Region  string   `xml:",chardata"`
+}
+
+func (h *S3Handler) getBucketLocation(w http.ResponseWriter, r *http.Request, bucket string) {
+	if !h.bucketExists(bucket) {
+		h.writeError(w, r, s3ErrNoSuchBucket)
+		return
+	}
+	h.writeXML(w, r, s3LocationConstraint{Xmlns: s3Namespace, Region: h.Region})
+}
+
+func (h *S3Handler) createBucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	if h.files.checkSymlinks(bucket) != nil {
+		h.writeError(w, r, s3ErrAccessDenied)
+		return
+	}
+	err := h.files.rootedFileSystem.Mkdir(bucket, 0755)
+	if errors.Is(err, fs.ErrExist) {
+		h.writeError(w, r, s3ErrBucketExists)
+		return
+	}
+	if err != nil {
+		h.logger(r).Error("Failed to create bucket", slog.String("bucket", bucket), slog.Any("error", err))
+		h.writeError(w, r, s3ErrInternalError)
+		return
+	}
+	w.Header().Set("Location", "/"+bucket)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *S3Handler) deleteBucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	if !h.bucketExists(bucket) {
+		h.writeError(w, r, s3ErrNoSuchBucket)
+		return
+	}
+	if err := h.files.rootedFileSystem.Remove(bucket); err != nil {
+		h.writeError(w, r, s3ErrBucketNotEmpty)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	Marker                *string          `xml:"Marker,omitempty"`
+	NextMarker            string           `xml:"NextMarker,omitempty"`
+	KeyCount              *int             `xml:"KeyCount,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+// s3ListEntry is either an object, or a common prefix if object is nil.
+type s3ListEntry struct {
+	key    string
+	object *s3Object
+}
+
+// listObjects implements both ListObjects and ListObjectsV2, which differ only in how the
+// position in the listing is passed between pages.
+func (h *S3Handler) listObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	if !h.bucketExists(bucket) {
+		h.writeError(w, r, s3ErrNoSuchBucket)
+		return
+	}
+	query := r.URL.Query()
+	isV2 := query.Get("list-type") == "2"
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	maxKeys := s3MaxKeys
+	if mk := query.Get("max-keys"); mk != "" {
+		var err error
+		if maxKeys, err = strconv.Atoi(mk); err != nil || maxKeys < 0 {
+			h.writeError(w, r, s3ErrInvalidArgument)
+			return
+		}
+		maxKeys = min(maxKeys, s3MaxKeys)
+	}
+	var after string
+	result := s3ListBucketResult{
+		Xmlns:        s3Namespace,
+		Name:         bucket,
+		Prefix:       prefix,
+		Delimiter:    delimiter,
+		MaxKeys:      maxKeys,
+		EncodingType: query.Get("encoding-type"),
+	}
+	if isV2 {
+		result.StartAfter = query.Get("start-after")
+		result.ContinuationToken = query.Get("continuation-token")
+		after = result.StartAfter
+		if result.ContinuationToken != "" {
+			decoded, err := base64.RawURLEncoding.DecodeString(result.ContinuationToken)
+			if err != nil {
+				h.writeError(w, r, s3ErrInvalidArgument)
+				return
+			}
+			after = string(decoded)
+		}
+	} else {
+		marker := query.Get("marker")
+		result.Marker = &marker
+		after = marker
+	}
+
+	entries, err := h.listEntries(r, bucket, prefix, delimiter)
+	if err != nil {
+		h.logger(r).Error("Failed to list objects", slog.String("bucket", bucket), slog.Any("error", err))
+		h.writeError(w, r, s3ErrInternalError)
+		return
+	}
+	start, _ := slices.BinarySearchFunc(entries, after, func(e s3ListEntry, after string) int {
+		return strings.Compare(e.key, after)
+	})
+	if start < len(entries) && entries[start].key == after {
+		start++
+	}
+	entries = entries[start:]
+	if len(entries) > maxKeys {
+		result.IsTruncated = true
+		entries = entries[:maxKeys]
+		last := entries[len(entries)-1].key
+		if isV2 {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		} else {
+			result.NextMarker = last
+		}
+	}
+	encode := func(s string) string { return s }
+	if result.EncodingType == "url" {
+		encode = s3URLEncode
+		result.Prefix = encode(result.Prefix)
+		result.Delimiter = encode(result.Delimiter)
+		result.StartAfter = encode(result.StartAfter)
+	}
+	for _, e := range entries {
+		if e.object == nil {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(e.key)})
+			continue
+		}
+		o := *e.object
+		o.Key = encode(o.Key)
+		result.Contents = append(result.Contents, o)
+	}
+	if isV2 {
+		keyCount := len(entries)
+		result.KeyCount = &keyCount
+	}
+	h.writeXML(w, r, result)
+}
+
+// listEntries returns the objects and common prefixes in the bucket that start with prefix,
+// sorted by key. As with directory listings, hidden files, and anything the user can't read, are
+// left out.
+func (h *S3Handler) listEntries(r *http.Request, bucket, prefix, delimiter string) (entries []s3ListEntry, err error) {
+	fsys := h.files.readFS()
+	// Only walk the directory that contains the prefix.
+	dir := bucket
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = bucket + "/" + prefix[:i]
+		if path.Clean(dir) != dir {
+			// Keys that aren't clean paths can't exist.
+			return nil, nil
+		}
+	}
+	prefixes := make(map[string]struct{})
+	err = fs.WalkDir(fsys, dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && name == dir {
+				return fs.SkipAll
+			}
+			return err
+		}
+		key := strings.TrimPrefix(name, bucket+"/")
+		if name != dir && (h.files.isHidden(name) || !h.files.isAuthorized(r, name, PermissionRead)) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if name == dir {
+				return nil
+			}
+			key += "/"
+			if !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key) {
+				return fs.SkipDir
+			}
+			// With the usual delimiter, there's no need to look inside directories.
+			if delimiter == "/" && strings.HasPrefix(key, prefix) {
+				prefixes[key] = struct{}{}
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		// Stat follows symlinks, as allowed by the symlink policy.
+		fi, err := fs.Stat(fsys, name)
+		if err != nil || !fi.Mode().IsRegular() {
+			return nil
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				prefixes[key[:len(prefix)+i+len(delimiter)]] = struct{}{}
+				return nil
+			}
+		}
+		entries = append(entries, s3ListEntry{key: key, object: &s3Object{
+			Key:          key,
+			LastModified: s3Time(fi.ModTime()),
+			ETag:         etag(fi),
+			Size:         fi.Size(),
+			StorageClass: "STANDARD",
+		}})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for p := range prefixes {
+		entries = append(entries, s3ListEntry{key: p})
+	}
+	slices.SortFunc(entries, func(a, b s3ListEntry) int {
+		return strings.Compare(a.key, b.key)
+	})
+	return entries, nil
+}
+
+func (h *S3Handler) getObject(w http.ResponseWriter, r *http.Request, name string) {
+	f, fi, ok := h.openObject(name)
+	if !ok {
+		h.writeError(w, r, s3ErrNoSuchKey)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("ETag", etag(fi))
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+// openObject opens a regular file for reading, in the same way as the FileHandler, so that hidden
+// files, and symlinks that aren't allowed by the symlink policy, don't exist.
+func (h *S3Handler) openObject(name string) (f io.ReadSeekCloser, fi fs.FileInfo, ok bool) {
+	if h.files.isHidden(name) {
+		return nil, nil, false
+	}
+	file, err := h.files.readFS().Open(name)
+	if err != nil {
+		return nil, nil, false
+	}
+	fi, err = file.Stat()
+	f, seekable := file.(io.ReadSeekCloser)
+	if err != nil || !fi.Mode().IsRegular() || !seekable {
+		file.Close()
+		return nil, nil, false
+	}
+	return f, fi, true
+}
+
+func (h *S3Handler) putObject(w http.ResponseWriter, r *http.Request, name string, body io.Reader) {
+	if strings.HasSuffix(name, "/") {
+		// Keys ending in a slash are used by some clients to create folders.
+		if err := h.files.rootedFileSystem.MkdirAll(strings.TrimSuffix(name, "/"), 0755); err != nil {
+			h.logger(r).Error("Failed to create directory", slog.String("path", name), slog.Any("error", err))
+			h.writeError(w, r, s3ErrInternalError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	precondition := func(current fs.FileInfo) bool {
+		return preconditionsMet(r, current)
+	}
+	if _, err := h.files.writeFileIf(name, auditBody(r, body), precondition); err != nil {
+		h.writeWriteError(w, r, name, err)
+		return
+	}
+	h.writeETag(w, name)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *S3Handler) writeWriteError(w http.ResponseWriter, r *http.Request, name string, err error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errPreconditionFailed):
+		h.writeError(w, r, s3ErrPreconditionFailed)
+	case errors.Is(err, errS3ContentSHA256):
+		h.writeError(w, r, s3ErrBadDigest)
+	case errors.Is(err, errS3SignatureMismatch):
+		h.writeError(w, r, s3ErrSignature)
+	case errors.As(err, &maxBytesErr):
+		h.writeError(w, r, s3ErrEntityTooLarge)
+	default:
+		h.logger(r).Error("Failed to write object", slog.String("path", name), slog.Any("error", err))
+		h.writeError(w, r, s3ErrInternalError)
+	}
+}
+
+func (h *S3Handler) writeETag(w http.ResponseWriter, name string) {
+	if fi, err := h.files.rootedFileSystem.Stat(name); err == nil {
+		w.Header().Set("ETag", etag(fi))
+	}
+}
+
+type s3CopyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	Xmlns        string   `xml:"xmlns,attr"`
+	LastModified string   `xml:"LastModified"`
+	ETag         string   `xml:"ETag"`
+}
+
+func (h *S3Handler) copyObject(w http.ResponseWriter, r *http.Request, name string) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		h.writeError(w, r, s3ErrInvalidArgument)
+		return
+	}
+	source, _, _ = strings.Cut(source, "?")
+	source = strings.TrimPrefix(source, "/")
+	if path.Clean(source) != source || strings.HasPrefix(source, ".") || strings.Contains(source, "..") {
+		h.writeError(w, r, s3ErrInvalidKey)
+		return
+	}
+	if !h.files.isAuthorized(r, source, PermissionRead) {
+		h.writeError(w, r, s3ErrAccessDenied)
+		return
+	}
+	f, _, ok := h.openObject(source)
+	if !ok {
+		h.writeError(w, r, s3ErrNoSuchKey)
+		return
+	}
+	defer f.Close()
+	if _, err = h.files.writeFile(name, f); err != nil {
+		h.writeWriteError(w, r, name, err)
+		return
+	}
+	fi, err := h.files.rootedFileSystem.Stat(name)
+	if err != nil {
+		h.writeError(w, r, s3ErrInternalError)
+		return
+	}
+	h.writeXML(w, r, s3CopyObjectResult{Xmlns: s3Namespace, LastModified: s3Time(fi.ModTime()), ETag: etag(fi)})
+}
+
+func (h *S3Handler) deleteObject(w http.ResponseWriter, r *http.Request, name string) {
+	if err := h.removeObject(name); err != nil {
+		h.logger(r).Error("Failed to delete object", slog.String("path", name), slog.Any("error", err))
+		h.writeError(w, r, s3ErrInternalError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeObject deletes the object, treating objects that don't exist as already deleted, as
+// S3 does.
+func (h *S3Handler) removeObject(name string) error {
+	fi, err := h.files.rootedFileSystem.Lstat(strings.TrimSuffix(name, "/"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() && !strings.HasSuffix(name, "/") {
+		return nil
+	}
+	err = h.files.rootedFileSystem.Remove(strings.TrimSuffix(name, "/"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+type s3Delete struct {
+	Quiet   bool `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type s3DeleteResult struct {
+	XMLName xml.Name        `xml:"DeleteResult"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Deleted []s3DeletedKey  `xml:"Deleted"`
+	Errors  []s3DeleteError `xml:"Error"`
+}
+
+type s3DeletedKey struct {
+	Key string `xml:"Key"`
+}
+
+type s3DeleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (h *S3Handler) deleteObjects(w http.ResponseWriter, r *http.Request, bucket string, body io.Reader) {
+	if !h.bucketExists(bucket) {
+		h.writeError(w, r, s3ErrNoSuchBucket)
+		return
+	}
+	var req s3Delete
+	if err := xml.NewDecoder(io.LimitReader(body, 2<<20)).Decode(&req); err != nil {
+		h.writeError(w, r, s3ErrMalformedXML)
+		return
+	}
+	result := s3DeleteResult{Xmlns: s3Namespace}
+	for _, o := range req.Objects {
+		name := bucket + "/" + o.Key
+		if path.Clean(name) != strings.TrimSuffix(name, "/") || strings.Contains(name, "..") {
+			result.Errors = append(result.Errors, s3DeleteError{Key: o.Key, Code: s3ErrInvalidKey.Code, Message: s3ErrInvalidKey.Message})
+			auditObject(r, h.files.cleanPath(name), s3ErrInvalidKey.status)
+			continue
+		}
+		if !h.files.isAuthorized(r, name, PermissionDelete) || h.files.checkSymlinks(strings.TrimSuffix(name, "/")) != nil {
+			result.Errors = append(result.Errors, s3DeleteError{Key: o.Key, Code: s3ErrAccessDenied.Code, Message: s3ErrAccessDenied.Message})
+			auditObject(r, name, s3ErrAccessDenied.status)
+			continue
+		}
+		if err := h.removeObject(name); err != nil {
+			h.logger(r).Error("Failed to delete object", slog.String("path", name), slog.Any("error", err))
+			result.Errors = append(result.Errors, s3DeleteError{Key: o.Key, Code: s3ErrInternalError.Code, Message: s3ErrInternalError.Message})
+			auditObject(r, name, s3ErrInternalError.status)
+			continue
+		}
+		auditObject(r, name, http.StatusNoContent)
+		if !req.Quiet {
+			result.Deleted = append(result.Deleted, s3DeletedKey{Key: o.Key})
+		}
+	}
+	h.writeXML(w, r, result)
+}
+
+// s3MultipartUpload is stored in the staging area alongside the uploaded parts.
+type s3MultipartUpload struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+func (h *S3Handler) createMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	h.removeExpiredMultipartUploads(r)
+	id := rand.Text()
+	dir := path.Join(s3UploadsDir, id)
+	data, err := json.Marshal(s3MultipartUpload{Bucket: bucket, Key: key})
+	if err == nil {
+		err = h.files.rootedFileSystem.MkdirAll(dir, 0755)
+	}
+	if err == nil {
+		err = h.files.rootedFileSystem.WriteFile(path.Join(dir, "upload.json"), data, 0644)
+	}
+	if err != nil {
+		h.logger(r).Error("Failed to create multipart upload", slog.String("bucket", bucket), slog.String("key", key), slog.Any("error", err))
+		h.writeError(w, r, s3ErrInternalError)
+		return
+	}
+	h.writeXML(w, r, s3InitiateMultipartUploadResult{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadID: id})
+}
+
+// multipartUploadDir returns the staging directory of the upload, if it exists and is for the
+// given object.
+func (h *S3Handler) multipartUploadDir(uploadID, bucket, key string) (dir string, ok bool) {
+	if uploadID == "" || strings.ContainsAny(uploadID, "/.") {
+		return "", false
+	}
+	dir = path.Join(s3UploadsDir, uploadID)
+	data, err := h.files.rootedFileSystem.ReadFile(path.Join(dir, "upload.json"))
+	if err != nil {
+		return "", false
+	}
+	var upload s3MultipartUpload
+	if err = json.Unmarshal(data, &upload); err != nil {
+		return "", false
+	}
+	return dir, upload.Bucket == bucket && upload.Key == key
+}
+
+// removeExpiredMultipartUploads deletes multipart uploads that haven't received a part within
+// the TusExpiry of the FileHandler.
+func (h *S3Handler) removeExpiredMultipartUploads(r *http.Request) {
+	entries, err := fs.ReadDir(h.files.rootedFileSystem.FS(), s3UploadsDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		// Writing a part renames it into the directory of the upload, which updates its
+		// modification time.
+		fi, err := entry.Info()
+		if err != nil || !h.files.tusExpired(fi) {
+			continue
+		}
+		dir := path.Join(s3UploadsDir, entry.Name())
+		if err = h.files.rootedFileSystem.RemoveAll(dir); err != nil {
+			h.logger(r).Error("Failed to remove expired multipart upload", slog.String("dir", dir), slog.Any("error", err))
+		}
+	}
+}
+
+func (h *S3Handler) uploadPart(w http.ResponseWriter, r *http.Request, bucket, key string, body io.Reader) {
+	dir, ok := h.multipartUploadDir(r.URL.Query().Get("uploadId"), bucket, key)
+	if !ok {
+		h.writeError(w, r, s3ErrNoSuchUpload)
+		return
+	}
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > s3MaxPartNumber {
+		h.writeError(w, r, s3ErrInvalidPartNum)
+		return
+	}
+	if r.ContentLength > h.MaxPartSize {
+		h.writeError(w, r, s3ErrEntityTooLarge)
+		return
+	}
+	body = http.MaxBytesReader(w, io.NopCloser(body), h.MaxPartSize)
+	hash := md5.New()
+	name := path.Join(dir, strconv.Itoa(partNumber))
+	if _, err = h.files.writeFile(name, io.TeeReader(auditBody(r, body), hash)); err != nil {
+		h.writeWriteError(w, r, name, err)
+		return
+	}
+	w.Header().Set("ETag", `"`+hex.EncodeToString(hash.Sum(nil))+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+type s3CompleteMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Bucket  string   `xml:"Bucket"`
+	Key     string   `xml:"Key"`
+	ETag    string   `xml:"ETag"`
+}
+
+func (h *S3Handler) completeMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string, body io.Reader) {
+	dir, ok := h.multipartUploadDir(r.URL.Query().Get("uploadId"), bucket, key)
+	if !ok {
+		h.writeError(w, r, s3ErrNoSuchUpload)
+		return
+	}
+	var req s3CompleteMultipartUpload
+	if err := xml.NewDecoder(io.LimitReader(body, 2<<20)).Decode(&req); err != nil || len(req.Parts) == 0 {
+		h.writeError(w, r, s3ErrMalformedXML)
+		return
+	}
+	var parts []io.Reader
+	for i, part := range req.Parts {
+		if i > 0 && part.PartNumber <= req.Parts[i-1].PartNumber {
+			h.writeError(w, r, newS3Error(http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order."))
+			return
+		}
+		f, err := h.files.rootedFileSystem.Open(path.Join(dir, strconv.Itoa(part.PartNumber)))
+		if err != nil {
+			h.writeError(w, r, s3ErrInvalidPart)
+			return
+		}
+		defer f.Close()
+		parts = append(parts, f)
+	}
+	name := bucket + "/" + key
+	if _, err := h.files.writeFile(name, auditBody(r, io.MultiReader(parts...))); err != nil {
+		h.writeWriteError(w, r, name, err)
+		return
+	}
+	if err := h.files.rootedFileSystem.RemoveAll(dir); err != nil {
+		h.logger(r).Error("Failed to remove multipart upload", slog.String("dir", dir), slog.Any("error", err))
+	}
+	result := s3CompleteMultipartUploadResult{Xmlns: s3Namespace, Bucket: bucket, Key: key}
+	if fi, err := h.files.rootedFileSystem.Stat(name); err == nil {
+		result.ETag = etag(fi)
+	}
+	h.writeXML(w, r, result)
+}
+
+func (h *S3Handler) abortMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	dir, ok := h.multipartUploadDir(r.URL.Query().Get("uploadId"), bucket, key)
+	if !ok {
+		h.writeError(w, r, s3ErrNoSuchUpload)
+		return
+	}
+	if err := h.files.rootedFileSystem.RemoveAll(dir); err != nil {
+		h.logger(r).Error("Failed to remove multipart upload", slog.String("dir", dir), slog.Any("error", err))
+		h.writeError(w, r, s3ErrInternalError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func s3Time(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// s3URLEncode encodes keys when the client requests encoding-type=url, leaving slashes as they
+// are.
+func s3URLEncode(s string) string {
+	return strings.ReplaceAll(url.PathEscape(s), "%2F", "/")
+}
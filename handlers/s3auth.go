@@ -0,0 +1,338 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm           = "AWS4-HMAC-SHA256"
+	sigV4MaxSkew             = 15 * time.Minute
+	sigV4AmzDateFormat       = "20060102T150405Z"
+	unsignedPayload          = "UNSIGNED-PAYLOAD"
+	streamingSignedPayload   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingSignedTrailer   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	// maxAWSChunkSize limits the memory used to verify each chunk of an aws-chunked upload.
+	maxAWSChunkSize = 16 << 20
+	emptySHA256     = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+var (
+	errS3SignatureMismatch = errors.New("the request signature does not match")
+	errS3AccessDenied      = errors.New("access denied")
+	errS3InvalidAccessKey  = errors.New("the access key does not exist")
+	errS3RequestExpired    = errors.New("the request time is too skewed or the presigned URL has expired")
+	errS3ContentSHA256     = errors.New("the content SHA-256 does not match the payload")
+)
+
+// sigV4 holds the access key of a verified AWS Signature Version 4, and the parts that are
+// needed to verify the signatures of an aws-chunked payload.
+type sigV4 struct {
+	accessKey  string
+	signingKey []byte
+	amzDate    string
+	scope      string
+	signature  string
+}
+
+// verifySigV4 checks the AWS Signature Version 4 of the request, from either the Authorization
+// header or presigned URL query parameters.
+func verifySigV4(r *http.Request, credentials map[string]string, now time.Time) (sig sigV4, err error) {
+	query := r.URL.Query()
+	var accessKey, credentialScope, signedHeaders, payloadHash string
+	var expires time.Duration
+	if query.Get("X-Amz-Algorithm") != "" {
+		if query.Get("X-Amz-Algorithm") != sigV4Algorithm {
+			return sig, errS3AccessDenied
+		}
+		accessKey, credentialScope, _ = strings.Cut(query.Get("X-Amz-Credential"), "/")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		sig.signature = query.Get("X-Amz-Signature")
+		sig.amzDate = query.Get("X-Amz-Date")
+		seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || seconds < 0 {
+			return sig, errS3AccessDenied
+		}
+		expires = time.Duration(seconds) * time.Second
+		payloadHash = unsignedPayload
+	} else {
+		algorithm, params, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !ok || algorithm != sigV4Algorithm {
+			return sig, errS3AccessDenied
+		}
+		for param := range strings.SplitSeq(params, ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			switch k {
+			case "Credential":
+				accessKey, credentialScope, _ = strings.Cut(v, "/")
+			case "SignedHeaders":
+				signedHeaders = v
+			case "Signature":
+				sig.signature = v
+			}
+		}
+		sig.amzDate = r.Header.Get("X-Amz-Date")
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			payloadHash = unsignedPayload
+		}
+	}
+
+	secretKey, ok := credentials[accessKey]
+	if !ok || accessKey == "" {
+		return sig, errS3InvalidAccessKey
+	}
+	sig.accessKey = accessKey
+	scopeParts := strings.Split(credentialScope, "/")
+	if len(scopeParts) != 4 || scopeParts[2] != "s3" || scopeParts[3] != "aws4_request" {
+		return sig, errS3AccessDenied
+	}
+	date, region := scopeParts[0], scopeParts[1]
+	signedAt, err := time.Parse(sigV4AmzDateFormat, sig.amzDate)
+	if err != nil || !strings.HasPrefix(sig.amzDate, date) {
+		return sig, errS3AccessDenied
+	}
+	if expires > 0 {
+		if now.Before(signedAt.Add(-sigV4MaxSkew)) || now.After(signedAt.Add(expires)) {
+			return sig, errS3RequestExpired
+		}
+	} else if now.Sub(signedAt).Abs() > sigV4MaxSkew {
+		return sig, errS3RequestExpired
+	}
+
+	headerNames := strings.Split(signedHeaders, ";")
+	if !slices.Contains(headerNames, "host") {
+		return sig, errS3AccessDenied
+	}
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		awsURIEncode(r.URL.Path, false),
+		canonicalQuery(query),
+		canonicalHeaders(r, headerNames),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	sig.scope = credentialScope
+	sig.signingKey = sigV4SigningKey(secretKey, date, region)
+	stringToSign := strings.Join([]string{sigV4Algorithm, sig.amzDate, sig.scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+	expected := hex.EncodeToString(hmacSHA256(sig.signingKey, []byte(stringToSign)))
+	if !hmac.Equal([]byte(expected), []byte(sig.signature)) {
+		return sig, errS3SignatureMismatch
+	}
+	return sig, nil
+}
+
+func sigV4SigningKey(secretKey, date, region string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretKey), []byte(date))
+	key = hmacSHA256(key, []byte(region))
+	key = hmacSHA256(key, []byte("s3"))
+	return hmacSHA256(key, []byte("aws4_request"))
+}
+
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for k, values := range query {
+		if k == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range values {
+			pairs = append(pairs, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func canonicalHeaders(r *http.Request, names []string) string {
+	var sb strings.Builder
+	for _, name := range names {
+		values := slices.Clone(r.Header.Values(name))
+		if name == "host" {
+			values = []string{r.Host}
+		}
+		if name == "content-length" && len(values) == 0 {
+			values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		}
+		for i, v := range values {
+			values[i] = strings.Join(strings.Fields(v), " ")
+		}
+		sb.WriteString(name)
+		sb.WriteByte(':')
+		sb.WriteString(strings.Join(values, ","))
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// awsURIEncode encodes s as described in the AWS Signature Version 4 documentation: every byte
+// except the unreserved characters is percent encoded, and slashes are only encoded if
+// encodeSlash is set.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			sb.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// s3PayloadReader returns a reader for the decoded request body, which verifies the payload
+// against the x-amz-content-sha256 header. If sig is nil, the request was not signed, and
+// aws-chunked payloads are decoded without verifying their chunk signatures.
+func s3PayloadReader(r *http.Request, sig *sigV4) io.Reader {
+	contentSHA256 := r.Header.Get("X-Amz-Content-Sha256")
+	switch contentSHA256 {
+	case "", unsignedPayload:
+		return r.Body
+	case streamingSignedPayload, streamingSignedTrailer:
+		return newAWSChunkedReader(r.Body, sig)
+	case streamingUnsignedTrailer:
+		return newAWSChunkedReader(r.Body, nil)
+	}
+	if sig == nil {
+		return r.Body
+	}
+	return &sha256VerifyingReader{r: r.Body, h: sha256.New(), expected: contentSHA256}
+}
+
+// sha256VerifyingReader returns an error at the end of the stream if the SHA-256 of the data read
+// doesn't match the expected value.
+type sha256VerifyingReader struct {
+	r        io.Reader
+	h        hash.Hash
+	expected string
+}
+
+func (v *sha256VerifyingReader) Read(p []byte) (n int, err error) {
+	n, err = v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.h.Sum(nil)) != v.expected {
+		return n, errS3ContentSHA256
+	}
+	return n, err
+}
+
+// awsChunkedReader decodes the aws-chunked content encoding used by AWS SDKs to stream uploads,
+// verifying the signature of each chunk if the request was signed.
+type awsChunkedReader struct {
+	r             *bufio.Reader
+	sig           *sigV4
+	prevSignature string
+	chunk         []byte
+	done          bool
+}
+
+func newAWSChunkedReader(r io.Reader, sig *sigV4) *awsChunkedReader {
+	cr := &awsChunkedReader{r: bufio.NewReader(r), sig: sig}
+	if sig != nil {
+		cr.prevSignature = sig.signature
+	}
+	return cr
+}
+
+func (cr *awsChunkedReader) Read(p []byte) (n int, err error) {
+	for len(cr.chunk) == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		if err = cr.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, cr.chunk)
+	cr.chunk = cr.chunk[n:]
+	return n, nil
+}
+
+func (cr *awsChunkedReader) readChunk() error {
+	line, err := cr.readLine()
+	if err != nil {
+		return err
+	}
+	sizeHex, ext, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 || size > maxAWSChunkSize {
+		return fmt.Errorf("invalid aws-chunked chunk size %q", sizeHex)
+	}
+	data := make([]byte, size)
+	if _, err = io.ReadFull(cr.r, data); err != nil {
+		return err
+	}
+	if cr.sig != nil {
+		signature, ok := strings.CutPrefix(ext, "chunk-signature=")
+		if !ok {
+			return errS3SignatureMismatch
+		}
+		stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256-PAYLOAD", cr.sig.amzDate, cr.sig.scope, cr.prevSignature, emptySHA256, sha256Hex(data)}, "\n")
+		expected := hex.EncodeToString(hmacSHA256(cr.sig.signingKey, []byte(stringToSign)))
+		if !hmac.Equal([]byte(expected), []byte(signature)) {
+			return errS3SignatureMismatch
+		}
+		cr.prevSignature = signature
+	}
+	if size == 0 {
+		// Skip any trailing headers, up to the terminating empty line.
+		for {
+			line, err := cr.readLine()
+			if err == io.EOF || (err == nil && line == "") {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		cr.done = true
+		return nil
+	}
+	if line, err = cr.readLine(); err != nil || line != "" {
+		return fmt.Errorf("invalid aws-chunked chunk terminator")
+	}
+	cr.chunk = data
+	return nil
+}
+
+func (cr *awsChunkedReader) readLine() (string, error) {
+	line, err := cr.r.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			return "", fmt.Errorf("aws-chunked line too long")
+		}
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return string(bytes.TrimRight(line, "\r\n")), nil
+}
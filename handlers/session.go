@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// LoginPath serves the login form, and accepts it with POST.
+	LoginPath = "/.login"
+	// LogoutPath ends the session with POST.
+	LogoutPath = "/.logout"
+)
+
+const (
+	sessionCookieName = "serve_session"
+	// sessionRefreshInterval is how often the cookie is reissued to record that the session is
+	// still in use, so the idle timeout is accurate to within the interval.
+	sessionRefreshInterval = time.Minute
+	// loginMaxFormSize limits the size of the login form.
+	loginMaxFormSize = 64 << 10
+)
+
+var (
+	errSessionInvalid = errors.New("invalid session")
+	errSessionExpired = errors.New("session has expired")
+)
+
+//go:embed login.html
+var loginTemplateText string
+
+var loginTemplate = template.Must(template.New("login").Parse(loginTemplateText))
+
+type loginData struct {
+	Username string
+	Next     string
+	Error    string
+}
+
+// NewSessions creates sessions that are stored in cookies signed with the key, so they survive
+// restarts of the server if the key is the same. Sessions end after the idleTimeout without
+// requests, and after the maxAge regardless of use.
+func NewSessions(key []byte, idleTimeout, maxAge time.Duration) *Sessions {
+	return &Sessions{
+		key:         key,
+		idleTimeout: idleTimeout,
+		maxAge:      maxAge,
+		now:         time.Now,
+		revoked:     make(map[string]time.Time),
+	}
+}
+
+type Sessions struct {
+	key         []byte
+	idleTimeout time.Duration
+	maxAge      time.Duration
+	now         func() time.Time
+
+	// revoked holds the IDs of sessions that were logged out until they expire, since the
+	// cookie may have been copied before it was cleared from the browser.
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+type session struct {
+	ID       string `json:"id"`
+	User     string `json:"user"`
+	Created  int64  `json:"created"`
+	LastSeen int64  `json:"last_seen"`
+}
+
+func (s *Sessions) create(user string) session {
+	now := s.now().Unix()
+	return session{
+		ID:       rand.Text(),
+		User:     user,
+		Created:  now,
+		LastSeen: now,
+	}
+}
+
+// encode returns the base64 encoded session and its signature, separated by a dot.
+func (s *Sessions) encode(sess session) string {
+	payload, _ := json.Marshal(sess)
+	value := base64.RawURLEncoding.EncodeToString(payload)
+	return value + "." + s.sign(value)
+}
+
+func (s *Sessions) sign(value string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Sessions) decode(cookie string) (sess session, err error) {
+	value, signature, ok := strings.Cut(cookie, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.sign(value))) {
+		return sess, errSessionInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return sess, errSessionInvalid
+	}
+	if err = json.Unmarshal(payload, &sess); err != nil || sess.ID == "" || sess.User == "" {
+		return sess, errSessionInvalid
+	}
+	now := s.now()
+	if now.Sub(time.Unix(sess.Created, 0)) > s.maxAge || now.Sub(time.Unix(sess.LastSeen, 0)) > s.idleTimeout {
+		return sess, errSessionExpired
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, revoked := s.revoked[sess.ID]; revoked {
+		return sess, errSessionExpired
+	}
+	return sess, nil
+}
+
+func (s *Sessions) revoke(sess session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for id, expires := range s.revoked {
+		if now.After(expires) {
+			delete(s.revoked, id)
+		}
+	}
+	s.revoked[sess.ID] = time.Unix(sess.Created, 0).Add(s.maxAge)
+}
+
+func (s *Sessions) setCookie(w http.ResponseWriter, r *http.Request, sess session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    s.encode(sess),
+		Path:     "/",
+		Expires:  time.Unix(sess.Created, 0).Add(s.maxAge),
+		Secure:   isHTTPS(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   isHTTPS(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// NewSessionMiddleware serves a login form at LoginPath that checks usernames and passwords with
+// the verifier and starts a session stored in a cookie, for browsers. Requests with a valid
+// session cookie are passed to next, and others to the Fallback, e.g. a BasicAuthMiddleware.
+// Browsers that request a page without credentials are redirected to the login form.
+//
+// State changing requests of sessions are rejected if they come from another origin, to prevent
+// cross-site request forgery.
+func NewSessionMiddleware(log *slog.Logger, next http.Handler, verifier PasswordVerifier, sessions *Sessions) *SessionMiddleware {
+	csrf := http.NewCrossOriginProtection()
+	csrf.SetDenyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		LoggerFromContext(r.Context(), log).Warn("Cross-origin request denied", slog.String("method", r.Method), slog.String("url", redactURL(r.URL)), slog.String("origin", r.Header.Get("Origin")))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}))
+	return &SessionMiddleware{
+		log:      log,
+		next:     csrf.Handler(next),
+		verifier: verifier,
+		sessions: sessions,
+		csrf:     csrf,
+	}
+}
+
+type SessionMiddleware struct {
+	log      *slog.Logger
+	next     http.Handler
+	verifier PasswordVerifier
+	sessions *Sessions
+	csrf     *http.CrossOriginProtection
+	// Fallback handles requests without a session.
+	Fallback http.Handler
+	// AllowAnonymous passes browsers without a session to the Fallback instead of redirecting
+	// them to the login form, so that they can see what anonymous users are allowed to.
+	AllowAnonymous bool
+	// Throttle slows down password guessing, no throttling if nil. It can be shared with a
+	// BasicAuthMiddleware so that failures of both count together.
+	Throttle *Throttle
+}
+
+func (m *SessionMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case LoginPath:
+		m.login(w, r)
+		return
+	case LogoutPath:
+		m.logout(w, r)
+		return
+	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		sess, err := m.sessions.decode(cookie.Value)
+		if err == nil {
+			if m.sessions.now().Sub(time.Unix(sess.LastSeen, 0)) >= sessionRefreshInterval {
+				sess.LastSeen = m.sessions.now().Unix()
+				m.sessions.setCookie(w, r, sess)
+			}
+			m.next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), &Identity{Name: sess.User, Method: "session"})))
+			return
+		}
+		clearSessionCookie(w, r)
+	}
+	if !m.AllowAnonymous && isBrowserNavigation(r) {
+		http.Redirect(w, r, LoginPath+"?"+url.Values{"next": {r.URL.RequestURI()}}.Encode(), http.StatusSeeOther)
+		return
+	}
+	m.Fallback.ServeHTTP(w, r)
+}
+
+// isBrowserNavigation returns true if the request is for a page that a browser will display,
+// without credentials.
+func isBrowserNavigation(r *http.Request) bool {
+	return r.Method == http.MethodGet &&
+		r.Header.Get("Authorization") == "" &&
+		strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func (m *SessionMiddleware) login(w http.ResponseWriter, r *http.Request) {
+	data := loginData{Next: loginRedirect(r.URL.Query().Get("next"))}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		m.renderLogin(w, r, http.StatusOK, data)
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := m.csrf.Check(r); err != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, loginMaxFormSize)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	data.Username = r.PostForm.Get("username")
+	data.Next = loginRedirect(r.PostForm.Get("next"))
+	ip := ClientIP(r).String()
+	if m.Throttle != nil {
+		if wait := m.Throttle.Wait(ip, data.Username); wait > 0 {
+			w.Header().Set("Retry-After", retryAfter(wait))
+			data.Error = "Too many failed login attempts, try again later."
+			m.renderLogin(w, r, http.StatusTooManyRequests, data)
+			return
+		}
+	}
+	if data.Username == "" || !m.verifier.Verify(data.Username, r.PostForm.Get("password")) {
+		if m.Throttle != nil {
+			m.Throttle.Fail(ip, data.Username)
+		}
+		m.logger(r).Warn("Login failed", slog.String("user", data.Username), slog.String("client_ip", ip))
+		data.Error = "Invalid username or password."
+		m.renderLogin(w, r, http.StatusUnauthorized, data)
+		return
+	}
+	if m.Throttle != nil {
+		m.Throttle.Succeed(data.Username)
+	}
+	m.logger(r).Info("Logged in", slog.String("user", data.Username), slog.String("client_ip", ip))
+	m.sessions.setCookie(w, r, m.sessions.create(data.Username))
+	http.Redirect(w, r, data.Next, http.StatusSeeOther)
+}
+
+func (m *SessionMiddleware) logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := m.csrf.Check(r); err != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		if sess, err := m.sessions.decode(cookie.Value); err == nil {
+			m.sessions.revoke(sess)
+			m.logger(r).Info("Logged out", slog.String("user", sess.User), slog.String("client_ip", ClientIP(r).String()))
+		}
+	}
+	clearSessionCookie(w, r)
+	http.Redirect(w, r, LoginPath, http.StatusSeeOther)
+}
+
+func (m *SessionMiddleware) logger(r *http.Request) *slog.Logger {
+	return LoggerFromContext(r.Context(), m.log)
+}
+
+func (m *SessionMiddleware) renderLogin(w http.ResponseWriter, r *http.Request, status int, data loginData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	if err := loginTemplate.Execute(w, data); err != nil {
+		m.logger(r).Error("Failed to render login form", slog.Any("error", err))
+	}
+}
+
+// loginRedirect returns the path to redirect to after logging in, which must be on this server.
+func loginRedirect(next string) string {
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || !strings.HasPrefix(u.Path, "/") ||
+		strings.HasPrefix(next, "//") || strings.Contains(next, `\`) || u.Path == LoginPath || u.Path == LogoutPath {
+		return "/"
+	}
+	return next
+}
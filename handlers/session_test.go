@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionMiddleware(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	sessions := NewSessions([]byte("0123456789abcdef0123456789abcdef"), 30*time.Minute, 12*time.Hour)
+	sessions.now = func() time.Time { return now }
+	var id *Identity
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id = IdentityFromContext(r.Context())
+	})
+	m := NewSessionMiddleware(slog.New(slog.DiscardHandler), next, staticPassword{username: "admin", password: "secret"}, sessions)
+	m.Fallback = NewBasicAuthMiddleware(next, "admin", "secret")
+
+	login := func(username, password, next string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {username}, "password": {password}, "next": {next}}
+		req := httptest.NewRequest(http.MethodPost, LoginPath, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, req)
+		return w
+	}
+	sessionCookie := func(w *httptest.ResponseRecorder) *http.Cookie {
+		for _, c := range w.Result().Cookies() {
+			if c.Name == sessionCookieName {
+				return c
+			}
+		}
+		return nil
+	}
+	request := func(method, target string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		id = nil
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Accept", "text/html")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("browsers without a session are redirected to the login form", func(t *testing.T) {
+		w := request(http.MethodGet, "/docs/?sort=size", nil)
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("Expected status 303, got %d", w.Code)
+		}
+		if location := w.Header().Get("Location"); location != "/.login?next=%2Fdocs%2F%3Fsort%3Dsize" {
+			t.Errorf("Unexpected redirect %q", location)
+		}
+		w = request(http.MethodGet, LoginPath, nil)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `name="password"`) {
+			t.Errorf("Expected the login form, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+	t.Run("other clients fall back to basic auth", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth("admin", "secret")
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || id == nil || id.Method != "basic" {
+			t.Errorf("Expected basic auth, got %d and %+v", w.Code, id)
+		}
+	})
+	t.Run("invalid credentials show the form again", func(t *testing.T) {
+		w := login("admin", "wrong", "/")
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected status 401, got %d", w.Code)
+		}
+		if sessionCookie(w) != nil {
+			t.Error("Expected no session cookie")
+		}
+		if !strings.Contains(w.Body.String(), "Invalid username or password") {
+			t.Errorf("Expected an error message, got %s", w.Body.String())
+		}
+	})
+	t.Run("logging in starts a session", func(t *testing.T) {
+		w := login("admin", "secret", "/docs/")
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/docs/" {
+			t.Fatalf("Expected a redirect to /docs/, got %d to %q", w.Code, w.Header().Get("Location"))
+		}
+		cookie := sessionCookie(w)
+		if cookie == nil {
+			t.Fatal("Expected a session cookie")
+		}
+		if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+			t.Errorf("Expected an HttpOnly, SameSite cookie, got %+v", cookie)
+		}
+		w = request(http.MethodGet, "/docs/", cookie)
+		if w.Code != http.StatusOK || id == nil || id.Name != "admin" || id.Method != "session" {
+			t.Errorf("Expected the session user, got %d and %+v", w.Code, id)
+		}
+	})
+	t.Run("cookies are secure behind a trusted proxy that terminates TLS", func(t *testing.T) {
+		trusted, _ := ParsePrefixes("10.0.0.1")
+		proxied := NewClientIPMiddleware(m, trusted)
+		for _, tt := range []struct {
+			remoteAddr string
+			secure     bool
+		}{{"10.0.0.1:1234", true}, {"192.0.2.1:1234", false}} {
+			form := url.Values{"username": {"admin"}, "password": {"secret"}}
+			req := httptest.NewRequest(http.MethodPost, LoginPath, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("X-Forwarded-Proto", "https")
+			req.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+			proxied.ServeHTTP(w, req)
+			if cookie := sessionCookie(w); cookie == nil || cookie.Secure != tt.secure {
+				t.Errorf("Expected a cookie from %s with Secure %v, got %+v", tt.remoteAddr, tt.secure, cookie)
+			}
+		}
+	})
+	t.Run("redirects after logging in stay on the server", func(t *testing.T) {
+		for _, next := range []string{"https://example.com/", "//example.com/", `/\example.com`, "docs"} {
+			w := login("admin", "secret", next)
+			if location := w.Header().Get("Location"); location != "/" {
+				t.Errorf("Expected %q to redirect to /, got %q", next, location)
+			}
+		}
+	})
+	t.Run("tampered cookies are rejected", func(t *testing.T) {
+		cookie := sessionCookie(login("admin", "secret", "/"))
+		other := sessions.create("other")
+		value, _, _ := strings.Cut(sessions.encode(other), ".")
+		_, signature, _ := strings.Cut(cookie.Value, ".")
+		cookie.Value = value + "." + signature
+		if w := request(http.MethodGet, "/", cookie); w.Code != http.StatusSeeOther || id != nil {
+			t.Errorf("Expected a redirect to the login form, got %d and %+v", w.Code, id)
+		}
+	})
+	t.Run("sessions end after the idle timeout", func(t *testing.T) {
+		cookie := sessionCookie(login("admin", "secret", "/"))
+		now = now.Add(20 * time.Minute)
+		w := request(http.MethodGet, "/", cookie)
+		if id == nil {
+			t.Fatal("Expected the session to be valid")
+		}
+		refreshed := sessionCookie(w)
+		if refreshed == nil {
+			t.Fatal("Expected the cookie to be refreshed")
+		}
+		now = now.Add(20 * time.Minute)
+		if request(http.MethodGet, "/", refreshed); id == nil {
+			t.Error("Expected the refreshed session to be valid")
+		}
+		if request(http.MethodGet, "/", cookie); id != nil {
+			t.Error("Expected the idle session to have ended")
+		}
+	})
+	t.Run("sessions end after the maximum age", func(t *testing.T) {
+		cookie := sessionCookie(login("admin", "secret", "/"))
+		for range 25 {
+			now = now.Add(29 * time.Minute)
+			if refreshed := sessionCookie(request(http.MethodGet, "/", cookie)); refreshed != nil {
+				cookie = refreshed
+			}
+		}
+		if id != nil {
+			t.Error("Expected the session to have ended")
+		}
+	})
+	t.Run("logging out ends the session", func(t *testing.T) {
+		cookie := sessionCookie(login("admin", "secret", "/"))
+		w := request(http.MethodPost, LogoutPath, cookie)
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("Expected status 303, got %d", w.Code)
+		}
+		if cleared := sessionCookie(w); cleared == nil || cleared.MaxAge >= 0 {
+			t.Errorf("Expected the cookie to be cleared, got %+v", cleared)
+		}
+		if request(http.MethodGet, "/", cookie); id != nil {
+			t.Error("Expected the copied cookie to be rejected after logging out")
+		}
+	})
+	t.Run("cross-origin requests are rejected", func(t *testing.T) {
+		cookie := sessionCookie(login("admin", "secret", "/"))
+		for _, target := range []string{"/file.txt", LogoutPath, LoginPath} {
+			req := httptest.NewRequest(http.MethodPost, target, nil)
+			req.Header.Set("Sec-Fetch-Site", "cross-site")
+			req.AddCookie(cookie)
+			w := httptest.NewRecorder()
+			m.ServeHTTP(w, req)
+			if w.Code != http.StatusForbidden {
+				t.Errorf("POST %s: expected status 403, got %d", target, w.Code)
+			}
+		}
+		req := httptest.NewRequest(http.MethodPost, "/file.txt", nil)
+		req.Header.Set("Sec-Fetch-Site", "same-origin")
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected same-origin requests to be allowed, got %d", w.Code)
+		}
+	})
+}
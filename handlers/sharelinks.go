@@ -0,0 +1,404 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ShareLinksPath is the URL path that share links are created, listed and revoked at, and
+// downloaded from.
+const ShareLinksPath = "/.shares/"
+
+var errShareLinkNotFound = errors.New("share link not found")
+
+// ShareLink allows anyone with its token to download a file a limited number of times.
+type ShareLink struct {
+	// ID identifies the link to its creator, e.g. to revoke it. It's derived from the hash of
+	// the token, so it can't be used to download the file.
+	ID string `json:"id"`
+	// Hash is the SHA-256 hash of the token. It's stored, but not returned by the API.
+	Hash string `json:"hash,omitempty"`
+	// Path is the URL path of the file, e.g. /docs/report.pdf.
+	Path string `json:"path"`
+	// MaxDownloads is the number of completed downloads after which the link is deleted.
+	MaxDownloads int64     `json:"max_downloads"`
+	Downloads    int64     `json:"downloads"`
+	Expires      time.Time `json:"expires,omitzero"`
+	CreatedBy    string    `json:"created_by"`
+	Created      time.Time `json:"created"`
+	// URL is only returned when the link is created, since the token isn't stored.
+	URL string `json:"url,omitempty"`
+
+	// inProgress is the number of downloads that have started but not completed, which count
+	// towards MaxDownloads so that concurrent downloads can't exceed it.
+	inProgress int64
+}
+
+func (l *ShareLink) expired(now time.Time) bool {
+	return !l.Expires.IsZero() && !now.Before(l.Expires)
+}
+
+// NewShareLinks loads the share links stored in a JSON file, which is created if it doesn't
+// exist. The file should be outside the served directory.
+func NewShareLinks(log *slog.Logger, name string) (*ShareLinks, error) {
+	s := &ShareLinks{
+		log:   log,
+		name:  name,
+		now:   time.Now,
+		links: make(map[string]*ShareLink),
+	}
+	data, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var links []*ShareLink
+	if err = json.Unmarshal(data, &links); err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		s.links[link.Hash] = link
+	}
+	return s, nil
+}
+
+type ShareLinks struct {
+	log  *slog.Logger
+	name string
+	now  func() time.Time
+
+	mu sync.Mutex
+	// links are indexed by the hash of their token.
+	links map[string]*ShareLink
+}
+
+// Create returns a new link with its URL.
+func (s *ShareLinks) Create(urlPath, createdBy string, maxDownloads int64, expires time.Time) (*ShareLink, error) {
+	token := rand.Text()
+	hash := shareLinkHash(token)
+	link := &ShareLink{
+		ID:           hash[:16],
+		Hash:         hash,
+		Path:         urlPath,
+		MaxDownloads: maxDownloads,
+		Expires:      expires,
+		CreatedBy:    createdBy,
+		Created:      s.now().UTC(),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.links[hash] = link
+	if err := s.save(); err != nil {
+		delete(s.links, hash)
+		return nil, err
+	}
+	created := *link
+	created.Hash, created.URL = "", ShareLinksPath+token
+	return &created, nil
+}
+
+// List returns the links created by the user.
+func (s *ShareLinks) List(createdBy string) (links []ShareLink) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for _, link := range s.links {
+		if link.CreatedBy == createdBy && !link.expired(now) {
+			listed := *link
+			listed.Hash = ""
+			links = append(links, listed)
+		}
+	}
+	slices.SortFunc(links, func(a, b ShareLink) int { return a.Created.Compare(b.Created) })
+	return links
+}
+
+// Revoke deletes a link created by the user.
+func (s *ShareLinks) Revoke(id, createdBy string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, link := range s.links {
+		if link.ID == id && link.CreatedBy == createdBy {
+			delete(s.links, hash)
+			return s.save()
+		}
+	}
+	return errShareLinkNotFound
+}
+
+// start reserves a download of the link with the token, returning a copy of the link.
+func (s *ShareLinks) start(token string) (link ShareLink, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hash := shareLinkHash(token)
+	l, ok := s.links[hash]
+	if !ok {
+		return link, errShareLinkNotFound
+	}
+	if l.expired(s.now()) {
+		delete(s.links, hash)
+		return link, errors.Join(errShareLinkNotFound, s.save())
+	}
+	if l.Downloads+l.inProgress >= l.MaxDownloads {
+		return link, errShareLinkNotFound
+	}
+	l.inProgress++
+	return *l, nil
+}
+
+// finish releases the reservation of a download, counting it if it completed, and deleting the
+// link once it's been downloaded the maximum number of times.
+func (s *ShareLinks) finish(hash string, completed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.links[hash]
+	if !ok {
+		return
+	}
+	l.inProgress--
+	if !completed {
+		return
+	}
+	l.Downloads++
+	if l.Downloads >= l.MaxDownloads {
+		delete(s.links, hash)
+		s.log.Info("Share link used up", slog.String("id", l.ID), slog.String("path", l.Path), slog.Int64("downloads", l.Downloads))
+	}
+	if err := s.save(); err != nil {
+		s.log.Error("Failed to save share links", slog.String("path", s.name), slog.Any("error", err))
+	}
+}
+
+// save writes the links to the file. It must be called with the mutex held.
+func (s *ShareLinks) save() error {
+	links := make([]*ShareLink, 0, len(s.links))
+	for _, link := range s.links {
+		links = append(links, link)
+	}
+	slices.SortFunc(links, func(a, b *ShareLink) int { return a.Created.Compare(b.Created) })
+	data, err := json.MarshalIndent(links, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.name), filepath.Base(s.name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.name)
+}
+
+func shareLinkHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// ServeShareLinks creates, lists and revokes the share links of the authenticated user:
+//
+//	POST /.shares/ {"path": "/docs/report.pdf", "max_downloads": 1, "expires_in": "24h"}
+//	GET /.shares/
+//	DELETE /.shares/<id>
+func (h *FileHandler) ServeShareLinks(w http.ResponseWriter, r *http.Request) {
+	id := IdentityFromContext(r.Context())
+	if id == nil {
+		deny(w, r)
+		return
+	}
+	linkID := strings.TrimPrefix(r.URL.Path, ShareLinksPath)
+	switch {
+	case linkID == "" && r.Method == http.MethodPost:
+		h.createShareLink(w, r, id)
+	case linkID == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		writeJSON(w, http.StatusOK, h.ShareLinks.List(id.Name))
+	case linkID != "" && r.Method == http.MethodDelete:
+		err := h.ShareLinks.Revoke(linkID, id.Name)
+		if errors.Is(err, errShareLinkNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			h.logger(r).Error("Failed to revoke share link", slog.String("id", linkID), slog.Any("error", err))
+			http.Error(w, "failed to revoke share link", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *FileHandler) createShareLink(w http.ResponseWriter, r *http.Request, id *Identity) {
+	var req struct {
+		Path         string `json:"path"`
+		MaxDownloads int64  `json:"max_downloads"`
+		ExpiresIn    string `json:"expires_in"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.MaxDownloads == 0 {
+		req.MaxDownloads = 1
+	}
+	if req.MaxDownloads < 0 {
+		http.Error(w, "max_downloads must be positive", http.StatusBadRequest)
+		return
+	}
+	var expires time.Time
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			http.Error(w, "expires_in must be a positive duration, e.g. 24h", http.StatusBadRequest)
+			return
+		}
+		expires = time.Now().Add(d).UTC()
+	}
+	cleaned := strings.TrimPrefix(path.Clean("/"+req.Path), "/")
+	if cleaned == "" || h.isHidden(cleaned) {
+		http.Error(w, "path must be a file", http.StatusBadRequest)
+		return
+	}
+	// Only files that the user can read can be shared.
+	if !h.authorize(w, r, cleaned, PermissionRead) {
+		return
+	}
+	fi, err := fs.Stat(h.readFS(), cleaned)
+	if err != nil || !fi.Mode().IsRegular() {
+		http.Error(w, "path must be a file", http.StatusBadRequest)
+		return
+	}
+	link, err := h.ShareLinks.Create("/"+cleaned, id.Name, req.MaxDownloads, expires)
+	if err != nil {
+		h.logger(r).Error("Failed to create share link", slog.String("path", cleaned), slog.Any("error", err))
+		http.Error(w, "failed to create share link", http.StatusInternalServerError)
+		return
+	}
+	h.logger(r).Info("Created share link", slog.String("id", link.ID), slog.String("path", link.Path), slog.String("user", id.Name), slog.Int64("max_downloads", link.MaxDownloads))
+	writeJSON(w, http.StatusCreated, link)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// NewShareLinkMiddleware serves downloads of share links, at ShareLinksPath<token>, without
+// other credentials, passing all other requests to the Fallback, e.g. a BasicAuthMiddleware, or
+// to next if there isn't one.
+func NewShareLinkMiddleware(next http.Handler, links *ShareLinks) *ShareLinkMiddleware {
+	return &ShareLinkMiddleware{
+		next:  next,
+		links: links,
+	}
+}
+
+type ShareLinkMiddleware struct {
+	next     http.Handler
+	links    *ShareLinks
+	Fallback http.Handler
+}
+
+func (m *ShareLinkMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.URL.Path, ShareLinksPath)
+	if !ok || token == "" || strings.Contains(token, "/") || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		if m.Fallback != nil {
+			m.Fallback.ServeHTTP(w, r)
+			return
+		}
+		m.next.ServeHTTP(w, r)
+		return
+	}
+	link, err := m.links.start(token)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	// Serve the file as the creator of the link, limited to reading it.
+	id := &Identity{
+		Name:   link.CreatedBy,
+		Method: "share-link",
+		Scope:  &Scope{Permissions: PermissionRead, Prefixes: []string{link.Path}},
+	}
+	// The request is cloned before it's rewritten, so that the logging middleware still sees the
+	// original request.
+	r = r.Clone(WithIdentity(r.Context(), id))
+	r.URL.Path, r.URL.RawPath, r.URL.RawQuery = link.Path, "", ""
+	// Only complete downloads are counted, so partial downloads aren't allowed.
+	r.Header.Del("Range")
+	r.Header.Del("If-Range")
+	w.Header().Set("Cache-Control", "no-store")
+	cw := &countingResponseWriter{ResponseWriter: w}
+	m.next.ServeHTTP(cw, r)
+	completed := r.Method == http.MethodGet && cw.status == http.StatusOK && cw.written == cw.contentLength()
+	m.links.finish(link.Hash, completed)
+}
+
+// countingResponseWriter records the status and the number of bytes written, so that complete
+// responses can be detected.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *countingResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *countingResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := readFrom(w.ResponseWriter, src)
+	w.written += n
+	return n, err
+}
+
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *countingResponseWriter) contentLength() int64 {
+	n, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
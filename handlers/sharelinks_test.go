@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestShareLinks(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "report.txt"), []byte("report"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "docs"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	log := slog.New(slog.DiscardHandler)
+	storeName := filepath.Join(t.TempDir(), "shares.json")
+	links, err := NewShareLinks(log, storeName)
+	if err != nil {
+		t.Fatalf("Failed to create share links: %v", err)
+	}
+	fh, closer, err := NewFileHandler(log, dir, false)
+	if err != nil {
+		t.Fatalf("Failed to create FileHandler: %v", err)
+	}
+	defer closer()
+	fh.ShareLinks = links
+	handler := NewShareLinkMiddleware(fh, links)
+	handler.Fallback = NewBasicAuthMiddleware(fh, "admin", "secret")
+
+	serve := func(method, target, body string, authenticated bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if authenticated {
+			req.SetBasicAuth("admin", "secret")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	create := func(body string) (link ShareLink) {
+		w := serve(http.MethodPost, ShareLinksPath, body, true)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &link); err != nil {
+			t.Fatalf("Failed to decode share link: %v", err)
+		}
+		return link
+	}
+
+	t.Run("Links are downloaded the maximum number of times", func(t *testing.T) {
+		link := create(`{"path": "/report.txt", "max_downloads": 2}`)
+		if link.Hash != "" {
+			t.Error("Expected the hash not to be returned")
+		}
+		for range 2 {
+			if w := serve(http.MethodGet, link.URL, "", false); w.Code != http.StatusOK || w.Body.String() != "report" {
+				t.Errorf("Expected status 200 with the file, got %d: %s", w.Code, w.Body.String())
+			}
+		}
+		if w := serve(http.MethodGet, link.URL, "", false); w.Code != http.StatusNotFound {
+			t.Errorf("Expected status 404 once used up, got %d", w.Code)
+		}
+	})
+	t.Run("HEAD requests aren't counted and ranges are ignored", func(t *testing.T) {
+		link := create(`{"path": "/report.txt"}`)
+		if w := serve(http.MethodHead, link.URL, "", false); w.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", w.Code)
+		}
+		req := httptest.NewRequest(http.MethodGet, link.URL, nil)
+		req.Header.Set("Range", "bytes=0-1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || w.Body.String() != "report" {
+			t.Errorf("Expected the range to be ignored, got %d: %s", w.Code, w.Body.String())
+		}
+		if w := serve(http.MethodGet, link.URL, "", false); w.Code != http.StatusNotFound {
+			t.Errorf("Expected status 404 once used up, got %d", w.Code)
+		}
+	})
+	t.Run("Tokens are redacted in logs, and the request isn't modified", func(t *testing.T) {
+		link := create(`{"path": "/report.txt"}`)
+		token := strings.TrimPrefix(link.URL, ShareLinksPath)
+		var logs, accessLog bytes.Buffer
+		m := NewLoggingMiddleware(slog.New(slog.NewTextHandler(&logs, nil)), false, handler)
+		m.AccessLog, _ = NewAccessLog(&accessLog, "{{.Method}} {{.URL}}")
+		req := httptest.NewRequest(http.MethodGet, link.URL, nil)
+		req.Header.Set("Range", "bytes=0-1")
+		m.ServeHTTP(httptest.NewRecorder(), req)
+		if req.URL.Path != link.URL || req.Header.Get("Range") == "" {
+			t.Errorf("Expected the request not to be modified, got %s with Range %q", req.URL.Path, req.Header.Get("Range"))
+		}
+		if strings.Contains(logs.String(), token) || strings.Contains(accessLog.String(), token) {
+			t.Errorf("Expected the token to be redacted, got %q and %q", logs.String(), accessLog.String())
+		}
+		if expected := "GET " + ShareLinksPath + "REDACTED\n"; accessLog.String() != expected {
+			t.Errorf("Expected access log %q, got %q", expected, accessLog.String())
+		}
+	})
+	t.Run("Concurrent downloads can't exceed the maximum", func(t *testing.T) {
+		link := create(`{"path": "/report.txt", "max_downloads": 3}`)
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var ok int
+		for range 10 {
+			wg.Go(func() {
+				if w := serve(http.MethodGet, link.URL, "", false); w.Code == http.StatusOK {
+					mu.Lock()
+					ok++
+					mu.Unlock()
+				}
+			})
+		}
+		wg.Wait()
+		if ok != 3 {
+			t.Errorf("Expected 3 downloads, got %d", ok)
+		}
+	})
+	t.Run("Links are listed, persisted and revoked", func(t *testing.T) {
+		link := create(`{"path": "/report.txt", "max_downloads": 5, "expires_in": "1h"}`)
+		w := serve(http.MethodGet, ShareLinksPath, "", true)
+		var listed []ShareLink
+		if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+			t.Fatalf("Failed to decode share links: %v", err)
+		}
+		if len(listed) != 1 || listed[0].ID != link.ID || listed[0].URL != "" {
+			t.Errorf("Expected the link to be listed without its URL, got %+v", listed)
+		}
+
+		reloaded, err := NewShareLinks(log, storeName)
+		if err != nil {
+			t.Fatalf("Failed to reload share links: %v", err)
+		}
+		if len(reloaded.List("admin")) != 1 {
+			t.Error("Expected the link to be persisted")
+		}
+		data, err := os.ReadFile(storeName)
+		if err != nil {
+			t.Fatalf("Failed to read store: %v", err)
+		}
+		if strings.Contains(string(data), strings.TrimPrefix(link.URL, ShareLinksPath)) {
+			t.Error("Expected the token not to be stored")
+		}
+
+		if w := serve(http.MethodDelete, ShareLinksPath+link.ID, "", true); w.Code != http.StatusNoContent {
+			t.Errorf("Expected status 204, got %d", w.Code)
+		}
+		if w := serve(http.MethodGet, link.URL, "", false); w.Code != http.StatusNotFound {
+			t.Errorf("Expected status 404 once revoked, got %d", w.Code)
+		}
+	})
+	t.Run("Creating links requires authentication", func(t *testing.T) {
+		if w := serve(http.MethodPost, ShareLinksPath, `{"path": "/report.txt"}`, false); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d", w.Code)
+		}
+	})
+	t.Run("Only files can be shared", func(t *testing.T) {
+		for _, body := range []string{`{"path": "/docs"}`, `{"path": "/missing.txt"}`, `{"path": "/"}`, `{"path": "/.serve/tmp"}`, `{"path": "/report.txt", "expires_in": "-1h"}`} {
+			if w := serve(http.MethodPost, ShareLinksPath, body, true); w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status 400, got %d", body, w.Code)
+			}
+		}
+	})
+	t.Run("Unknown tokens return 404", func(t *testing.T) {
+		if w := serve(http.MethodGet, ShareLinksPath+"unknown", "", false); w.Code != http.StatusNotFound {
+			t.Errorf("Expected status 404, got %d", w.Code)
+		}
+	})
+}
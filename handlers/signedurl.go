@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Query parameters of signed URLs. They're prefixed so they don't clash with the parameters used
+// by the FileHandler, e.g. archive and extract, which are also covered by the signature.
+const (
+	signedURLExpires   = "serve-expires"
+	signedURLMaxSize   = "serve-max-size"
+	signedURLIP        = "serve-ip"
+	signedURLUser      = "serve-user"
+	signedURLSignature = "serve-signature"
+)
+
+// signedURLDefaultUser is the name of the identity of signed URLs that don't specify a user.
+const signedURLDefaultUser = "signed-url"
+
+var (
+	errSignedURLInvalid = errors.New("invalid signature")
+	errSignedURLExpired = errors.New("signed URL has expired")
+	errSignedURLIP      = errors.New("signed URL can't be used from this IP address")
+	errSignedURLMethod  = errors.New("signed URL can't be used with this method")
+)
+
+// SignURLOptions limit what a signed URL can be used for.
+type SignURLOptions struct {
+	// Method is GET to download, which also allows HEAD, or PUT or POST to upload.
+	Method  string
+	Expires time.Time
+	// MaxSize limits the size of uploads in bytes, 0 for no limit.
+	MaxSize int64
+	// IP limits the URL to clients with the IP address.
+	IP string
+	// User is the identity used for access control, signed-url if not set.
+	User string
+}
+
+// SignURL returns a copy of u that can be used without credentials until it expires, by servers
+// with the same key. The path, method and query parameters of u are covered by the signature.
+func SignURL(key []byte, u *url.URL, opts SignURLOptions) (*url.URL, error) {
+	if signedURLPermission(opts.Method) == 0 {
+		return nil, fmt.Errorf("%w: %s, must be GET, PUT or POST", errSignedURLMethod, opts.Method)
+	}
+	if _, err := netip.ParseAddr(opts.IP); opts.IP != "" && err != nil {
+		return nil, fmt.Errorf("invalid IP address %q", opts.IP)
+	}
+	signed := *u
+	query := u.Query()
+	query.Del(signedURLSignature)
+	query.Set(signedURLExpires, strconv.FormatInt(opts.Expires.Unix(), 10))
+	if opts.MaxSize > 0 {
+		query.Set(signedURLMaxSize, strconv.FormatInt(opts.MaxSize, 10))
+	}
+	if opts.IP != "" {
+		query.Set(signedURLIP, opts.IP)
+	}
+	if opts.User != "" {
+		query.Set(signedURLUser, opts.User)
+	}
+	query.Set(signedURLSignature, signURL(key, opts.Method, u.Path, query))
+	signed.RawQuery = query.Encode()
+	return &signed, nil
+}
+
+// signURL returns the signature of the method, path and query, excluding the signature itself.
+func signURL(key []byte, method, urlPath string, query url.Values) string {
+	unsigned := url.Values{}
+	for k, v := range query {
+		if k != signedURLSignature {
+			unsigned[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s", method, urlPath, unsigned.Encode())
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signedURLPermission(method string) Permission {
+	switch method {
+	case http.MethodGet:
+		return PermissionRead
+	case http.MethodPut, http.MethodPost:
+		return PermissionWrite
+	}
+	return 0
+}
+
+// NewSignedURLMiddleware allows requests with a valid URL signature through without other
+// credentials, scoped to the signed path and method. Requests without a signature are passed to
+// the Fallback, e.g. a BasicAuthMiddleware, or to next if there isn't one.
+func NewSignedURLMiddleware(next http.Handler, key []byte) *SignedURLMiddleware {
+	return &SignedURLMiddleware{
+		next: next,
+		key:  key,
+	}
+}
+
+type SignedURLMiddleware struct {
+	next     http.Handler
+	key      []byte
+	Fallback http.Handler
+
+	now func() time.Time
+}
+
+func (m *SignedURLMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !r.URL.Query().Has(signedURLSignature) {
+		if m.Fallback != nil {
+			m.Fallback.ServeHTTP(w, r)
+			return
+		}
+		m.next.ServeHTTP(w, r)
+		return
+	}
+	id, maxSize, err := m.verify(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if maxSize > 0 {
+		if r.ContentLength > maxSize {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	}
+	m.next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), id)))
+}
+
+func (m *SignedURLMiddleware) verify(r *http.Request) (id *Identity, maxSize int64, err error) {
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	perm := signedURLPermission(method)
+	if perm == 0 {
+		return nil, 0, errSignedURLMethod
+	}
+	query := r.URL.Query()
+	expected := signURL(m.key, method, r.URL.Path, query)
+	if !hmac.Equal([]byte(query.Get(signedURLSignature)), []byte(expected)) {
+		return nil, 0, errSignedURLInvalid
+	}
+	expires, err := strconv.ParseInt(query.Get(signedURLExpires), 10, 64)
+	if err != nil {
+		return nil, 0, errSignedURLInvalid
+	}
+	now := time.Now
+	if m.now != nil {
+		now = m.now
+	}
+	if !now().Before(time.Unix(expires, 0)) {
+		return nil, 0, errSignedURLExpired
+	}
+	if ip := query.Get(signedURLIP); ip != "" {
+		if addr, err := netip.ParseAddr(ip); err != nil || addr.Unmap() != ClientIP(r) {
+			return nil, 0, errSignedURLIP
+		}
+	}
+	if size := query.Get(signedURLMaxSize); size != "" {
+		if maxSize, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return nil, 0, errSignedURLInvalid
+		}
+	}
+	id = &Identity{
+		Name:   query.Get(signedURLUser),
+		Method: "signed-url",
+		Scope:  &Scope{Permissions: perm, Prefixes: []string{r.URL.Path}},
+	}
+	if id.Name == "" {
+		id.Name = signedURLDefaultUser
+	}
+	return id, maxSize, nil
+}
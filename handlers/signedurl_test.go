@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedURLMiddleware(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "report.txt"), []byte("report"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	fh, closer, err := NewFileHandler(slog.New(slog.DiscardHandler), dir, false)
+	if err != nil {
+		t.Fatalf("Failed to create FileHandler: %v", err)
+	}
+	defer closer()
+	key := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	handler := NewSignedURLMiddleware(fh, key)
+	handler.Fallback = NewBasicAuthMiddleware(fh, "admin", "secret")
+	handler.now = func() time.Time { return now }
+
+	signed := func(target string, opts SignURLOptions) string {
+		u, err := url.Parse(target)
+		if err != nil {
+			t.Fatalf("Failed to parse URL: %v", err)
+		}
+		if opts.Expires.IsZero() {
+			opts.Expires = now.Add(time.Hour)
+		}
+		signed, err := SignURL(key, u, opts)
+		if err != nil {
+			t.Fatalf("Failed to sign URL: %v", err)
+		}
+		return signed.String()
+	}
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Signed downloads don't need credentials", func(t *testing.T) {
+		target := signed("/report.txt", SignURLOptions{Method: http.MethodGet})
+		if w := serve(http.MethodGet, target, ""); w.Code != http.StatusOK || w.Body.String() != "report" {
+			t.Errorf("Expected status 200 with the file, got %d: %s", w.Code, w.Body.String())
+		}
+		if w := serve(http.MethodHead, target, ""); w.Code != http.StatusOK {
+			t.Errorf("Expected status 200 for HEAD, got %d", w.Code)
+		}
+	})
+	t.Run("Signed uploads don't need credentials", func(t *testing.T) {
+		target := signed("/upload.txt", SignURLOptions{Method: http.MethodPut, MaxSize: 10})
+		if w := serve(http.MethodPut, target, "uploaded"); w.Code != http.StatusCreated {
+			t.Errorf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+		}
+		if w := serve(http.MethodPut, target, "more than ten bytes"); w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status 413, got %d", w.Code)
+		}
+	})
+	t.Run("Invalid signed URLs are rejected", func(t *testing.T) {
+		download := signed("/report.txt", SignURLOptions{Method: http.MethodGet})
+		tests := []struct {
+			name   string
+			method string
+			target string
+		}{
+			{name: "other path", method: http.MethodGet, target: strings.Replace(download, "report", "secret", 1)},
+			{name: "other method", method: http.MethodPut, target: download},
+			{name: "added parameter", method: http.MethodGet, target: download + "&archive=zip"},
+			{name: "expired", method: http.MethodGet, target: signed("/report.txt", SignURLOptions{Method: http.MethodGet, Expires: now.Add(-time.Second)})},
+			{name: "other IP", method: http.MethodGet, target: signed("/report.txt", SignURLOptions{Method: http.MethodGet, IP: "192.0.2.2"})},
+			{name: "delete", method: http.MethodDelete, target: download},
+		}
+		for _, tt := range tests {
+			if w := serve(tt.method, tt.target, ""); w.Code != http.StatusForbidden {
+				t.Errorf("%s: expected status 403, got %d", tt.name, w.Code)
+			}
+		}
+		if w := serve(http.MethodGet, signed("/report.txt", SignURLOptions{Method: http.MethodGet, IP: "192.0.2.1"}), ""); w.Code != http.StatusOK {
+			t.Errorf("Expected status 200 from the signed IP, got %d", w.Code)
+		}
+	})
+	t.Run("Requests without a signature use the fallback", func(t *testing.T) {
+		if w := serve(http.MethodGet, "/report.txt", ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d", w.Code)
+		}
+	})
+	t.Run("Only GET, PUT and POST URLs can be signed", func(t *testing.T) {
+		if _, err := SignURL(key, &url.URL{Path: "/report.txt"}, SignURLOptions{Method: http.MethodDelete}); err == nil {
+			t.Error("Expected an error")
+		}
+	})
+}
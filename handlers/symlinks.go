@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// SymlinkPolicy controls how symlinks within the served directory are treated.
+type SymlinkPolicy string
+
+const (
+	// SymlinksDeny treats symlinks as if they don't exist, and rejects writes through them.
+	SymlinksDeny SymlinkPolicy = "deny"
+	// SymlinksWithinRoot follows symlinks, as long as they point within the served directory.
+	SymlinksWithinRoot SymlinkPolicy = "within-root"
+	// SymlinksFollow follows symlinks for reads, wherever they point. Writes are always kept
+	// within the served directory.
+	SymlinksFollow SymlinkPolicy = "follow"
+)
+
+var errSymlink = errors.New("path contains a symlink")
+
+// readFS returns the file system that GET requests, listings and archives are served from,
+// according to the symlink policy.
+func (h *FileHandler) readFS() fs.FS {
+	switch h.Symlinks {
+	case SymlinksFollow:
+		return os.DirFS(h.dir)
+	case SymlinksDeny:
+		return noSymlinksFS{root: h.rootedFileSystem}
+	}
+	return withinRootFS{root: h.rootedFileSystem}
+}
+
+// checkSymlinks returns errSymlink if symlinks are denied, and name is, or is within, a symlink.
+func (h *FileHandler) checkSymlinks(name string) error {
+	if h.Symlinks == SymlinksDeny && hasSymlink(h.rootedFileSystem, name) {
+		return errSymlink
+	}
+	return nil
+}
+
+// hasSymlink returns true if any part of name is a symlink.
+func hasSymlink(root *os.Root, name string) bool {
+	if name == "" || name == "." {
+		return false
+	}
+	var current string
+	for segment := range strings.SplitSeq(name, "/") {
+		current = path.Join(current, segment)
+		fi, err := root.Lstat(current)
+		if err != nil {
+			// Nothing within a path that doesn't exist can be a symlink.
+			return false
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// withinRootFS is an fs.FS over an os.Root that reports symlinks that escape the root as not
+// existing, rather than as an error.
+type withinRootFS struct {
+	root *os.Root
+}
+
+func (fsys withinRootFS) err(op, name string, err error) error {
+	if err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrPermission) && hasSymlink(fsys.root, name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return err
+}
+
+func (fsys withinRootFS) Open(name string) (fs.File, error) {
+	f, err := fsys.root.FS().Open(name)
+	return f, fsys.err("open", name, err)
+}
+
+func (fsys withinRootFS) Stat(name string) (fs.FileInfo, error) {
+	fi, err := fs.Stat(fsys.root.FS(), name)
+	return fi, fsys.err("stat", name, err)
+}
+
+func (fsys withinRootFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(fsys.root.FS(), name)
+	return entries, fsys.err("readdir", name, err)
+}
+
+// noSymlinksFS is an fs.FS over an os.Root that hides symlinks.
+type noSymlinksFS struct {
+	root *os.Root
+}
+
+func (fsys noSymlinksFS) check(op, name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if hasSymlink(fsys.root, name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return nil
+}
+
+func (fsys noSymlinksFS) Open(name string) (fs.File, error) {
+	if err := fsys.check("open", name); err != nil {
+		return nil, err
+	}
+	return fsys.root.FS().Open(name)
+}
+
+func (fsys noSymlinksFS) Stat(name string) (fs.FileInfo, error) {
+	if err := fsys.check("stat", name); err != nil {
+		return nil, err
+	}
+	return fsys.root.Stat(name)
+}
+
+func (fsys noSymlinksFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := fsys.check("readdir", name); err != nil {
+		return nil, err
+	}
+	entries, err := fs.ReadDir(fsys.root.FS(), name)
+	return slices.DeleteFunc(entries, func(e fs.DirEntry) bool {
+		return e.Type()&fs.ModeSymlink != 0
+	}), err
+}
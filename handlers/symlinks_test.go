@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSymlinkPolicy(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "file.txt"), []byte("inside"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("outside"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	for link, target := range map[string]string{
+		"inside.txt":  filepath.Join("sub", "file.txt"),
+		"outside.txt": filepath.Join(outside, "secret.txt"),
+		"linkdir":     "sub",
+		"outsidedir":  outside,
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatalf("Failed to create symlink: %v", err)
+		}
+	}
+	log := slog.New(slog.DiscardHandler)
+	fh, closer, err := NewFileHandler(log, dir, false)
+	if err != nil {
+		t.Fatalf("Failed to create FileHandler: %v", err)
+	}
+	defer closer()
+
+	tests := []struct {
+		policy   SymlinkPolicy
+		path     string
+		expected int
+	}{
+		{policy: SymlinksWithinRoot, path: "/sub/file.txt", expected: http.StatusOK},
+		{policy: SymlinksWithinRoot, path: "/inside.txt", expected: http.StatusOK},
+		{policy: SymlinksWithinRoot, path: "/linkdir/file.txt", expected: http.StatusOK},
+		{policy: SymlinksWithinRoot, path: "/outside.txt", expected: http.StatusNotFound},
+		{policy: SymlinksWithinRoot, path: "/outsidedir/secret.txt", expected: http.StatusNotFound},
+		{policy: SymlinksDeny, path: "/sub/file.txt", expected: http.StatusOK},
+		{policy: SymlinksDeny, path: "/inside.txt", expected: http.StatusNotFound},
+		{policy: SymlinksDeny, path: "/linkdir/file.txt", expected: http.StatusNotFound},
+		{policy: SymlinksDeny, path: "/outside.txt", expected: http.StatusNotFound},
+		{policy: SymlinksFollow, path: "/inside.txt", expected: http.StatusOK},
+		{policy: SymlinksFollow, path: "/outside.txt", expected: http.StatusOK},
+		{policy: SymlinksFollow, path: "/outsidedir/secret.txt", expected: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy)+" "+tt.path, func(t *testing.T) {
+			fh.Symlinks = tt.policy
+			w := httptest.NewRecorder()
+			fh.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.expected {
+				t.Errorf("Expected status %d, got %d: %s", tt.expected, w.Code, w.Body.String())
+			}
+		})
+	}
+	t.Run("Symlinks are left out of listings when denied", func(t *testing.T) {
+		fh.Symlinks = SymlinksDeny
+		result := testListJSON(t, fh, httptest.NewRequest(http.MethodGet, "/?format=json", nil))
+		if got := listingNames(result); got != "sub" {
+			t.Errorf("Unexpected listing: %s", got)
+		}
+	})
+	t.Run("Symlinks outside the root are left out of listings", func(t *testing.T) {
+		fh.Symlinks = SymlinksWithinRoot
+		result := testListJSON(t, fh, httptest.NewRequest(http.MethodGet, "/?format=json", nil))
+		if got := listingNames(result); got != "inside.txt,linkdir,sub" {
+			t.Errorf("Unexpected listing: %s", got)
+		}
+	})
+	t.Run("Writes through symlinks are rejected when denied", func(t *testing.T) {
+		fh.Symlinks = SymlinksDeny
+		for _, method := range []string{http.MethodPut, http.MethodDelete} {
+			w := httptest.NewRecorder()
+			fh.ServeHTTP(w, httptest.NewRequest(method, "/linkdir/file.txt", bytes.NewReader([]byte("new"))))
+			if w.Code != http.StatusForbidden {
+				t.Errorf("%s: expected status %d, got %d", method, http.StatusForbidden, w.Code)
+			}
+		}
+		testFileContent(t, dir, "sub/file.txt", "inside")
+	})
+	t.Run("Writes can't escape the root when following symlinks", func(t *testing.T) {
+		fh.Symlinks = SymlinksFollow
+		w := httptest.NewRecorder()
+		fh.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/outsidedir/secret.txt", strings.NewReader("overwritten")))
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, w.Code)
+		}
+		testFileContent(t, outside, "secret.txt", "outside")
+	})
+}
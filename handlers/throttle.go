@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// throttleFreeFailures is the number of failures allowed before backing off.
+	throttleFreeFailures = 3
+	// throttleBaseDelay is the delay after the first failure beyond the free failures, which
+	// doubles with each further failure.
+	throttleBaseDelay = time.Second
+	// throttleMaxEntries limits the memory used to track failures, e.g. when guessing usernames.
+	throttleMaxEntries = 100000
+)
+
+// NewThrottle slows down password guessing by tracking failed attempts per client IP address and
+// per username. After a few failures, further attempts must wait for an exponentially increasing
+// delay, and after maxFailures, attempts are locked out for the lockout duration.
+func NewThrottle(log *slog.Logger, maxFailures int, lockout time.Duration) *Throttle {
+	return &Throttle{
+		log:         log,
+		maxFailures: maxFailures,
+		lockout:     lockout,
+		now:         time.Now,
+		entries:     make(map[throttleKey]*throttleEntry),
+	}
+}
+
+type Throttle struct {
+	log         *slog.Logger
+	maxFailures int
+	lockout     time.Duration
+	now         func() time.Time
+
+	mu      sync.Mutex
+	entries map[throttleKey]*throttleEntry
+}
+
+type throttleKey struct {
+	// kind is ip or user.
+	kind  string
+	value string
+}
+
+type throttleEntry struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// Wait returns how long the client must wait before trying to authenticate, or zero.
+func (t *Throttle) Wait(ip, username string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	var wait time.Duration
+	for _, key := range throttleKeys(ip, username) {
+		if e, ok := t.entries[key]; ok && now.Before(e.blockedUntil) {
+			wait = max(wait, e.blockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+// Fail records a failed attempt.
+func (t *Throttle) Fail(ip, username string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	if len(t.entries) >= throttleMaxEntries {
+		t.prune(now)
+	}
+	for _, key := range throttleKeys(ip, username) {
+		e, ok := t.entries[key]
+		if !ok || now.Sub(e.lastFailure) > t.lockout {
+			// Failures are forgotten after the lockout duration.
+			e = &throttleEntry{}
+			t.entries[key] = e
+		}
+		e.failures++
+		e.lastFailure = now
+		switch {
+		case e.failures >= t.maxFailures:
+			e.blockedUntil = now.Add(t.lockout)
+			if e.failures == t.maxFailures {
+				t.log.Warn("Locked out after repeated authentication failures", slog.String(key.kind, key.value), slog.Int("failures", e.failures), slog.Duration("lockout", t.lockout))
+			}
+		case e.failures > throttleFreeFailures:
+			shift := min(e.failures-throttleFreeFailures-1, 30)
+			delay := min(throttleBaseDelay*time.Duration(math.Pow(2, float64(shift))), t.lockout)
+			e.blockedUntil = now.Add(delay)
+		}
+	}
+}
+
+// Succeed forgets the failures of the username. Failures of the IP address aren't forgotten, so
+// that an attacker with one valid account can't use it to keep guessing the passwords of others.
+func (t *Throttle) Succeed(username string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, throttleKey{kind: "user", value: username})
+}
+
+// prune removes entries that no longer block or count towards a lockout, and if there are still
+// too many, removes entries until there's space. It must be called with the mutex held.
+func (t *Throttle) prune(now time.Time) {
+	for key, e := range t.entries {
+		if now.Sub(e.lastFailure) > t.lockout && !now.Before(e.blockedUntil) {
+			delete(t.entries, key)
+		}
+	}
+	for key := range t.entries {
+		if len(t.entries) < throttleMaxEntries {
+			break
+		}
+		delete(t.entries, key)
+	}
+}
+
+func throttleKeys(ip, username string) []throttleKey {
+	keys := []throttleKey{{kind: "ip", value: ip}}
+	if username != "" {
+		keys = append(keys, throttleKey{kind: "user", value: username})
+	}
+	return keys
+}
+
+// tooManyRequests writes a 429 response with a Retry-After header.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", retryAfter(wait))
+	http.Error(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+}
+
+// retryAfter returns the value of a Retry-After header, in whole seconds.
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	newThrottle := func(logs *bytes.Buffer) *Throttle {
+		throttle := NewThrottle(slog.New(slog.NewTextHandler(logs, nil)), 10, 15*time.Minute)
+		throttle.now = func() time.Time { return now }
+		return throttle
+	}
+	t.Run("the first failures aren't delayed", func(t *testing.T) {
+		throttle := newThrottle(&bytes.Buffer{})
+		for range throttleFreeFailures {
+			throttle.Fail("192.0.2.1", "admin")
+		}
+		if wait := throttle.Wait("192.0.2.1", "admin"); wait != 0 {
+			t.Errorf("Expected no wait, got %v", wait)
+		}
+	})
+	t.Run("further failures back off exponentially", func(t *testing.T) {
+		throttle := newThrottle(&bytes.Buffer{})
+		for range throttleFreeFailures {
+			throttle.Fail("192.0.2.1", "admin")
+		}
+		for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+			throttle.Fail("192.0.2.1", "admin")
+			if wait := throttle.Wait("192.0.2.1", "admin"); wait != expected {
+				t.Errorf("Expected wait %v, got %v", expected, wait)
+			}
+		}
+	})
+	t.Run("failures are tracked per IP address and per username", func(t *testing.T) {
+		throttle := newThrottle(&bytes.Buffer{})
+		for i := range throttleFreeFailures + 1 {
+			throttle.Fail("192.0.2.1", "user"+string(rune('a'+i)))
+		}
+		if wait := throttle.Wait("192.0.2.1", "other"); wait == 0 {
+			t.Error("Expected the IP address to be delayed")
+		}
+		for i := range throttleFreeFailures + 1 {
+			throttle.Fail("198.51.100."+string(rune('1'+i)), "admin")
+		}
+		if wait := throttle.Wait("203.0.113.1", "admin"); wait == 0 {
+			t.Error("Expected the username to be delayed from other IP addresses")
+		}
+		if wait := throttle.Wait("203.0.113.1", "other"); wait != 0 {
+			t.Errorf("Expected other users from other IP addresses not to be delayed, got %v", wait)
+		}
+	})
+	t.Run("repeated failures are locked out and logged", func(t *testing.T) {
+		var logs bytes.Buffer
+		throttle := newThrottle(&logs)
+		for range 10 {
+			throttle.Fail("192.0.2.1", "admin")
+		}
+		if wait := throttle.Wait("192.0.2.1", "admin"); wait != 15*time.Minute {
+			t.Errorf("Expected a 15 minute lockout, got %v", wait)
+		}
+		if !strings.Contains(logs.String(), "Locked out") || !strings.Contains(logs.String(), "user=admin") || !strings.Contains(logs.String(), "ip=192.0.2.1") {
+			t.Errorf("Expected the lockout to be logged, got %q", logs.String())
+		}
+		now = now.Add(15 * time.Minute)
+		if wait := throttle.Wait("192.0.2.1", "admin"); wait != 0 {
+			t.Errorf("Expected the lockout to expire, got %v", wait)
+		}
+	})
+	t.Run("success forgets the failures of the username", func(t *testing.T) {
+		throttle := newThrottle(&bytes.Buffer{})
+		for range throttleFreeFailures + 1 {
+			throttle.Fail("192.0.2.1", "admin")
+		}
+		throttle.Succeed("admin")
+		if wait := throttle.Wait("198.51.100.1", "admin"); wait != 0 {
+			t.Errorf("Expected no wait, got %v", wait)
+		}
+		if wait := throttle.Wait("192.0.2.1", "admin"); wait == 0 {
+			t.Error("Expected the IP address to still be delayed")
+		}
+	})
+}
+
+func TestBasicAuthMiddlewareThrottle(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	m := NewBasicAuthMiddleware(next, "admin", "secret")
+	m.Throttle = NewThrottle(slog.New(slog.DiscardHandler), 10, 15*time.Minute)
+	request := func(password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.SetBasicAuth("admin", password)
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, req)
+		return w
+	}
+	for range throttleFreeFailures + 1 {
+		if w := request("wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected status 401, got %d", w.Code)
+		}
+	}
+	w := request("secret")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429, got %d", w.Code)
+	}
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "1" {
+		t.Errorf("Expected Retry-After 1, got %q", retryAfter)
+	}
+}
@@ -0,0 +1,385 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TusPath is the URL path that the tus (https://tus.io) resumable upload endpoint is served from.
+const TusPath = "/.tus/"
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+	tusDir        = stagingDir + "/tus"
+)
+
+// tusUpload is the state of an incomplete upload, stored alongside the partial data.
+type tusUpload struct {
+	Length   int64             `json:"length"`
+	Target   string            `json:"target"`
+	Metadata map[string]string `json:"metadata"`
+	// RawMetadata is the Upload-Metadata header as sent by the client.
+	RawMetadata string `json:"raw_metadata"`
+}
+
+func (h *FileHandler) ServeTus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		if h.TusMaxSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.TusMaxSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, TusPath)
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.tusCreate(w, r)
+		return
+	}
+	if strings.ContainsAny(id, "/.") {
+		http.NotFound(w, r)
+		return
+	}
+	// Check that the upload exists before locking it, so that requests for made up IDs don't
+	// add locks that are never removed.
+	if _, err := h.rootedFileSystem.Stat(tusInfoPath(id)); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Only allow one request at a time to operate on an upload. The lock is removed along with
+	// the upload.
+	lock, _ := h.tusLocks.LoadOrStore(id, &sync.Mutex{})
+	if !lock.(*sync.Mutex).TryLock() {
+		http.Error(w, "Upload is locked by another request", http.StatusLocked)
+		return
+	}
+	defer lock.(*sync.Mutex).Unlock()
+
+	switch r.Method {
+	case http.MethodHead:
+		h.tusHead(w, r, id)
+	case http.MethodPatch:
+		h.tusPatch(w, r, id)
+	case http.MethodDelete:
+		h.tusDelete(w, r, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *FileHandler) tusCreate(w http.ResponseWriter, r *http.Request) {
+	h.tusRemoveExpired(r)
+
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "Upload-Defer-Length is not supported", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if h.TusMaxSize > 0 && length > h.TusMaxSize {
+		http.Error(w, "Upload-Length exceeds Tus-Max-Size", http.StatusRequestEntityTooLarge)
+		return
+	}
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "Invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+	target := h.cleanPath("/" + metadata["filename"])
+	if target == "" || isStagingPath(target) {
+		http.Error(w, "Upload-Metadata must include a valid filename", http.StatusBadRequest)
+		return
+	}
+	setAuditPath(r, target)
+	if !h.authorize(w, r, target, PermissionWrite) {
+		return
+	}
+	if err = h.checkSymlinks(target); err != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	upload := tusUpload{
+		Length:      length,
+		Target:      target,
+		Metadata:    metadata,
+		RawMetadata: r.Header.Get("Upload-Metadata"),
+	}
+	id := rand.Text()
+	if err = h.rootedFileSystem.MkdirAll(tusDir, 0755); err != nil {
+		h.logger(r).Error("Failed to create tus staging directory", slog.Any("error", err))
+		http.Error(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	if err = h.tusWriteInfo(id, upload); err != nil {
+		h.logger(r).Error("Failed to create tus upload", slog.String("id", id), slog.Any("error", err))
+		http.Error(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	f, err := h.rootedFileSystem.OpenFile(tusDataPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		h.logger(r).Error("Failed to create tus upload", slog.String("id", id), slog.Any("error", err))
+		http.Error(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+
+	w.Header().Set("Location", TusPath+id)
+	h.tusSetExpires(w, time.Now())
+	if length == 0 && !h.tusFinish(w, r, id, upload) {
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *FileHandler) tusHead(w http.ResponseWriter, r *http.Request, id string) {
+	upload, offset, ok := h.tusLoad(w, r, id)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.RawMetadata != "" {
+		w.Header().Set("Upload-Metadata", upload.RawMetadata)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *FileHandler) tusPatch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	requestOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || requestOffset < 0 {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	upload, offset, ok := h.tusLoad(w, r, id)
+	if !ok {
+		return
+	}
+	if requestOffset != offset {
+		http.Error(w, "Upload-Offset does not match the current offset", http.StatusConflict)
+		return
+	}
+
+	f, err := h.rootedFileSystem.OpenFile(tusDataPath(id), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		h.logger(r).Error("Failed to open tus upload", slog.String("id", id), slog.Any("error", err))
+		http.Error(w, "failed to write upload", http.StatusInternalServerError)
+		return
+	}
+	// Keep whatever was received, even if the client goes away part way through, so that the
+	// upload can be resumed from there.
+	n, copyErr := io.Copy(f, io.LimitReader(auditBody(r, r.Body), upload.Length-offset))
+	closeErr := f.Close()
+	if err = errors.Join(copyErr, closeErr); err != nil {
+		h.logger(r).Error("Failed to write tus upload", slog.String("id", id), slog.Int64("written", n), slog.Any("error", err))
+		http.Error(w, "failed to write upload", http.StatusInternalServerError)
+		return
+	}
+	offset += n
+
+	if offset == upload.Length {
+		if !h.tusFinish(w, r, id, upload) {
+			return
+		}
+	} else {
+		h.tusSetExpires(w, time.Now())
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *FileHandler) tusDelete(w http.ResponseWriter, r *http.Request, id string) {
+	if _, _, ok := h.tusLoad(w, r, id); !ok {
+		return
+	}
+	if err := h.tusRemove(id); err != nil {
+		h.logger(r).Error("Failed to delete tus upload", slog.String("id", id), slog.Any("error", err))
+		http.Error(w, "failed to delete upload", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusLoad reads the state of the upload, writing an error response and returning false if the
+// upload can't be used.
+func (h *FileHandler) tusLoad(w http.ResponseWriter, r *http.Request, id string) (upload tusUpload, offset int64, ok bool) {
+	data, err := h.rootedFileSystem.ReadFile(tusInfoPath(id))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			h.logger(r).Error("Failed to read tus upload", slog.String("id", id), slog.Any("error", err))
+		}
+		http.NotFound(w, r)
+		return upload, 0, false
+	}
+	if err = json.Unmarshal(data, &upload); err != nil {
+		h.logger(r).Error("Failed to parse tus upload", slog.String("id", id), slog.Any("error", err))
+		http.Error(w, "failed to read upload", http.StatusInternalServerError)
+		return upload, 0, false
+	}
+	setAuditPath(r, upload.Target)
+	if !h.authorize(w, r, upload.Target, PermissionWrite) {
+		return upload, 0, false
+	}
+	fi, err := h.rootedFileSystem.Stat(tusDataPath(id))
+	if err != nil {
+		h.logger(r).Error("Failed to read tus upload", slog.String("id", id), slog.Any("error", err))
+		http.NotFound(w, r)
+		return upload, 0, false
+	}
+	if h.tusExpired(fi) {
+		if err = h.tusRemove(id); err != nil {
+			h.logger(r).Error("Failed to delete expired tus upload", slog.String("id", id), slog.Any("error", err))
+		}
+		http.Error(w, "Upload expired", http.StatusGone)
+		return upload, 0, false
+	}
+	h.tusSetExpires(w, fi.ModTime())
+	return upload, fi.Size(), true
+}
+
+// tusFinish moves a complete upload to its target path, in the same way as other uploads, so
+// that the If-Match and If-None-Match headers of the request that completes the upload are
+// checked. If the upload can't be completed, an error response is written, the upload is removed,
+// and false is returned.
+func (h *FileHandler) tusFinish(w http.ResponseWriter, r *http.Request, id string, upload tusUpload) bool {
+	err := h.checkSymlinks(upload.Target)
+	if err == nil {
+		err = h.commit(tusDataPath(id), upload.Target, func(current fs.FileInfo) bool {
+			return preconditionsMet(r, current)
+		})
+	}
+	if removeErr := h.tusRemove(id); removeErr != nil {
+		h.logger(r).Error("Failed to delete tus upload", slog.String("id", id), slog.Any("error", removeErr))
+	}
+	switch {
+	case errors.Is(err, errSymlink):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	case errors.Is(err, errPreconditionFailed):
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return false
+	case err != nil:
+		h.logger(r).Error("Failed to complete tus upload", slog.String("id", id), slog.Any("error", err))
+		http.Error(w, "failed to complete upload", http.StatusInternalServerError)
+		return false
+	}
+	h.logger(r).Info("Completed tus upload", slog.String("id", id), slog.String("path", upload.Target), slog.Int64("size", upload.Length))
+	return true
+}
+
+func (h *FileHandler) tusWriteInfo(id string, upload tusUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return h.rootedFileSystem.WriteFile(tusInfoPath(id), data, 0644)
+}
+
+func (h *FileHandler) tusRemove(id string) error {
+	h.tusLocks.Delete(id)
+	errData := h.rootedFileSystem.Remove(tusDataPath(id))
+	if errors.Is(errData, fs.ErrNotExist) {
+		errData = nil
+	}
+	return errors.Join(errData, h.rootedFileSystem.Remove(tusInfoPath(id)))
+}
+
+// tusExpired returns true if an upload hasn't received any data within the expiry period.
+func (h *FileHandler) tusExpired(data fs.FileInfo) bool {
+	return h.TusExpiry > 0 && time.Since(data.ModTime()) > h.TusExpiry
+}
+
+func (h *FileHandler) tusSetExpires(w http.ResponseWriter, lastModified time.Time) {
+	if h.TusExpiry > 0 {
+		w.Header().Set("Upload-Expires", lastModified.Add(h.TusExpiry).UTC().Format(http.TimeFormat))
+	}
+}
+
+// tusRemoveExpired deletes uploads that have expired.
+func (h *FileHandler) tusRemoveExpired(r *http.Request) {
+	entries, err := fs.ReadDir(h.rootedFileSystem.FS(), tusDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		id, isInfo := strings.CutSuffix(entry.Name(), ".info")
+		if !isInfo {
+			continue
+		}
+		fi, err := h.rootedFileSystem.Stat(tusDataPath(id))
+		if err == nil && !h.tusExpired(fi) {
+			continue
+		}
+		lock, _ := h.tusLocks.LoadOrStore(id, &sync.Mutex{})
+		if !lock.(*sync.Mutex).TryLock() {
+			continue
+		}
+		if err = h.tusRemove(id); err != nil {
+			h.logger(r).Error("Failed to delete expired tus upload", slog.String("id", id), slog.Any("error", err))
+		}
+		lock.(*sync.Mutex).Unlock()
+	}
+}
+
+func tusDataPath(id string) string {
+	return path.Join(tusDir, id)
+}
+
+func tusInfoPath(id string) string {
+	return path.Join(tusDir, id+".info")
+}
+
+// parseTusMetadata parses the Upload-Metadata header, a comma separated list of keys, each
+// optionally followed by a space and a base64 encoded value.
+func parseTusMetadata(header string) (metadata map[string]string, err error) {
+	metadata = make(map[string]string)
+	if header == "" {
+		return metadata, nil
+	}
+	for pair := range strings.SplitSeq(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("empty metadata key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata value for %q: %w", key, err)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTus(t *testing.T) {
+	dir := t.TempDir()
+	log := slog.New(slog.DiscardHandler)
+	fh, closer, err := NewFileHandler(log, dir, false)
+	if err != nil {
+		t.Fatalf("Failed to create FileHandler: %v", err)
+	}
+	defer closer()
+	fh.TusEnabled = true
+	fh.TusMaxSize = 1024
+	fh.TusExpiry = time.Hour
+
+	t.Run("OPTIONS advertises the protocol", func(t *testing.T) {
+		w := tusRequest(t, fh, http.MethodOptions, TusPath, nil, "")
+		if w.Code != http.StatusNoContent {
+			t.Errorf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+		}
+		if got := w.Header().Get("Tus-Extension"); got != tusExtensions {
+			t.Errorf("Expected Tus-Extension %q, got %q", tusExtensions, got)
+		}
+		if got := w.Header().Get("Tus-Max-Size"); got != "1024" {
+			t.Errorf("Expected Tus-Max-Size 1024, got %q", got)
+		}
+	})
+	t.Run("Requests without Tus-Resumable are rejected", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, TusPath, nil)
+		w := httptest.NewRecorder()
+		fh.ServeHTTP(w, req)
+		if w.Code != http.StatusPreconditionFailed {
+			t.Errorf("Expected status %d, got %d", http.StatusPreconditionFailed, w.Code)
+		}
+	})
+	t.Run("Uploads larger than the maximum size are rejected", func(t *testing.T) {
+		w := tusCreate(t, fh, 2048, "big.bin")
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+		}
+	})
+	t.Run("Uploads require a filename", func(t *testing.T) {
+		w := tusCreate(t, fh, 10, "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+	t.Run("Uploads can be resumed", func(t *testing.T) {
+		w := tusCreate(t, fh, 11, "resumed/file.txt")
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status %d, got %d", http.StatusCreated, w.Code)
+		}
+		location := w.Header().Get("Location")
+
+		w = tusPatch(t, fh, location, "0", "Hello")
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "resumed/file.txt")); !os.IsNotExist(err) {
+			t.Errorf("Expected incomplete upload not to be visible")
+		}
+
+		w = tusRequest(t, fh, http.MethodHead, location, map[string]string{"Tus-Resumable": tusVersion}, "")
+		if got := w.Header().Get("Upload-Offset"); got != "5" {
+			t.Errorf("Expected Upload-Offset 5, got %q", got)
+		}
+		if got := w.Header().Get("Upload-Length"); got != "11" {
+			t.Errorf("Expected Upload-Length 11, got %q", got)
+		}
+
+		w = tusPatch(t, fh, location, "0", "Hello")
+		if w.Code != http.StatusConflict {
+			t.Errorf("Expected status %d for wrong offset, got %d", http.StatusConflict, w.Code)
+		}
+
+		w = tusPatch(t, fh, location, "5", ", tus!")
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+		}
+		testGet(t, fh, "/resumed/file.txt", http.StatusOK, "Hello, tus!")
+
+		w = tusRequest(t, fh, http.MethodHead, location, map[string]string{"Tus-Resumable": tusVersion}, "")
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected completed upload to return %d, got %d", http.StatusNotFound, w.Code)
+		}
+	})
+	t.Run("Uploads can be terminated", func(t *testing.T) {
+		w := tusCreate(t, fh, 10, "terminated.txt")
+		location := w.Header().Get("Location")
+		w = tusRequest(t, fh, http.MethodDelete, location, map[string]string{"Tus-Resumable": tusVersion}, "")
+		if w.Code != http.StatusNoContent {
+			t.Errorf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+		}
+		w = tusPatch(t, fh, location, "0", "data")
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+		}
+	})
+	t.Run("Expired uploads are removed", func(t *testing.T) {
+		w := tusCreate(t, fh, 10, "expired.txt")
+		location := w.Header().Get("Location")
+		id := strings.TrimPrefix(location, TusPath)
+		old := time.Now().Add(-2 * time.Hour)
+		if err := os.Chtimes(filepath.Join(dir, tusDataPath(id)), old, old); err != nil {
+			t.Fatalf("Failed to change upload time: %v", err)
+		}
+		w = tusPatch(t, fh, location, "0", "data")
+		if w.Code != http.StatusGone {
+			t.Errorf("Expected status %d, got %d", http.StatusGone, w.Code)
+		}
+		if _, err := os.Stat(filepath.Join(dir, tusInfoPath(id))); !os.IsNotExist(err) {
+			t.Errorf("Expected expired upload to be deleted")
+		}
+	})
+	t.Run("Completed uploads respect If-None-Match", func(t *testing.T) {
+		w := tusCreate(t, fh, 3, "resumed/file.txt")
+		w = tusRequest(t, fh, http.MethodPatch, w.Header().Get("Location"), map[string]string{
+			"Tus-Resumable": tusVersion,
+			"Upload-Offset": "0",
+			"Content-Type":  "application/offset+octet-stream",
+			"If-None-Match": "*",
+		}, "new")
+		if w.Code != http.StatusPreconditionFailed {
+			t.Errorf("Expected status %d, got %d", http.StatusPreconditionFailed, w.Code)
+		}
+		testGet(t, fh, "/resumed/file.txt", http.StatusOK, "Hello, tus!")
+	})
+	t.Run("Locks are only kept for uploads that exist", func(t *testing.T) {
+		for _, method := range []string{http.MethodHead, http.MethodPatch, http.MethodDelete} {
+			w := tusRequest(t, fh, method, TusPath+"UNKNOWN", map[string]string{"Tus-Resumable": tusVersion}, "")
+			if w.Code != http.StatusNotFound {
+				t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+			}
+		}
+		w := tusCreate(t, fh, 4, "locks.txt")
+		tusPatch(t, fh, w.Header().Get("Location"), "0", "done")
+		fh.tusLocks.Range(func(id, _ any) bool {
+			t.Errorf("Expected no locks, got %v", id)
+			return true
+		})
+	})
+	t.Run("Uploads are rejected when read only", func(t *testing.T) {
+		fh.IsReadOnly = true
+		defer func() { fh.IsReadOnly = false }()
+		w := tusCreate(t, fh, 10, "readonly.txt")
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
+		}
+	})
+}
+
+func tusCreate(t *testing.T, fh *FileHandler, length int, filename string) *httptest.ResponseRecorder {
+	headers := map[string]string{
+		"Tus-Resumable": tusVersion,
+		"Upload-Length": strconv.Itoa(length),
+	}
+	if filename != "" {
+		headers["Upload-Metadata"] = "filename " + base64.StdEncoding.EncodeToString([]byte(filename))
+	}
+	return tusRequest(t, fh, http.MethodPost, TusPath, headers, "")
+}
+
+func tusPatch(t *testing.T, fh *FileHandler, location, offset, body string) *httptest.ResponseRecorder {
+	headers := map[string]string{
+		"Tus-Resumable": tusVersion,
+		"Upload-Offset": offset,
+		"Content-Type":  "application/offset+octet-stream",
+	}
+	return tusRequest(t, fh, http.MethodPatch, location, headers, body)
+}
+
+func tusRequest(t *testing.T, fh *FileHandler, method, urlPath string, headers map[string]string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, urlPath, strings.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	fh.ServeHTTP(w, req)
+	return w
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"os"
+	"time"
+)
+
+// watchedFile tracks the modification time and size of a file, so that it can be reloaded when
+// it changes.
+type watchedFile struct {
+	name          string
+	checkInterval time.Duration
+	checked       time.Time
+	modTime       time.Time
+	size          int64
+}
+
+// changed returns the file info if the file has changed since it was loaded, checking at most
+// once per checkInterval. Calls must be serialised by the caller.
+func (f *watchedFile) changed() (fi os.FileInfo, changed bool, err error) {
+	if time.Since(f.checked) < f.checkInterval {
+		return nil, false, nil
+	}
+	f.checked = time.Now()
+	if fi, err = os.Stat(f.name); err != nil {
+		return nil, false, err
+	}
+	return fi, !fi.ModTime().Equal(f.modTime) || fi.Size() != f.size, nil
+}
+
+// loaded records the file info of the loaded file.
+func (f *watchedFile) loaded(fi os.FileInfo) {
+	f.modTime, f.size = fi.ModTime(), fi.Size()
+}
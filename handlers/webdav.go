@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// rootFileSystem is a webdav.FileSystem that reads and writes within the root of the handler,
+// hides the staging directory and, with HideDotfiles, dotfiles, and leaves entries that the
+// request can't read out of listings.
+type rootFileSystem struct {
+	h *FileHandler
+}
+
+func (fsys rootFileSystem) denySymlinks() bool {
+	return fsys.h.Symlinks == SymlinksDeny
+}
+
+func (fsys rootFileSystem) name(name string) (string, error) {
+	cleaned := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if fsys.h.isHidden(cleaned) {
+		return "", os.ErrNotExist
+	}
+	if cleaned == "" {
+		return ".", nil
+	}
+	if fsys.denySymlinks() && hasSymlink(fsys.h.rootedFileSystem, cleaned) {
+		return "", os.ErrNotExist
+	}
+	return cleaned, nil
+}
+
+func (fsys rootFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) (err error) {
+	if name, err = fsys.name(name); err != nil {
+		return err
+	}
+	return fsys.h.rootedFileSystem.Mkdir(name, perm)
+}
+
+func (fsys rootFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name, err := fsys.name(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fsys.h.rootedFileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return dir{File: f, ctx: ctx, fsys: fsys, name: name}, nil
+}
+
+func (fsys rootFileSystem) RemoveAll(ctx context.Context, name string) (err error) {
+	if name, err = fsys.name(name); err != nil {
+		return err
+	}
+	if name == "." {
+		return os.ErrPermission
+	}
+	return fsys.h.rootedFileSystem.RemoveAll(name)
+}
+
+func (fsys rootFileSystem) Rename(ctx context.Context, oldName, newName string) (err error) {
+	if oldName, err = fsys.name(oldName); err != nil {
+		return err
+	}
+	if newName, err = fsys.name(newName); err != nil {
+		return err
+	}
+	if oldName == "." || newName == "." {
+		return os.ErrPermission
+	}
+	return fsys.h.rootedFileSystem.Rename(oldName, newName)
+}
+
+func (fsys rootFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name, err := fsys.name(name)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.h.rootedFileSystem.Stat(name)
+}
+
+// dir leaves hidden files, symlinks if they're denied, and entries that the request
+// can't read out of listings, so that a PROPFIND with a Depth of 1 or infinity doesn't list them.
+type dir struct {
+	*os.File
+	// ctx is the context of the request, with its identity.
+	ctx  context.Context
+	fsys rootFileSystem
+	name string
+}
+
+func (d dir) Readdir(count int) ([]fs.FileInfo, error) {
+	entries, err := d.File.Readdir(count)
+	return slices.DeleteFunc(entries, func(fi fs.FileInfo) bool {
+		name := path.Join(d.name, fi.Name())
+		return d.fsys.h.isHidden(name) ||
+			(d.fsys.denySymlinks() && fi.Mode()&fs.ModeSymlink != 0) ||
+			!d.fsys.h.isAuthorizedContext(d.ctx, name, PermissionRead)
+	}), err
+}
+
+func newWebDAVHandler(h *FileHandler) *webdav.Handler {
+	return &webdav.Handler{
+		FileSystem: rootFileSystem{h: h},
+		LockSystem: h.locks,
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				h.logger(r).Debug("WebDAV request failed", slog.String("method", r.Method), slog.String("url", r.URL.String()), slog.Any("error", err))
+			}
+		},
+	}
+}
+
+// webDAVPermission returns the permission the WebDAV method needs for the request path, and for
+// the Destination of a COPY or MOVE.
+func webDAVPermission(method string) (source, destination Permission) {
+	switch method {
+	case "PROPPATCH", "MKCOL", "LOCK", "UNLOCK":
+		return PermissionWrite, 0
+	case "COPY":
+		return PermissionRead, PermissionWrite
+	case "MOVE":
+		return PermissionDelete, PermissionWrite
+	}
+	return PermissionRead, 0
+}
+
+func (h *FileHandler) ServeWebDAV(w http.ResponseWriter, r *http.Request) {
+	cleaned := h.cleanPath(r.URL.Path)
+	source, destination := webDAVPermission(r.Method)
+	// Collections are moved, and copied unless the Depth is 0, along with their contents, so
+	// the permissions are needed for everything within them.
+	recursive := r.Method == "MOVE" || (r.Method == "COPY" && r.Header.Get("Depth") != "0")
+	authorize := h.authorize
+	if recursive {
+		authorize = h.authorizeTree
+	}
+	if !authorize(w, r, cleaned, source) {
+		return
+	}
+	if destination != 0 {
+		u, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil {
+			http.Error(w, "Invalid Destination", http.StatusBadRequest)
+			return
+		}
+		target := h.cleanPath(u.Path)
+		setAuditDestination(r, target)
+		if !h.authorize(w, r, target, destination) {
+			return
+		}
+		if recursive && !h.isAuthorizedTree(r, cleaned, target, destination) {
+			deny(w, r)
+			return
+		}
+		// Overwriting a collection deletes its contents.
+		if fi, err := h.stat(target); err == nil && fi != nil && fi.IsDir() && r.Header.Get("Overwrite") != "F" && !h.isAuthorizedTree(r, target, target, PermissionDelete) {
+			deny(w, r)
+			return
+		}
+	}
+	h.webdav.ServeHTTP(w, r)
+}
+
+// confirmLocks checks that a PUT, POST or DELETE, which are served by the FileHandler rather than
+// the WebDAV handler, doesn't conflict with WebDAV locks. Without an If header, the path mustn't
+// be locked, otherwise the If header must include the token of a lock of the path. The returned
+// function releases the path once the request has been served. If the request conflicts with a
+// lock, a 423 or 412 response is written.
+func (h *FileHandler) confirmLocks(w http.ResponseWriter, r *http.Request, cleaned string) (release func(), ok bool) {
+	if !h.WebDAV {
+		return func() {}, true
+	}
+	name := "/" + cleaned
+	now := time.Now()
+	header := r.Header.Get("If")
+	if header == "" {
+		// Create a temporary lock, which fails if another client holds a lock. Deletes also
+		// conflict with locks within the directory.
+		token, err := h.locks.Create(now, webdav.LockDetails{Root: name, Duration: -1, ZeroDepth: r.Method != http.MethodDelete})
+		if errors.Is(err, webdav.ErrLocked) {
+			http.Error(w, "Locked", webdav.StatusLocked)
+			return nil, false
+		}
+		if err != nil {
+			h.logger(r).Error("Failed to lock file", slog.String("path", cleaned), slog.Any("error", err))
+			http.Error(w, "failed to lock file", http.StatusInternalServerError)
+			return nil, false
+		}
+		return func() { h.locks.Unlock(now, token) }, true
+	}
+	lists, ok := parseIfHeader(header)
+	if !ok {
+		http.Error(w, "Invalid If header", http.StatusBadRequest)
+		return nil, false
+	}
+	// The lists are alternatives, so any list that confirms a lock will do.
+	for _, l := range lists {
+		lockName := name
+		if l.resource != "" {
+			u, err := url.Parse(l.resource)
+			if err != nil || u.Host != r.Host {
+				continue
+			}
+			lockName = u.Path
+		}
+		release, err := h.locks.Confirm(now, lockName, "", l.conditions...)
+		if errors.Is(err, webdav.ErrConfirmationFailed) {
+			continue
+		}
+		if err != nil {
+			h.logger(r).Error("Failed to confirm lock", slog.String("path", cleaned), slog.Any("error", err))
+			http.Error(w, "failed to lock file", http.StatusInternalServerError)
+			return nil, false
+		}
+		return release, true
+	}
+	http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+	return nil, false
+}
+
+// ifList is a list of conditions of an If header, which all apply to the resource, or to the
+// request path if the resource is empty.
+type ifList struct {
+	resource   string
+	conditions []webdav.Condition
+}
+
+// parseIfHeader parses an If header, e.g. (<urn:uuid:1>), or with a resource and an entity tag,
+// <http://example.com/a.txt> (<urn:uuid:1> ["etag"]), see RFC 4918 section 10.4.
+func parseIfHeader(s string) (lists []ifList, ok bool) {
+	var resource string
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		switch s[0] {
+		case '<':
+			end := strings.IndexByte(s, '>')
+			if end < 0 {
+				return nil, false
+			}
+			resource, s = s[1:end], s[end+1:]
+		case '(':
+			end := strings.IndexByte(s, ')')
+			if end < 0 {
+				return nil, false
+			}
+			conditions, ok := parseIfConditions(s[1:end])
+			if !ok {
+				return nil, false
+			}
+			lists = append(lists, ifList{resource: resource, conditions: conditions})
+			s = s[end+1:]
+		default:
+			return nil, false
+		}
+	}
+	return lists, len(lists) > 0
+}
+
+func parseIfConditions(s string) (conditions []webdav.Condition, ok bool) {
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		var c webdav.Condition
+		if len(s) > 3 && strings.EqualFold(s[:3], "not") {
+			c.Not, s = true, strings.TrimSpace(s[3:])
+		}
+		if s == "" {
+			return nil, false
+		}
+		var closing byte
+		switch s[0] {
+		case '<':
+			closing = '>'
+		case '[':
+			closing = ']'
+		default:
+			return nil, false
+		}
+		end := strings.IndexByte(s, closing)
+		if end < 0 {
+			return nil, false
+		}
+		if s[0] == '<' {
+			c.Token = s[1:end]
+		} else {
+			c.ETag = s[1:end]
+		}
+		conditions = append(conditions, c)
+		s = s[end+1:]
+	}
+	return conditions, len(conditions) > 0
+}
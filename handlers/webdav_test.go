@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWebDAV(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "testfile.txt"), []byte("Hello, World!"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, stagingDir, "tmp"), 0755); err != nil {
+		t.Fatalf("Failed to create staging directory: %v", err)
+	}
+
+	log := slog.New(slog.DiscardHandler)
+	fh, closer, err := NewFileHandler(log, dir, true)
+	if err != nil {
+		t.Fatalf("Failed to create FileHandler: %v", err)
+	}
+	defer closer()
+	fh.WebDAV = true
+
+	t.Run("PROPFIND lists files", func(t *testing.T) {
+		w := webDAVRequest(fh, "PROPFIND", "/", map[string]string{"Depth": "1"})
+		if w.Code != http.StatusMultiStatus {
+			t.Fatalf("Expected status %d, got %d", http.StatusMultiStatus, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "/testfile.txt") {
+			t.Errorf("Expected listing to include testfile.txt, got %s", w.Body.String())
+		}
+		if strings.Contains(w.Body.String(), stagingDir) {
+			t.Errorf("Expected listing not to include the staging directory, got %s", w.Body.String())
+		}
+	})
+	t.Run("PROPFIND cannot see the staging directory", func(t *testing.T) {
+		w := webDAVRequest(fh, "PROPFIND", "/"+stagingDir+"/", map[string]string{"Depth": "0"})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+		}
+	})
+	t.Run("Cannot MKCOL when not writable", func(t *testing.T) {
+		w := webDAVRequest(fh, "MKCOL", "/newdir", nil)
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
+		}
+	})
+
+	fh.IsReadOnly = false
+	t.Run("Can MKCOL when writable", func(t *testing.T) {
+		w := webDAVRequest(fh, "MKCOL", "/newdir", nil)
+		if w.Code != http.StatusCreated {
+			t.Errorf("Expected status %d, got %d", http.StatusCreated, w.Code)
+		}
+		if fi, err := os.Stat(filepath.Join(dir, "newdir")); err != nil || !fi.IsDir() {
+			t.Errorf("Expected directory to be created: %v", err)
+		}
+	})
+	t.Run("Can COPY and MOVE when writable", func(t *testing.T) {
+		w := webDAVRequest(fh, "COPY", "/testfile.txt", map[string]string{"Destination": "http://example.com/newdir/copied.txt"})
+		if w.Code != http.StatusCreated {
+			t.Errorf("Expected status %d, got %d", http.StatusCreated, w.Code)
+		}
+		w = webDAVRequest(fh, "MOVE", "/newdir/copied.txt", map[string]string{"Destination": "http://example.com/newdir/moved.txt"})
+		if w.Code != http.StatusCreated {
+			t.Errorf("Expected status %d, got %d", http.StatusCreated, w.Code)
+		}
+		testGet(t, fh, "/newdir/moved.txt", http.StatusOK, "Hello, World!")
+	})
+	t.Run("Cannot MOVE into the staging directory", func(t *testing.T) {
+		w := webDAVRequest(fh, "MOVE", "/newdir/moved.txt", map[string]string{"Destination": "http://example.com/" + stagingDir + "/tmp/moved.txt"})
+		if w.Code < 400 {
+			t.Errorf("Expected an error status, got %d", w.Code)
+		}
+		if _, err := os.Stat(filepath.Join(dir, stagingDir, "tmp", "moved.txt")); !os.IsNotExist(err) {
+			t.Errorf("Expected file not to be moved into the staging directory")
+		}
+	})
+	t.Run("PUT and DELETE respect locks", func(t *testing.T) {
+		req := httptest.NewRequest("LOCK", "/locked.txt", strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`))
+		w := httptest.NewRecorder()
+		fh.ServeHTTP(w, req)
+		token := w.Header().Get("Lock-Token")
+		if w.Code >= 300 || token == "" {
+			t.Fatalf("Failed to lock: %d %s", w.Code, w.Body.String())
+		}
+		testWrite(t, fh, http.MethodPut, "/locked.txt", "unlocked", http.StatusLocked)
+		testWrite(t, fh, http.MethodDelete, "/locked.txt", "", http.StatusLocked)
+		if w := webDAVRequest(fh, http.MethodPut, "/locked.txt", map[string]string{"If": "(<urn:uuid:other>)"}); w.Code != http.StatusPreconditionFailed {
+			t.Errorf("Expected status %d, got %d", http.StatusPreconditionFailed, w.Code)
+		}
+		if w := webDAVRequest(fh, http.MethodPut, "/locked.txt", map[string]string{"If": "(" + token + ")"}); w.Code != http.StatusCreated {
+			t.Errorf("Expected status %d, got %d", http.StatusCreated, w.Code)
+		}
+		if w := webDAVRequest(fh, http.MethodDelete, "/locked.txt", map[string]string{"If": "<http://example.com/locked.txt> (" + token + ` ["etag"])`}); w.Code != http.StatusNoContent {
+			t.Errorf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+		}
+	})
+	t.Run("Dotfiles are hidden with HideDotfiles", func(t *testing.T) {
+		if err := os.MkdirAll(filepath.Join(dir, ".git"), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		fh.HideDotfiles = true
+		defer func() { fh.HideDotfiles = false }()
+		w := webDAVRequest(fh, "PROPFIND", "/", map[string]string{"Depth": "1"})
+		if w.Code != http.StatusMultiStatus {
+			t.Fatalf("Expected status %d, got %d", http.StatusMultiStatus, w.Code)
+		}
+		if strings.Contains(w.Body.String(), ".git") {
+			t.Errorf("Expected listing not to include .git, got %s", w.Body.String())
+		}
+		if w := webDAVRequest(fh, "PROPFIND", "/.git", map[string]string{"Depth": "0"}); w.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+		}
+		if w := webDAVRequest(fh, "MKCOL", "/.hidden", nil); w.Code < 400 {
+			t.Errorf("Expected an error status, got %d", w.Code)
+		}
+		if w := webDAVRequest(fh, "COPY", "/testfile.txt", map[string]string{"Destination": "http://example.com/.git/config"}); w.Code < 400 {
+			t.Errorf("Expected an error status, got %d", w.Code)
+		}
+		for _, name := range []string{".hidden", ".git/config"} {
+			if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+				t.Errorf("Expected %s not to be created", name)
+			}
+		}
+	})
+	t.Run("Can DELETE collections", func(t *testing.T) {
+		testWrite(t, fh, http.MethodDelete, "/newdir", "", http.StatusNoContent)
+		if _, err := os.Stat(filepath.Join(dir, "newdir")); !os.IsNotExist(err) {
+			t.Errorf("Expected directory to be deleted")
+		}
+	})
+}
+
+func webDAVRequest(fh *FileHandler, method, urlPath string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, urlPath, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	fh.ServeHTTP(w, req)
+	return w
+}
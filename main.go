@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/tls"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
@@ -13,6 +14,21 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		if err := sign(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		if err := audit(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	conf, err := config.New()
 	if err != nil {
 		slog.Error("Error parsing config", slog.Any("error", err))
@@ -73,13 +89,25 @@ func main() {
 			log.Error("Certificate and key files must not be in the directory being served", slog.String("crt", conf.Crt), slog.String("key", conf.Key), slog.String("dir", conf.Dir))
 			os.Exit(1)
 		}
+		if conf.ClientCA != "" {
+			server.TLSConfig.ClientCAs, err = handlers.LoadClientCAs(conf.ClientCA)
+			if err != nil {
+				log.Error("Failed to load client CA certificates", slog.String("client-ca", conf.ClientCA), slog.Any("error", err))
+				os.Exit(1)
+			}
+			server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			// Certificates are optional when clients can use other auth methods, or be anonymous.
+			if conf.Auth != "" || conf.AuthFile != "" || conf.APIKeyFile != "" || conf.JWKS != "" || conf.URLSigningKey != "" || conf.ShareLinksFile != "" || conf.ACLFile != "" {
+				server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+		}
 		// Switch to TLS mode.
 		listen = func() error {
 			return server.ListenAndServeTLS(conf.Crt, conf.Key)
 		}
 	}
 
-	log.Info("Starting server", slog.String("dir", conf.Dir), slog.String("addr", conf.Addr), slog.Bool("tls", serveTLS), slog.Bool("log-remote-addr", conf.LogRemoteAddr), slog.Bool("read-only", conf.ReadOnly), slog.Bool("auth-enabled", conf.Auth != ""))
+	log.Info("Starting server", slog.String("dir", conf.Dir), slog.String("addr", conf.Addr), slog.Bool("tls", serveTLS), slog.Bool("log-remote-addr", conf.LogRemoteAddr), slog.Bool("read-only", conf.ReadOnly), slog.Bool("auth-enabled", conf.Auth != "" || conf.AuthFile != "" || conf.APIKeyFile != "" || conf.JWKS != "" || conf.ClientCA != ""), slog.Bool("webdav", conf.WebDAV), slog.Bool("tus", conf.Tus), slog.Bool("s3", conf.S3))
 
 	if err := listen(); err != nil {
 		log.Error("Server error", slog.Any("error", err))
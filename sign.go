@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/a-h/serve/config"
+	"github.com/a-h/serve/handlers"
+)
+
+// sign prints a pre-signed URL for a path, e.g. serve sign -expires 1h /releases/app.zip
+func sign(args []string) error {
+	fs := flag.NewFlagSet("serve sign", flag.ContinueOnError)
+	key := fs.String("key", os.Getenv("SERVE_URL_SIGNING_KEY"), "Secret key, the same as the server's -url-signing-key. (Env: SERVE_URL_SIGNING_KEY)")
+	baseURL := fs.String("base-url", "http://localhost:8080", "Scheme and host of the server.")
+	method := fs.String("method", "GET", "GET to download, or PUT or POST to upload.")
+	expires := fs.Duration("expires", time.Hour, "Duration the URL can be used for.")
+	maxSize := fs.Int64("max-size", 0, "Maximum size of an upload in bytes, 0 for no limit.")
+	ip := fs.String("ip", "", "IP address that the URL can only be used from.")
+	user := fs.String("user", "", "User that ACL rules are applied to, signed-url if not set.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: serve sign [options] <path>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected a single path to sign")
+	}
+	if len(*key) < config.MinURLSigningKeyLength {
+		return fmt.Errorf("-key must be at least %d characters", config.MinURLSigningKeyLength)
+	}
+	u, err := url.Parse(*baseURL)
+	if err != nil || u.Scheme == "" || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+		return fmt.Errorf("-base-url must be a scheme and host, e.g. https://files.example.com")
+	}
+	target, err := url.Parse(fs.Arg(0))
+	if err != nil || !strings.HasPrefix(target.Path, "/") {
+		return fmt.Errorf("path must start with /, e.g. /releases/app.zip")
+	}
+	u.Path, u.RawQuery = target.Path, target.RawQuery
+	signed, err := handlers.SignURL([]byte(*key), u, handlers.SignURLOptions{
+		Method:  strings.ToUpper(*method),
+		Expires: time.Now().Add(*expires),
+		MaxSize: *maxSize,
+		IP:      *ip,
+		User:    *user,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(signed)
+	return nil
+}